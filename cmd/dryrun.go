@@ -0,0 +1,148 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"go.uber.org/zap"
+)
+
+const dryRunCommand = "test"
+
+// dryRun converts the payload read from stdin with the subscription matching the given topic and prints the resulting
+// series in the prometheus text format. Errors are printed per metric. It returns the exit code.
+func dryRun(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet(dryRunCommand, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s %s -config config.yaml -topic <topic> < payload\n", os.Args[0], dryRunCommand)
+		flags.PrintDefaults()
+	}
+	configFile := flags.String("config", "config.yaml", "config file")
+	topic := flags.String("topic", "", "MQTT topic the payload is published to")
+	timestamps := flags.Bool("timestamps", false, "print the ingest timestamp of the series")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *topic == "" {
+		fmt.Fprintln(stderr, "-topic is required")
+		flags.Usage()
+		return 2
+	}
+
+	cfg, err := config.ReadConfig(*configFile, zap.NewNop())
+	if err != nil {
+		fmt.Fprintf(stderr, "could not load config: %v\n", err)
+		return 1
+	}
+	payload, err := io.ReadAll(stdin)
+	if err != nil {
+		fmt.Fprintf(stderr, "could not read payload: %v\n", err)
+		return 1
+	}
+	var sub *config.SubscriptionConfig
+	for i := range cfg.MQTT.Subscriptions {
+		if mqttclient.MatchTopic(cfg.MQTT.Subscriptions[i].TopicPath, *topic) {
+			sub = &cfg.MQTT.Subscriptions[i]
+			break
+		}
+	}
+	if sub == nil {
+		fmt.Fprintf(stderr, "no subscription matches the topic %q\n", *topic)
+		return 1
+	}
+	deviceID := sub.DeviceIDRegex.GroupValue(*topic, config.DeviceIDRegexGroup)
+
+	// expressions start with an empty state, to make the output reproducible
+	stateDir, err := os.MkdirTemp("", "mqtt2prometheus-test")
+	if err != nil {
+		fmt.Fprintf(stderr, "could not create state directory: %v\n", err)
+		return 1
+	}
+	defer os.RemoveAll(stateDir)
+
+	collector := metrics.NewCollector(cfg.Cache.Timeout, sub.Metrics, zap.NewNop())
+	observe := func(mc metrics.MetricCollection) {
+		if !*timestamps {
+			for i := range mc {
+				mc[i].IngestTime = time.Time{}
+			}
+		}
+		collector.Observe(deviceID, mc)
+	}
+	extract := func(s config.SubscriptionConfig) (metrics.MetricCollection, error) {
+		extractor, err := setupExtractor(s, metrics.NewParser(s.Metrics, cfg.JsonParsing.Separator, stateDir), newExtractorState(s, nil, extractorState{}))
+		if err != nil {
+			return nil, err
+		}
+		return extractor(*topic, payload, deviceID, metrics.MessageProperties{})
+	}
+
+	// Each metric is extracted on its own, so that the errors of one metric do not hide the others.
+	var failed bool
+	for _, m := range sub.Metrics {
+		single := *sub
+		single.Metrics = []config.MetricConfig{m}
+		if single.ObjectPerTopicConfig != nil {
+			objectConfig := *single.ObjectPerTopicConfig
+			objectConfig.AutoDiscover = nil
+			single.ObjectPerTopicConfig = &objectConfig
+		}
+		mc, err := extract(single)
+		if err != nil {
+			fmt.Fprintf(stderr, "error: metric %q: %v\n", m.PrometheusName, err)
+			failed = true
+			continue
+		}
+		observe(mc)
+	}
+	if sub.ObjectPerTopicConfig != nil && sub.ObjectPerTopicConfig.AutoDiscover != nil {
+		if failed {
+			fmt.Fprintln(stderr, "error: auto_discover: skipped because of the errors above")
+		} else if mc, err := extract(*sub); err != nil {
+			fmt.Fprintf(stderr, "error: auto_discover: %v\n", err)
+			failed = true
+		} else {
+			observe(mc)
+		}
+	}
+	if sub.HomieConfig != nil {
+		// without the retained attributes, only the device state is extracted
+		if mc, err := extract(*sub); err != nil {
+			fmt.Fprintf(stderr, "error: homie_config: %v\n", err)
+			failed = true
+		} else {
+			observe(mc)
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(collector); err != nil {
+		fmt.Fprintf(stderr, "could not register metrics: %v\n", err)
+		return 1
+	}
+	families, err := registry.Gather()
+	if err != nil {
+		fmt.Fprintf(stderr, "error: %v\n", err)
+		failed = true
+	}
+	encoder := expfmt.NewEncoder(stdout, expfmt.NewFormat(expfmt.TypeTextPlain))
+	for _, family := range families {
+		if err := encoder.Encode(family); err != nil {
+			fmt.Fprintf(stderr, "could not encode metrics: %v\n", err)
+			return 1
+		}
+	}
+	if failed {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const dryRunTestConfig = `
+mqtt:
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+      device_id_regex: "tele/(?P<deviceid>.*)/SENSOR"
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+    help: DHT22 temperature
+    type: gauge
+`
+
+func TestDryRun(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, configFile, dryRunTestConfig)
+
+	tests := []struct {
+		name       string
+		args       []string
+		payload    string
+		wantCode   int
+		wantStdout string
+		wantStderr string
+	}{
+		{
+			name:     "matching topic",
+			args:     []string{"-config", configFile, "-topic", "tele/dht22/SENSOR"},
+			payload:  `{"temperature": 21.5}`,
+			wantCode: 0,
+			wantStdout: `# HELP temperature DHT22 temperature
+# TYPE temperature gauge
+temperature{sensor="dht22",topic="tele/dht22/SENSOR"} 21.5
+`,
+		},
+		{
+			name:       "no matching subscription",
+			args:       []string{"-config", configFile, "-topic", "stat/dht22/POWER"},
+			payload:    `{"temperature": 21.5}`,
+			wantCode:   1,
+			wantStderr: "no subscription matches the topic \"stat/dht22/POWER\"\n",
+		},
+		{
+			name:       "invalid payload",
+			args:       []string{"-config", configFile, "-topic", "tele/dht22/SENSOR"},
+			payload:    `{"temperature": "warm"}`,
+			wantCode:   1,
+			wantStderr: "error: metric \"temperature\": ",
+		},
+		{
+			name:       "bad config path",
+			args:       []string{"-config", filepath.Join(t.TempDir(), "missing.yaml"), "-topic", "tele/dht22/SENSOR"},
+			wantCode:   1,
+			wantStderr: "could not load config: ",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var stdout, stderr bytes.Buffer
+			code := dryRun(tt.args, strings.NewReader(tt.payload), &stdout, &stderr)
+			if code != tt.wantCode {
+				t.Errorf("dryRun() = %d, want %d", code, tt.wantCode)
+			}
+			if got := stdout.String(); got != tt.wantStdout {
+				t.Errorf("got stdout\n%s\nwant\n%s", got, tt.wantStdout)
+			}
+			if got := stderr.String(); !strings.HasPrefix(got, tt.wantStderr) || (tt.wantStderr == "") != (got == "") {
+				t.Errorf("got stderr %q, want prefix %q", got, tt.wantStderr)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
@@ -9,17 +10,21 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/go-kit/kit/log"
 	kitzap "github.com/go-kit/kit/log/zap"
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
 	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
 	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	"github.com/hikhvar/mqtt2prometheus/pkg/otlp"
+	"github.com/hikhvar/mqtt2prometheus/pkg/remotewrite"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/exporter-toolkit/web"
@@ -64,6 +69,11 @@ var (
 		"",
 		"[EXPERIMENTAL] Path to configuration file that can enable TLS or authentication for metric scraping.",
 	)
+	shutdownTimeoutFlag = flag.Duration(
+		"shutdown-timeout",
+		10*time.Second,
+		"maximum time to wait for in-flight messages, the metric state flush and the HTTP server during shutdown",
+	)
 	usePasswordFromFile = flag.Bool(
 		"treat-mqtt-password-as-file-name",
 		false,
@@ -77,45 +87,27 @@ func main() {
 		mustShowVersion()
 		os.Exit(0)
 	}
+	if flag.Arg(0) == dryRunCommand {
+		os.Exit(dryRun(flag.Args()[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
 	logger := mustSetupLogger()
 	defer logger.Sync() //nolint:errcheck
 	c := make(chan os.Signal, 1)
-	cfg, err := config.LoadConfig(*configFlag, logger)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	cfg, err := loadConfig(logger)
 	if err != nil {
 		logger.Fatal("Could not load config", zap.Error(err))
 	}
 
-	mqtt_user := os.Getenv("MQTT2PROM_MQTT_USER")
-	if mqtt_user != "" {
-		cfg.MQTT.User = mqtt_user
-	}
-
-	mqtt_password := os.Getenv("MQTT2PROM_MQTT_PASSWORD")
-	if *usePasswordFromFile {
-		if mqtt_password == "" {
-			logger.Fatal("MQTT2PROM_MQTT_PASSWORD is required")
-		}
-		secret, err := ioutil.ReadFile(mqtt_password)
-		if err != nil {
-			logger.Fatal("unable to read mqtt password from secret file", zap.Error(err))
-		}
-		cfg.MQTT.Password = string(secret)
-	} else {
-		if mqtt_password != "" {
-			cfg.MQTT.Password = mqtt_password
-		}
+	mqttClientOptions := mqttclient.ConnectionOptions{
+		Server:          cfg.MQTT.Server,
+		ProtocolVersion: cfg.MQTT.ProtocolVersion,
+		User:            cfg.MQTT.User,
+		Password:        cfg.MQTT.Password,
+		ClientID:        cfg.MQTT.ClientID,
 	}
-
-	mqttClientOptions := mqtt.NewClientOptions()
-	mqttClientOptions.AddBroker(cfg.MQTT.Server).SetCleanSession(true)
-	mqttClientOptions.SetAutoReconnect(true)
-	mqttClientOptions.SetUsername(cfg.MQTT.User)
-	mqttClientOptions.SetPassword(cfg.MQTT.Password)
-
-	if cfg.MQTT.ClientID != "" {
-		mqttClientOptions.SetClientID(cfg.MQTT.ClientID)
-	} else {
-		mqttClientOptions.SetClientID(mustMQTTClientID())
+	if mqttClientOptions.ClientID == "" {
+		mqttClientOptions.ClientID = mustMQTTClientID()
 	}
 
 	if cfg.MQTT.ClientCert != "" || cfg.MQTT.ClientKey != "" {
@@ -123,25 +115,67 @@ func main() {
 		if err != nil {
 			logger.Fatal("Invalid tls certificate settings", zap.Error(err))
 		}
-		mqttClientOptions.SetTLSConfig(tlsconfig)
+		mqttClientOptions.TLSConfig = tlsconfig
 	}
 
-	collector := metrics.NewCollector(cfg.Cache.Timeout, cfg.Metrics, logger)
-	extractor, err := setupExtractor(cfg)
+	var collector metrics.Collector = metrics.NewLimitedCollector(cfg.Cache.Timeout, cfg.Cache.SeriesLimit, cfg.AllMetrics(), logger)
+	var snapshotFile string
+	stopSnapshots := func() {}
+	if cfg.Cache.SnapshotInterval > 0 {
+		snapshotFile = cfg.Cache.SnapshotFile()
+		restoreSnapshot(cfg.Cache, collector, logger)
+		var ctx context.Context
+		ctx, stopSnapshots = context.WithCancel(context.Background())
+		go runSnapshots(ctx, cfg.Cache, collector, logger)
+	}
+	var writer *remotewrite.Writer
+	stopRemoteWrite := func() {}
+	if cfg.RemoteWrite != nil {
+		if writer, collector, err = setupRemoteWrite(cfg, collector, logger); err != nil {
+			logger.Fatal("could not setup remote write", zap.Error(err))
+		}
+		var ctx context.Context
+		ctx, stopRemoteWrite = context.WithCancel(context.Background())
+		go writer.Run(ctx)
+	}
+	var otlpExporter *otlp.Exporter
+	stopOTLP := func() {}
+	if cfg.OTLP != nil {
+		if otlpExporter, collector, err = setupOTLP(cfg, collector, logger); err != nil {
+			logger.Fatal("could not setup OTLP export", zap.Error(err))
+		}
+		var ctx context.Context
+		ctx, stopOTLP = context.WithCancel(context.Background())
+		go otlpExporter.Run(ctx)
+	}
+	devices := metrics.NewDeviceTracker(cfg.Cache.DeviceRetention)
+	errorChan := make(chan error, 1)
+	pipelines, err := setupPipelines(cfg, collector, nil)
 	if err != nil {
 		logger.Fatal("could not setup a metric extractor", zap.Error(err))
 	}
-	ingest := metrics.NewIngest(collector, extractor, cfg.MQTT.DeviceIDRegex)
-	mqttClientOptions.SetOnConnectHandler(ingest.OnConnectHandler)
-	mqttClientOptions.SetConnectionLostHandler(ingest.ConnectionLostHandler)
-	errorChan := make(chan error, 1)
+	for i := range pipelines {
+		pipelines[i].ingest = metrics.NewIngest(collector, devices, pipelines[i].extractor, pipelines[i].subscription.DeviceIDRegex, cfg.Sharding)
+	}
+	availability := setupAvailability(cfg, collector, devices)
+	var discovery *metrics.HomeAssistantDiscovery
+	if cfg.MQTT.HomeAssistantDiscovery != nil {
+		discovery = metrics.NewHomeAssistantDiscovery(*cfg.MQTT.HomeAssistantDiscovery, cfg.JsonParsing.Separator, cfg.Cache.StateDir, collector, devices, cfg.Sharding)
+	}
+	// All ingests and the discovery share the same instrumentation, so one of them is used to track the connection state.
+	var instrumentation instrumented = discovery
+	if len(pipelines) > 0 {
+		instrumentation = pipelines[0].ingest
+	}
+	mqttClientOptions.OnConnect = instrumentation.OnConnectHandler
+	mqttClientOptions.OnConnectionLost = instrumentation.ConnectionLostHandler
 
+	var client *mqttclient.Client
 	for {
-		err = mqttclient.Subscribe(mqttClientOptions, mqttclient.SubscribeOptions{
-			Topic:             cfg.MQTT.TopicPath,
-			QoS:               cfg.MQTT.QoS,
-			OnMessageReceived: ingest.SetupSubscriptionHandler(errorChan),
-			Logger:            logger,
+		client, err = mqttclient.Subscribe(mqttClientOptions, mqttclient.SubscribeOptions{
+			Subscriptions:           subscriptions(pipelines, availability, discovery, errorChan),
+			SharedSubscriptionGroup: cfg.MQTT.SharedGroup,
+			Logger:                  logger,
 		})
 		if err == nil {
 			// connected, break loop
@@ -150,33 +184,100 @@ func main() {
 		logger.Warn("could not connect to mqtt broker, sleep 10 second", zap.Error(err))
 		time.Sleep(10 * time.Second)
 	}
+	stopDiscovery := func() {}
+	if discovery != nil {
+		var ctx context.Context
+		ctx, stopDiscovery = context.WithCancel(context.Background())
+		go discovery.Run(ctx, client, errorChan)
+	}
+
+	e := &exporter{
+		cfg:             cfg,
+		collector:       collector,
+		devices:         devices,
+		pipelines:       pipelines,
+		availability:    availability,
+		discovery:       discovery,
+		stopDiscovery:   stopDiscovery,
+		client:          client,
+		remoteWrite:     writer,
+		stopRemoteWrite: stopRemoteWrite,
+		otlp:            otlpExporter,
+		stopOTLP:        stopOTLP,
+		snapshotFile:    snapshotFile,
+		stopSnapshots:   stopSnapshots,
+		errorChan:       errorChan,
+		logger:          logger,
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
 
 	var gatherer prometheus.Gatherer
 	if cfg.EnableProfiling {
 		gatherer = prometheus.DefaultGatherer
 	} else {
 		reg := prometheus.NewRegistry()
-		reg.MustRegister(ingest.Collector())
+		reg.MustRegister(instrumentation.Collector())
 		reg.MustRegister(collector)
+		reg.MustRegister(devices)
+		if cfg.Sharding != nil || cfg.MQTT.SharedGroup != "" {
+			reg.MustRegister(metrics.NewShardInfo(cfg.Sharding, cfg.MQTT.SharedGroup))
+		}
+		if writer != nil {
+			reg.MustRegister(writer.Collector())
+		}
+		if otlpExporter != nil {
+			reg.MustRegister(otlpExporter.Collector())
+		}
 		gatherer = reg
 	}
 	http.Handle("/metrics", promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{}))
+	http.Handle("/-/reload", e)
 	s := &http.Server{
 		Addr:    getListenAddress(),
 		Handler: http.DefaultServeMux,
 	}
 	go func() {
-		err = web.ListenAndServe(s, *webConfigFlag, setupGoKitLogger(logger))
-		if err != nil {
+		err := web.ListenAndServe(s, *webConfigFlag, setupGoKitLogger(logger))
+		if err != nil && err != http.ErrServerClosed {
 			logger.Fatal("Error while serving http", zap.Error(err))
 		}
 	}()
 
+	shutdownDone := make(chan error, 1)
+	shuttingDown := false
 	for {
 		select {
-		case <-c:
-			logger.Info("Terminated via Signal. Stop.")
-			os.Exit(0)
+		case sig := <-c:
+			if shuttingDown {
+				logger.Warn("Terminated via Signal during shutdown. Stop immediately.", zap.String("signal", sig.String()))
+				logger.Sync() //nolint:errcheck
+				os.Exit(1)
+			}
+			shuttingDown = true
+			logger.Info("Terminated via Signal. Shutting down.", zap.String("signal", sig.String()))
+			// Shutdown asynchronously, message handlers may block on errorChan while we drain them.
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeoutFlag)
+				defer cancel()
+				shutdownDone <- e.shutdown(ctx, s)
+			}()
+		case err := <-shutdownDone:
+			if err != nil {
+				logger.Error("Could not shut down gracefully", zap.Error(err))
+				logger.Sync() //nolint:errcheck
+				os.Exit(1)
+			}
+			logger.Info("Stopped.")
+			return
+		case <-hup:
+			logger.Info("Reload config via signal")
+			// Reload asynchronously, message handlers may block on errorChan while we resubscribe.
+			go func() {
+				if err := e.reload(); err != nil {
+					logger.Error("Could not reload config", zap.Error(err))
+				}
+			}()
 		case err = <-errorChan:
 			logger.Error("Error while processing message", zap.Error(err))
 		}
@@ -233,18 +334,90 @@ func setupGoKitLogger(l *zap.Logger) log.Logger {
 	return kitzap.NewZapSugarLogger(l, zap.NewAtomicLevelAt(*logLevelFlag).Level())
 }
 
-func setupExtractor(cfg config.Config) (metrics.Extractor, error) {
-	parser := metrics.NewParser(cfg.Metrics, cfg.JsonParsing.Separator, cfg.Cache.StateDir)
-	if cfg.MQTT.ObjectPerTopicConfig != nil {
-		switch cfg.MQTT.ObjectPerTopicConfig.Encoding {
-		case config.EncodingJSON:
-			return metrics.NewJSONObjectExtractor(parser), nil
+func loadConfig(logger *zap.Logger) (config.Config, error) {
+	cfg, err := config.LoadConfig(*configFlag, logger)
+	if err != nil {
+		return cfg, err
+	}
+
+	mqtt_user := os.Getenv("MQTT2PROM_MQTT_USER")
+	if mqtt_user != "" {
+		cfg.MQTT.User = mqtt_user
+	}
+
+	mqtt_password := os.Getenv("MQTT2PROM_MQTT_PASSWORD")
+	if *usePasswordFromFile {
+		if mqtt_password == "" {
+			return cfg, fmt.Errorf("MQTT2PROM_MQTT_PASSWORD is required")
+		}
+		secret, err := ioutil.ReadFile(mqtt_password)
+		if err != nil {
+			return cfg, fmt.Errorf("unable to read mqtt password from secret file: %w", err)
+		}
+		cfg.MQTT.Password = string(secret)
+	} else {
+		if mqtt_password != "" {
+			cfg.MQTT.Password = mqtt_password
+		}
+	}
+
+	if shardIndex := os.Getenv("MQTT2PROM_SHARD_INDEX"); shardIndex != "" {
+		if cfg.Sharding == nil {
+			return cfg, fmt.Errorf("MQTT2PROM_SHARD_INDEX requires a sharding config")
+		}
+		index, err := strconv.ParseUint(shardIndex, 10, 0)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid MQTT2PROM_SHARD_INDEX: %w", err)
+		}
+		if uint(index) >= cfg.Sharding.Shards {
+			return cfg, fmt.Errorf("MQTT2PROM_SHARD_INDEX %d must be smaller than sharding.shards %d", index, cfg.Sharding.Shards)
+		}
+		cfg.Sharding.Index = uint(index)
+	}
+	return cfg, nil
+}
+
+func setupExtractor(sub config.SubscriptionConfig, parser metrics.Parser, state extractorState) (metrics.Extractor, error) {
+	extractor, err := newExtractor(sub, parser, state)
+	if err != nil {
+		return nil, err
+	}
+	if len(sub.TopicLabels()) > 0 {
+		extractor = metrics.WithTopicLabels(extractor, sub.TopicLabelValues)
+	}
+	if sub.TimestampField != "" {
+		extractor = metrics.WithPayloadTimestamp(extractor, parser, sub.TimestampConfig)
+	}
+	if sub.ObjectPerTopicConfig != nil {
+		switch sub.ObjectPerTopicConfig.Encoding {
+		case config.EncodingMsgpack:
+			extractor = metrics.WithPayloadDecoder(extractor, metrics.DecodeMsgpack)
+		case config.EncodingCBOR:
+			extractor = metrics.WithPayloadDecoder(extractor, metrics.DecodeCBOR)
+		}
+	}
+	return extractor, nil
+}
+
+func newExtractor(sub config.SubscriptionConfig, parser metrics.Parser, state extractorState) (metrics.Extractor, error) {
+	if sub.ObjectPerTopicConfig != nil {
+		switch sub.ObjectPerTopicConfig.Encoding {
+		case config.EncodingJSON, config.EncodingMsgpack, config.EncodingCBOR:
+			// binary payloads are converted to JSON in setupExtractor
+			return metrics.NewJSONObjectExtractor(parser, sub.ObjectPerTopicConfig.AutoDiscover), nil
+		case config.EncodingInfluxLine:
+			return metrics.NewInfluxLineExtractor(parser), nil
+		case config.EncodingSparkplugB:
+			return metrics.NewSparkplugExtractor(parser, state.sparkplug), nil
 		default:
-			return nil, fmt.Errorf("unsupported object format: %s", cfg.MQTT.ObjectPerTopicConfig.Encoding)
+			return nil, fmt.Errorf("unsupported object format: %s", sub.ObjectPerTopicConfig.Encoding)
 		}
 	}
-	if cfg.MQTT.MetricPerTopicConfig != nil {
-		return metrics.NewMetricPerTopicExtractor(parser, cfg.MQTT.MetricPerTopicConfig.MetricNameRegex), nil
+	if sub.MetricPerTopicConfig != nil {
+		return metrics.NewMetricPerTopicExtractor(parser, sub.MetricPerTopicConfig.MetricNameRegex), nil
+	}
+	if sub.HomieConfig != nil {
+		return metrics.NewHomieExtractor(parser, sub.HomieConfig, state.homie), nil
 	}
 	return nil, fmt.Errorf("no extractor configured")
 }
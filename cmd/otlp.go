@@ -0,0 +1,23 @@
+package main
+
+import (
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
+	"github.com/hikhvar/mqtt2prometheus/pkg/otlp"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// setupOTLP creates the OTLP exporter for the metrics of the given collector. The returned collector must be used by
+// the ingests.
+func setupOTLP(cfg config.Config, collector metrics.Collector, logger *zap.Logger) (*otlp.Exporter, metrics.Collector, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(collector); err != nil {
+		return nil, nil, err
+	}
+	exporter, err := otlp.New(*cfg.OTLP, reg, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return exporter, notifyingCollector{Collector: collector, notify: exporter.Notify}, nil
+}
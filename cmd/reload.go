@@ -0,0 +1,289 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	"github.com/hikhvar/mqtt2prometheus/pkg/otlp"
+	"github.com/hikhvar/mqtt2prometheus/pkg/remotewrite"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// pipeline holds everything needed to turn the messages of a single subscription into metrics.
+type pipeline struct {
+	subscription config.SubscriptionConfig
+	parser       metrics.Parser
+	extractor    metrics.Extractor
+	ingest       *metrics.Ingest
+	state        extractorState
+}
+
+// extractorState is the state of the Homie and Sparkplug B extractors, which is kept during a config reload.
+type extractorState struct {
+	homie     *metrics.HomieDevices
+	sparkplug *metrics.SparkplugNodes
+}
+
+// newExtractorState creates the state needed by the extractor of the subscription. The state of the previous extractor
+// is kept. The collector expires the metrics of dead Sparkplug B nodes and deletes the series of renamed Homie
+// properties, it may be nil.
+func newExtractorState(sub config.SubscriptionConfig, collector metrics.Collector, previous extractorState) extractorState {
+	var state extractorState
+	if sub.HomieConfig != nil {
+		state.homie = previous.homie
+		if state.homie == nil {
+			state.homie = metrics.NewHomieDevices(collector)
+		}
+	}
+	if sub.ObjectPerTopicConfig != nil && sub.ObjectPerTopicConfig.Encoding == config.EncodingSparkplugB {
+		state.sparkplug = previous.sparkplug
+		if state.sparkplug == nil {
+			state.sparkplug = metrics.NewSparkplugNodes(collector)
+		}
+	}
+	return state
+}
+
+// setupPipelines creates a pipeline without ingest per subscription. All parsers share their state with each other and
+// with the parsers of the previous pipelines. The extractors keep the state of the previous pipeline at the same
+// position.
+func setupPipelines(cfg config.Config, collector metrics.Collector, previous []pipeline) ([]pipeline, error) {
+	var pipelines []pipeline
+	for i, sub := range cfg.MQTT.Subscriptions {
+		parser := metrics.NewParser(sub.Metrics, cfg.JsonParsing.Separator, cfg.Cache.StateDir)
+		if len(pipelines) > 0 {
+			parser.InheritState(pipelines[0].parser)
+		} else if len(previous) > 0 {
+			parser.InheritState(previous[0].parser)
+		}
+		var state extractorState
+		if i < len(previous) {
+			state = previous[i].state
+		}
+		state = newExtractorState(sub, collector, state)
+		extractor, err := setupExtractor(sub, parser, state)
+		if err != nil {
+			return nil, fmt.Errorf("subscription %q: %w", sub.TopicPath, err)
+		}
+		pipelines = append(pipelines, pipeline{
+			subscription: sub,
+			parser:       parser,
+			extractor:    extractor,
+			state:        state,
+		})
+	}
+	return pipelines, nil
+}
+
+// availabilityTopic tracks the device availability of a single availability topic.
+type availabilityTopic struct {
+	config       config.AvailabilityConfig
+	availability *metrics.Availability
+}
+
+// setupAvailability creates the availability tracking of every availability topic.
+func setupAvailability(cfg config.Config, collector metrics.Collector, devices *metrics.DeviceTracker) []availabilityTopic {
+	var topics []availabilityTopic
+	for _, a := range cfg.MQTT.Availability {
+		topics = append(topics, availabilityTopic{
+			config:       a,
+			availability: metrics.NewAvailability(a, cfg.JsonParsing.Separator, collector, devices, cfg.Sharding),
+		})
+	}
+	return topics
+}
+
+// instrumented is implemented by the ingests and the discovery, which all share the same instrumentation.
+type instrumented interface {
+	Collector() prometheus.Collector
+	OnConnectHandler()
+	ConnectionLostHandler(err error)
+}
+
+func subscriptions(pipelines []pipeline, availability []availabilityTopic, discovery *metrics.HomeAssistantDiscovery, errorChan chan<- error) []mqttclient.Subscription {
+	var subs []mqttclient.Subscription
+	for _, p := range pipelines {
+		subs = append(subs, mqttclient.Subscription{
+			Topic:             p.subscription.TopicPath,
+			QoS:               p.subscription.QoS,
+			OnMessageReceived: p.ingest.SetupSubscriptionHandler(errorChan),
+		})
+	}
+	for _, a := range availability {
+		subs = append(subs, mqttclient.Subscription{
+			Topic:             a.config.TopicPath,
+			QoS:               a.config.QoS,
+			OnMessageReceived: a.availability.SetupSubscriptionHandler(errorChan),
+		})
+	}
+	if discovery != nil {
+		subs = append(subs, discovery.Subscriptions(errorChan)...)
+	}
+	return subs
+}
+
+// topicsChanged reports whether the topic settings of the given pipelines differ.
+func topicsChanged(previous, current []pipeline) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+	for i := range previous {
+		if previous[i].subscription.TopicPath != current[i].subscription.TopicPath || previous[i].subscription.QoS != current[i].subscription.QoS {
+			return true
+		}
+	}
+	return false
+}
+
+// availabilityTopicsChanged reports whether the topic settings of the given availability topics differ.
+func availabilityTopicsChanged(previous, current []availabilityTopic) bool {
+	if len(previous) != len(current) {
+		return true
+	}
+	for i := range previous {
+		if previous[i].config.TopicPath != current[i].config.TopicPath || previous[i].config.QoS != current[i].config.QoS {
+			return true
+		}
+	}
+	return false
+}
+
+// brokerClient is the part of the MQTT client which is used by reloads and the shutdown.
+type brokerClient interface {
+	shutdownClient
+	Resubscribe(subscriptions []mqttclient.Subscription) error
+}
+
+// exporter holds the runtime state which is replaced during a reload or torn down during a shutdown.
+type exporter struct {
+	lock        sync.Mutex
+	cfg         config.Config
+	collector   metrics.Collector
+	devices     *metrics.DeviceTracker
+	pipelines   []pipeline
+	client      brokerClient
+	remoteWrite *remotewrite.Writer
+	// stopRemoteWrite stops the periodic pushes of the remote write
+	stopRemoteWrite func()
+	otlp            *otlp.Exporter
+	// stopOTLP stops the periodic pushes of the OTLP exporter
+	stopOTLP func()
+	// snapshotFile is empty if the cache is not persisted
+	snapshotFile string
+	// stopSnapshots stops the periodic snapshots of the cache
+	stopSnapshots func()
+	// availability has an entry per availability topic
+	availability []availabilityTopic
+	// discovery is nil if the Home Assistant discovery is disabled
+	discovery *metrics.HomeAssistantDiscovery
+	// stopDiscovery stops subscribing to the state topics of discovered entities
+	stopDiscovery func()
+	errorChan     chan<- error
+	logger        *zap.Logger
+}
+
+// reload applies changes of the config file without restarting the process or reconnecting to the broker.
+func (e *exporter) reload() error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	cfg, err := loadConfig(e.logger)
+	if err != nil {
+		return fmt.Errorf("could not load config: %w", err)
+	}
+	e.warnUnreloadableChanges(cfg)
+	// Keep the settings of the running client and ingests until the next restart.
+	cfg.Sharding = e.cfg.Sharding
+	cfg.MQTT.SharedGroup = e.cfg.MQTT.SharedGroup
+	cfg.RemoteWrite = e.cfg.RemoteWrite
+	cfg.OTLP = e.cfg.OTLP
+	cfg.MQTT.HomeAssistantDiscovery = e.cfg.MQTT.HomeAssistantDiscovery
+
+	pipelines, err := setupPipelines(cfg, e.collector, e.pipelines)
+	if err != nil {
+		return fmt.Errorf("could not setup a metric extractor: %w", err)
+	}
+
+	availability := setupAvailability(cfg, e.collector, e.devices)
+	if topicsChanged(e.pipelines, pipelines) || availabilityTopicsChanged(e.availability, availability) {
+		for i := range pipelines {
+			pipelines[i].ingest = metrics.NewIngest(e.collector, e.devices, pipelines[i].extractor, pipelines[i].subscription.DeviceIDRegex, e.cfg.Sharding)
+		}
+		if err := e.client.Resubscribe(subscriptions(pipelines, availability, e.discovery, e.errorChan)); err != nil {
+			return err
+		}
+	} else {
+		for i := range pipelines {
+			pipelines[i].ingest = e.pipelines[i].ingest
+			pipelines[i].ingest.Update(pipelines[i].extractor, pipelines[i].subscription.DeviceIDRegex)
+		}
+		for i := range availability {
+			availability[i].availability = e.availability[i].availability
+			availability[i].availability.Update(availability[i].config, cfg.JsonParsing.Separator)
+		}
+	}
+	e.collector.Update(cfg.AllMetrics())
+
+	e.cfg = cfg
+	e.pipelines = pipelines
+	e.availability = availability
+	e.logger.Info("Reloaded config", zap.String("config", *configFlag))
+	return nil
+}
+
+// warnUnreloadableChanges logs a warning for every changed setting which requires a restart.
+func (e *exporter) warnUnreloadableChanges(cfg config.Config) {
+	previous, current := e.cfg.MQTT, cfg.MQTT
+	if previous.Server != current.Server || previous.ProtocolVersion != current.ProtocolVersion || previous.User != current.User || previous.Password != current.Password ||
+		previous.ClientID != current.ClientID || previous.CACert != current.CACert ||
+		previous.ClientCert != current.ClientCert || previous.ClientKey != current.ClientKey ||
+		previous.SharedGroup != current.SharedGroup {
+		e.logger.Warn("Changes of the MQTT connection settings require a restart")
+	}
+	if !reflect.DeepEqual(e.cfg.Sharding, cfg.Sharding) {
+		e.logger.Warn("Changes of the sharding settings require a restart")
+	}
+	if e.cfg.Cache.Timeout != cfg.Cache.Timeout {
+		e.logger.Warn("Changes of the cache timeout require a restart")
+	}
+	if e.cfg.Cache.SnapshotInterval != cfg.Cache.SnapshotInterval || e.cfg.Cache.StateDir != cfg.Cache.StateDir {
+		e.logger.Warn("Changes of cache.snapshot_interval or cache.state_directory require a restart")
+	}
+	if e.cfg.Cache.DeviceRetention != cfg.Cache.DeviceRetention {
+		e.logger.Warn("Changes of cache.device_retention require a restart")
+	}
+	if !reflect.DeepEqual(e.cfg.Cache.SeriesLimit, cfg.Cache.SeriesLimit) {
+		e.logger.Warn("Changes of cache.series_limit require a restart")
+	}
+	if !reflect.DeepEqual(previous.HomeAssistantDiscovery, current.HomeAssistantDiscovery) {
+		e.logger.Warn("Changes of mqtt.homeassistant_discovery require a restart")
+	}
+	if !reflect.DeepEqual(e.cfg.RemoteWrite, cfg.RemoteWrite) {
+		e.logger.Warn("Changes of the remote_write settings require a restart")
+	}
+	if !reflect.DeepEqual(e.cfg.OTLP, cfg.OTLP) {
+		e.logger.Warn("Changes of the otlp settings require a restart")
+	}
+	if e.cfg.EnableProfiling != cfg.EnableProfiling {
+		e.logger.Warn("Changes of enable_profiling_metrics require a restart")
+	}
+}
+
+// ServeHTTP triggers a reload on POST requests.
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := e.reload(); err != nil {
+		e.logger.Error("Could not reload config", zap.Error(err))
+		http.Error(w, fmt.Sprintf("failed to reload config: %s", err), http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeClient records the calls of the exporter instead of talking to a broker.
+type fakeClient struct {
+	// resubscribed has the topics of every Resubscribe call
+	resubscribed [][]string
+}
+
+func (c *fakeClient) Resubscribe(subscriptions []mqttclient.Subscription) error {
+	var topics []string
+	for _, s := range subscriptions {
+		topics = append(topics, s.Topic)
+	}
+	c.resubscribed = append(c.resubscribed, topics)
+	return nil
+}
+
+func (c *fakeClient) UnsubscribeAll() error { return nil }
+
+func (c *fakeClient) Disconnect(quiesce uint) {}
+
+const reloadTestConfig = `
+mqtt:
+  server: tcp://127.0.0.1:1883
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+    - topic_path: spBv1.0/#
+      object_per_topic_config:
+        encoding: SPARKPLUG_B
+cache:
+  timeout: 1h
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`
+
+// newTestExporter sets up an exporter like main does, with a fake client and a logger which records the warnings.
+func newTestExporter(t *testing.T, cfgText string) (*exporter, *fakeClient, *observer.ObservedLogs) {
+	t.Helper()
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	writeTestConfig(t, configFile, cfgText)
+	previous := *configFlag
+	*configFlag = configFile
+	t.Cleanup(func() { *configFlag = previous })
+
+	core, logs := observer.New(zapcore.WarnLevel)
+	logger := zap.New(core)
+	config.SetProcessContext(logger)
+	cfg, err := loadConfig(logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	collector := metrics.NewCollector(cfg.Cache.Timeout, cfg.AllMetrics(), logger)
+	devices := metrics.NewDeviceTracker(cfg.Cache.DeviceRetention)
+	pipelines, err := setupPipelines(cfg, collector, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range pipelines {
+		pipelines[i].ingest = metrics.NewIngest(collector, devices, pipelines[i].extractor, pipelines[i].subscription.DeviceIDRegex, cfg.Sharding)
+	}
+	client := &fakeClient{}
+	e := &exporter{
+		cfg:       cfg,
+		collector: collector,
+		devices:   devices,
+		pipelines: pipelines,
+		client:    client,
+		errorChan: make(chan error, 10),
+		logger:    logger,
+	}
+	return e, client, logs
+}
+
+func writeTestConfig(t *testing.T, file, cfgText string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(cfgText), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExporter_reload(t *testing.T) {
+	tests := []struct {
+		name             string
+		config           string
+		wantErr          bool
+		wantTopics       []string
+		wantResubscribed [][]string
+		// wantKeptIngests is true if the ingests of the previous pipelines are reused
+		wantKeptIngests bool
+		wantWarnings    []string
+		// wantCollected is true if the temperature observed before the reload is still collected
+		wantCollected bool
+	}{
+		{
+			name:            "unchanged config",
+			config:          reloadTestConfig,
+			wantTopics:      []string{"tele/+/SENSOR", "spBv1.0/#"},
+			wantKeptIngests: true,
+			wantCollected:   true,
+		},
+		{
+			name: "added metric",
+			config: `
+mqtt:
+  server: tcp://127.0.0.1:1883
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+    - topic_path: spBv1.0/#
+      object_per_topic_config:
+        encoding: SPARKPLUG_B
+cache:
+  timeout: 1h
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+  - prom_name: humidity
+    mqtt_name: humidity
+`,
+			wantTopics:      []string{"tele/+/SENSOR", "spBv1.0/#"},
+			wantKeptIngests: true,
+			wantCollected:   true,
+		},
+		{
+			name: "changed metric",
+			config: `
+mqtt:
+  server: tcp://127.0.0.1:1883
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+    - topic_path: spBv1.0/#
+      object_per_topic_config:
+        encoding: SPARKPLUG_B
+cache:
+  timeout: 1h
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+    help: Temperature in °C
+`,
+			wantTopics:      []string{"tele/+/SENSOR", "spBv1.0/#"},
+			wantKeptIngests: true,
+		},
+		{
+			name: "added subscription",
+			config: `
+mqtt:
+  server: tcp://127.0.0.1:1883
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+    - topic_path: spBv1.0/#
+      object_per_topic_config:
+        encoding: SPARKPLUG_B
+    - topic_path: shellies/+/status
+cache:
+  timeout: 1h
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`,
+			wantTopics:       []string{"tele/+/SENSOR", "spBv1.0/#", "shellies/+/status"},
+			wantResubscribed: [][]string{{"tele/+/SENSOR", "spBv1.0/#", "shellies/+/status"}},
+			wantCollected:    true,
+		},
+		{
+			name: "removed subscription",
+			config: `
+mqtt:
+  server: tcp://127.0.0.1:1883
+  topic_path: tele/+/SENSOR
+cache:
+  timeout: 1h
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`,
+			wantTopics:       []string{"tele/+/SENSOR"},
+			wantResubscribed: [][]string{{"tele/+/SENSOR"}},
+			// the temperature loses the Sparkplug B topic labels of the removed subscription
+			wantCollected: false,
+		},
+		{
+			name: "invalid config",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+      metric_per_topic_config:
+        metric_name_regex: "tele/(?P<other>.*)"
+`,
+			wantErr:         true,
+			wantTopics:      []string{"tele/+/SENSOR", "spBv1.0/#"},
+			wantKeptIngests: true,
+			wantCollected:   true,
+		},
+		{
+			name: "settings which require a restart",
+			config: `
+mqtt:
+  server: tcp://broker:1883
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+    - topic_path: spBv1.0/#
+      object_per_topic_config:
+        encoding: SPARKPLUG_B
+sharding:
+  shards: 2
+cache:
+  timeout: 2h
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`,
+			wantTopics:      []string{"tele/+/SENSOR", "spBv1.0/#"},
+			wantKeptIngests: true,
+			wantWarnings: []string{
+				"Changes of the MQTT connection settings require a restart",
+				"Changes of the sharding settings require a restart",
+				"Changes of the cache timeout require a restart",
+			},
+			wantCollected: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e, client, logs := newTestExporter(t, reloadTestConfig)
+			errs := make(chan error, 1)
+			e.pipelines[0].ingest.SetupSubscriptionHandler(errs)(mqttclient.Message{Topic: "tele/sensor-1/SENSOR", Payload: []byte(`{"temperature": 21.5}`)})
+			if len(errs) > 0 {
+				t.Fatal(<-errs)
+			}
+			previous := e.pipelines
+			writeTestConfig(t, *configFlag, tt.config)
+
+			err := e.reload()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("reload() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			var topics []string
+			for _, p := range e.pipelines {
+				topics = append(topics, p.subscription.TopicPath)
+			}
+			if !reflect.DeepEqual(topics, tt.wantTopics) {
+				t.Errorf("got pipelines for %v, want %v", topics, tt.wantTopics)
+			}
+			if !reflect.DeepEqual(client.resubscribed, tt.wantResubscribed) {
+				t.Errorf("got resubscriptions %v, want %v", client.resubscribed, tt.wantResubscribed)
+			}
+			for i := range e.pipelines {
+				if i >= len(previous) {
+					break
+				}
+				if kept := e.pipelines[i].ingest == previous[i].ingest; kept != tt.wantKeptIngests {
+					t.Errorf("pipeline %d: ingest kept = %v, want %v", i, kept, tt.wantKeptIngests)
+				}
+				if e.pipelines[i].state.sparkplug != previous[i].state.sparkplug {
+					t.Errorf("pipeline %d: expected the Sparkplug B state to be kept", i)
+				}
+			}
+			if e.cfg.Sharding != nil {
+				t.Errorf("expected the sharding settings of the running process, got %+v", e.cfg.Sharding)
+			}
+			var warnings []string
+			for _, entry := range logs.All() {
+				warnings = append(warnings, entry.Message)
+			}
+			if !reflect.DeepEqual(warnings, tt.wantWarnings) {
+				t.Errorf("got warnings %q, want %q", warnings, tt.wantWarnings)
+			}
+			if collected := collectsTemperature(t, e.collector); collected != tt.wantCollected {
+				t.Errorf("temperature collected = %v, want %v", collected, tt.wantCollected)
+			}
+		})
+	}
+}
+
+// collectsTemperature returns true if the collector has a temperature series.
+func collectsTemperature(t *testing.T, collector prometheus.Collector) bool {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() == "temperature" {
+			return len(family.GetMetric()) > 0
+		}
+	}
+	return false
+}
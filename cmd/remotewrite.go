@@ -0,0 +1,34 @@
+package main
+
+import (
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
+	"github.com/hikhvar/mqtt2prometheus/pkg/remotewrite"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// notifyingCollector notifies a push output after every observation, to push the metrics on ingest.
+type notifyingCollector struct {
+	metrics.Collector
+	notify func()
+}
+
+func (n notifyingCollector) Observe(deviceID string, collection metrics.MetricCollection) {
+	n.Collector.Observe(deviceID, collection)
+	n.notify()
+}
+
+// setupRemoteWrite creates the remote write for the metrics of the given collector. The returned collector must be used
+// by the ingests.
+func setupRemoteWrite(cfg config.Config, collector metrics.Collector, logger *zap.Logger) (*remotewrite.Writer, metrics.Collector, error) {
+	reg := prometheus.NewRegistry()
+	if err := reg.Register(collector); err != nil {
+		return nil, nil, err
+	}
+	writer, err := remotewrite.New(*cfg.RemoteWrite, reg, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+	return writer, notifyingCollector{Collector: collector, notify: writer.Notify}, nil
+}
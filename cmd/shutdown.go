@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// mqttQuiesce is the time in milliseconds to wait for the MQTT client to complete existing work while disconnecting.
+const mqttQuiesce = 250
+
+// shutdownClient is the part of the MQTT client which is used during the shutdown.
+type shutdownClient interface {
+	UnsubscribeAll() error
+	Disconnect(quiesce uint)
+}
+
+// drainer waits for the messages which are currently processed.
+type drainer interface {
+	Drain()
+}
+
+type stateWriter interface {
+	WriteState() error
+}
+
+type snapshotWriter interface {
+	WriteSnapshot(file string) error
+}
+
+// flushSequence persists everything the exporter holds in memory before the process exits.
+type flushSequence struct {
+	client   shutdownClient
+	handlers []drainer
+	// state is nil if there are no pipelines
+	state     stateWriter
+	stateDir  string
+	collector snapshotWriter
+	// snapshotFile is empty if the cache is not persisted
+	snapshotFile string
+	// push sends the metrics a last time via remote write and OTLP
+	push   func(ctx context.Context)
+	logger *zap.Logger
+}
+
+// run stops the intake of new messages, waits for the handlers to process the received messages, writes the metric
+// state and the cache snapshot, pushes the metrics and disconnects from the broker. It gives up when the context is
+// done.
+func (s flushSequence) run(ctx context.Context) error {
+	done := make(chan error, 1)
+	go func() {
+		if err := s.client.UnsubscribeAll(); err != nil {
+			s.logger.Warn("could not unsubscribe, messages may be received until the disconnect", zap.Error(err))
+		}
+		for _, h := range s.handlers {
+			h.Drain()
+		}
+		if s.state != nil {
+			if err := s.state.WriteState(); err != nil {
+				done <- fmt.Errorf("could not write metric state: %w", err)
+				return
+			}
+			s.logger.Info("Flushed metric state", zap.String("state_directory", s.stateDir))
+		}
+		if s.snapshotFile != "" {
+			if err := s.collector.WriteSnapshot(s.snapshotFile); err != nil {
+				done <- fmt.Errorf("could not write cache snapshot: %w", err)
+				return
+			}
+			s.logger.Info("Wrote cache snapshot", zap.String("file", s.snapshotFile))
+		}
+		s.push(ctx)
+		s.client.Disconnect(mqttQuiesce)
+		done <- nil
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("could not drain messages and flush metric state: %w", ctx.Err())
+	}
+}
+
+// shutdown flushes the state of the exporter, see flushSequence.run, and stops the HTTP server. The given context
+// limits the time the shutdown may take.
+func (e *exporter) shutdown(ctx context.Context, server *http.Server) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	e.stopDiscovery()
+	e.stopSnapshots()
+	e.stopRemoteWrite()
+	e.stopOTLP()
+	s := flushSequence{
+		client:       e.client,
+		handlers:     e.drainers(),
+		stateDir:     e.cfg.Cache.StateDir,
+		collector:    e.collector,
+		snapshotFile: e.snapshotFile,
+		push:         e.push,
+		logger:       e.logger,
+	}
+	// All parsers share their state, flushing the first one flushes the state of all metrics.
+	if len(e.pipelines) > 0 {
+		s.state = &e.pipelines[0].parser
+	}
+	if err := s.run(ctx); err != nil {
+		return err
+	}
+
+	if err := server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("could not stop http server: %w", err)
+	}
+	return nil
+}
+
+// drainers returns the handlers of all subscriptions: the ingests, the availability tracking and the discovery.
+func (e *exporter) drainers() []drainer {
+	var handlers []drainer
+	for _, p := range e.pipelines {
+		handlers = append(handlers, p.ingest)
+	}
+	for _, a := range e.availability {
+		handlers = append(handlers, a.availability)
+	}
+	if e.discovery != nil {
+		handlers = append(handlers, e.discovery)
+	}
+	return handlers
+}
+
+// push pushes the metrics a last time via remote write and OTLP. Errors are logged, unsent remote write requests stay
+// in the queue and are sent after the next start.
+func (e *exporter) push(ctx context.Context) {
+	if e.remoteWrite != nil {
+		if err := e.remoteWrite.Push(ctx); err != nil {
+			e.logger.Warn("could not push metrics via remote write", zap.Error(err))
+		}
+	}
+	if e.otlp != nil {
+		if err := e.otlp.Push(ctx); err != nil {
+			e.logger.Warn("could not export metrics via OTLP", zap.Error(err))
+		}
+		e.otlp.Close() //nolint:errcheck
+	}
+}
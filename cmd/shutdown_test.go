@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// shutdownRecorder records the steps of the shutdown in the order they are called.
+type shutdownRecorder struct {
+	lock   sync.Mutex
+	steps  []string
+	failOn string
+	// block delays the drains until it is closed, if it is not nil
+	block chan struct{}
+}
+
+func (r *shutdownRecorder) record(step string) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.steps = append(r.steps, step)
+	if step == r.failOn {
+		return errors.New("failed")
+	}
+	return nil
+}
+
+func (r *shutdownRecorder) recorded() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return append([]string(nil), r.steps...)
+}
+
+func (r *shutdownRecorder) UnsubscribeAll() error { return r.record("unsubscribe") }
+
+func (r *shutdownRecorder) Disconnect(quiesce uint) { _ = r.record("disconnect") }
+
+func (r *shutdownRecorder) Drain() {
+	if r.block != nil {
+		<-r.block
+	}
+	_ = r.record("drain")
+}
+
+func (r *shutdownRecorder) WriteState() error { return r.record("state") }
+
+func (r *shutdownRecorder) WriteSnapshot(file string) error { return r.record("snapshot " + file) }
+
+func TestFlushSequence_run(t *testing.T) {
+	tests := []struct {
+		name         string
+		withState    bool
+		snapshotFile string
+		failOn       string
+		block        bool
+		timeout      time.Duration
+		wantSteps    []string
+		wantErr      bool
+	}{
+		{
+			name:         "all steps",
+			withState:    true,
+			snapshotFile: "cache.json",
+			timeout:      time.Second,
+			wantSteps:    []string{"unsubscribe", "drain", "drain", "state", "snapshot cache.json", "push", "disconnect"},
+		},
+		{
+			name:      "without state and snapshot",
+			timeout:   time.Second,
+			wantSteps: []string{"unsubscribe", "drain", "drain", "push", "disconnect"},
+		},
+		{
+			name:      "unsubscribe fails",
+			failOn:    "unsubscribe",
+			timeout:   time.Second,
+			wantSteps: []string{"unsubscribe", "drain", "drain", "push", "disconnect"},
+		},
+		{
+			name:         "snapshot fails",
+			withState:    true,
+			snapshotFile: "cache.json",
+			failOn:       "snapshot cache.json",
+			timeout:      time.Second,
+			wantSteps:    []string{"unsubscribe", "drain", "drain", "state", "snapshot cache.json"},
+			wantErr:      true,
+		},
+		{
+			name:         "timeout while draining",
+			withState:    true,
+			snapshotFile: "cache.json",
+			block:        true,
+			timeout:      10 * time.Millisecond,
+			wantSteps:    []string{"unsubscribe"},
+			wantErr:      true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &shutdownRecorder{failOn: tt.failOn}
+			if tt.block {
+				r.block = make(chan struct{})
+				defer close(r.block)
+			}
+			s := flushSequence{
+				client:       r,
+				handlers:     []drainer{r, r},
+				collector:    r,
+				snapshotFile: tt.snapshotFile,
+				push:         func(context.Context) { _ = r.record("push") },
+				logger:       zap.NewNop(),
+			}
+			if tt.withState {
+				s.state = r
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), tt.timeout)
+			defer cancel()
+
+			err := s.run(ctx)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("run() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.block && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("expected the deadline to be exceeded, got %v", err)
+			}
+			if got := r.recorded(); !reflect.DeepEqual(got, tt.wantSteps) {
+				t.Errorf("got steps %q, want %q", got, tt.wantSteps)
+			}
+		})
+	}
+}
+
+func TestExporter_drainers(t *testing.T) {
+	e, _, _ := newTestExporter(t, reloadTestConfig)
+	availability := metrics.NewAvailability(config.AvailabilityConfig{}, ".", e.collector, e.devices, nil)
+	e.availability = []availabilityTopic{{availability: availability}}
+	e.discovery = metrics.NewHomeAssistantDiscovery(config.HomeAssistantDiscoveryConfig{}, ".", "", e.collector, e.devices, nil)
+
+	want := []drainer{e.pipelines[0].ingest, e.pipelines[1].ingest, availability, e.discovery}
+	if got := e.drainers(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %d drainers %v, want the ingests, the availability and the discovery", len(got), got)
+	}
+}
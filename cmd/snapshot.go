@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
+	"go.uber.org/zap"
+)
+
+// restoreSnapshot fills the cache with the metrics of the last snapshot. Errors are logged, a broken snapshot must not
+// prevent the start.
+func restoreSnapshot(cfg *config.CacheConfig, collector metrics.Collector, logger *zap.Logger) {
+	restored, err := collector.RestoreSnapshot(cfg.SnapshotFile())
+	if err != nil {
+		logger.Warn("could not restore the cache snapshot", zap.String("file", cfg.SnapshotFile()), zap.Error(err))
+		return
+	}
+	logger.Info("Restored cache snapshot", zap.String("file", cfg.SnapshotFile()), zap.Int("metrics", restored))
+}
+
+// runSnapshots writes a snapshot of the cache in the configured interval until the context is canceled.
+func runSnapshots(ctx context.Context, cfg *config.CacheConfig, collector metrics.Collector, logger *zap.Logger) {
+	ticker := time.NewTicker(cfg.SnapshotInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := collector.WriteSnapshot(cfg.SnapshotFile()); err != nil {
+				logger.Warn("could not write the cache snapshot", zap.String("file", cfg.SnapshotFile()), zap.Error(err))
+			}
+		}
+	}
+}
@@ -29,7 +29,7 @@ func Fuzz(data []byte) int {
 			ValueType:      "counter",
 		},
 	}, ".")
-	json := metrics.NewJSONObjectExtractor(p)
+	json := metrics.NewJSONObjectExtractor(p, nil)
 	mc, err := json("foo", data, "bar")
 	if err != nil && len(mc) > 0 {
 		return 1
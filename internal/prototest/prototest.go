@@ -0,0 +1,32 @@
+// Package prototest decodes protobuf messages in tests without the generated code of their schema.
+package prototest
+
+import "google.golang.org/protobuf/encoding/protowire"
+
+// Fields returns the values of all fields with the given number. Length delimited values are returned without their
+// length, fixed64 values as 8 little endian bytes.
+func Fields(b []byte, num protowire.Number) [][]byte {
+	var values [][]byte
+	for len(b) > 0 {
+		n, typ, l := protowire.ConsumeTag(b)
+		b = b[l:]
+		l = protowire.ConsumeFieldValue(n, typ, b)
+		if n == num {
+			switch typ {
+			case protowire.BytesType:
+				value, _ := protowire.ConsumeBytes(b)
+				values = append(values, value)
+			case protowire.Fixed64Type:
+				values = append(values, b[:l])
+			}
+		}
+		b = b[l:]
+	}
+	return values
+}
+
+// Fixed64 returns the value of the first fixed64 field with the given number.
+func Fixed64(b []byte, num protowire.Number) uint64 {
+	v, _ := protowire.ConsumeFixed64(Fields(b, num)[0])
+	return v
+}
@@ -0,0 +1,54 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultPayloadOnline  = "online"
+	DefaultPayloadOffline = "offline"
+)
+
+// AvailabilityConfig tracks whether the devices are online from the messages of an availability or last will topic.
+type AvailabilityConfig struct {
+	TopicPath string `yaml:"topic_path"`
+	// DeviceIDRegex defaults to the device_id_regex of the mqtt section
+	DeviceIDRegex *Regexp `yaml:"device_id_regex"`
+	QoS           byte    `yaml:"qos"`
+	// PayloadField reads the state from a field of a JSON payload instead of using the whole payload
+	PayloadField string `yaml:"payload_field"`
+	// PayloadOnline and PayloadOffline are compared case-insensitively
+	PayloadOnline  string `yaml:"payload_online"`
+	PayloadOffline string `yaml:"payload_offline"`
+	// ExpireOnOffline expires the cached metrics of a device as soon as it reports offline
+	ExpireOnOffline bool `yaml:"expire_on_offline"`
+}
+
+func (ac *AvailabilityConfig) validate(sharedGroup string) error {
+	if ac.TopicPath == "" {
+		return fmt.Errorf("topic_path must not be empty")
+	}
+	if sharedGroup != "" && strings.HasPrefix(ac.TopicPath, "$share/") {
+		return fmt.Errorf("topic_path %q is already a shared subscription, it cannot be combined with shared_subscription_group", ac.TopicPath)
+	}
+	var validRegex bool
+	for _, name := range ac.DeviceIDRegex.RegEx().SubexpNames() {
+		if name == DeviceIDRegexGroup {
+			validRegex = true
+		}
+	}
+	if !validRegex {
+		return fmt.Errorf("device id regex %q does not contain required regex group %q", ac.DeviceIDRegex.pattern, DeviceIDRegexGroup)
+	}
+	if ac.PayloadOnline == "" {
+		ac.PayloadOnline = DefaultPayloadOnline
+	}
+	if ac.PayloadOffline == "" {
+		ac.PayloadOffline = DefaultPayloadOffline
+	}
+	if strings.EqualFold(ac.PayloadOnline, ac.PayloadOffline) {
+		return fmt.Errorf("payload_online and payload_offline must differ")
+	}
+	return nil
+}
@@ -3,9 +3,13 @@ package config
 import (
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -14,11 +18,27 @@ import (
 )
 
 const (
-	GaugeValueType   = "gauge"
-	CounterValueType = "counter"
+	GaugeValueType     = "gauge"
+	CounterValueType   = "counter"
+	HistogramValueType = "histogram"
+	SummaryValueType   = "summary"
+	InfoValueType      = "info"
+	StateSetValueType  = "stateset"
+
+	// WildcardPathSegment matches every key of an object or every element of an array in a mqtt_name path
+	WildcardPathSegment = "*"
+
+	// DefaultInfoLabel is the label holding the value of info metrics if no info_label is configured
+	DefaultInfoLabel = "value"
 
 	DeviceIDRegexGroup   = "deviceid"
 	MetricNameRegexGroup = "metricname"
+
+	// OnExpiryDrop removes an expired series, OnExpiryKeep never expires the series and OnExpiryStale exposes the
+	// expired series once more with a NaN staleness marker.
+	OnExpiryDrop  = "drop"
+	OnExpiryKeep  = "keep"
+	OnExpiryStale = "stale"
 )
 
 var MQTTConfigDefaults = MQTTConfig{
@@ -29,8 +49,9 @@ var MQTTConfigDefaults = MQTTConfig{
 }
 
 var CacheConfigDefaults = CacheConfig{
-	Timeout:  2 * time.Minute,
-	StateDir: "/var/lib/mqtt2prometheus",
+	Timeout:         2 * time.Minute,
+	StateDir:        "/var/lib/mqtt2prometheus",
+	DeviceRetention: 7 * 24 * time.Hour,
 }
 
 var JsonParsingConfigDefaults = JsonParsingConfig{
@@ -69,6 +90,11 @@ func (rf *Regexp) Match(s string) bool {
 
 // GroupValue returns the value of the given group. If the group is not part of the underlying regexp, returns the empty string.
 func (rf *Regexp) GroupValue(s string, groupName string) string {
+	return rf.GroupValues(s)[groupName]
+}
+
+// GroupValues returns the values of all named groups. It returns an empty map if the regexp does not match.
+func (rf *Regexp) GroupValues(s string) map[string]string {
 	match := rf.r.FindStringSubmatch(s)
 	groupValues := make(map[string]string)
 	for i, name := range rf.r.SubexpNames() {
@@ -76,7 +102,7 @@ func (rf *Regexp) GroupValue(s string, groupName string) string {
 			groupValues[name] = match[i]
 		}
 	}
-	return groupValues[groupName]
+	return groupValues
 }
 
 func (rf *Regexp) RegEx() *regexp.Regexp {
@@ -95,12 +121,213 @@ type Config struct {
 	Metrics         []MetricConfig     `yaml:"metrics"`
 	MQTT            *MQTTConfig        `yaml:"mqtt,omitempty"`
 	Cache           *CacheConfig       `yaml:"cache,omitempty"`
+	Sharding        *ShardingConfig    `yaml:"sharding,omitempty"`
+	RemoteWrite     *RemoteWriteConfig `yaml:"remote_write,omitempty"`
+	OTLP            *OTLPConfig        `yaml:"otlp,omitempty"`
 	EnableProfiling bool               `yaml:"enable_profiling_metrics,omitempty"`
+	// RelabelConfigs are applied to all metrics before their own relabel configs
+	RelabelConfigs []RelabelConfig `yaml:"relabel_configs,omitempty"`
+}
+
+// RemoteWriteConfig pushes the cached metrics to a prometheus remote_write endpoint
+type RemoteWriteConfig struct {
+	URL string `yaml:"url"`
+	// Interval between two pushes
+	Interval time.Duration `yaml:"interval"`
+	// PushOnIngest pushes the metrics after every received message in addition to the interval
+	PushOnIngest bool          `yaml:"push_on_ingest"`
+	Timeout      time.Duration `yaml:"timeout"`
+	// MaxRetries is the number of retries of a failed push before it is retried with the next push
+	MaxRetries      int              `yaml:"max_retries"`
+	MinBackoff      time.Duration    `yaml:"min_backoff"`
+	MaxBackoff      time.Duration    `yaml:"max_backoff"`
+	BasicAuth       *BasicAuthConfig `yaml:"basic_auth"`
+	BearerToken     string           `yaml:"bearer_token"`
+	BearerTokenFile string           `yaml:"bearer_token_file"`
+	// QueueDirectory keeps the pushes which were not sent yet
+	QueueDirectory string `yaml:"queue_directory"`
+	// MaxQueueBytes limits the size of the queue. The oldest pushes are dropped if the queue is full.
+	MaxQueueBytes int64 `yaml:"max_queue_bytes"`
+}
+
+type BasicAuthConfig struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+var RemoteWriteConfigDefaults = RemoteWriteConfig{
+	Interval:      30 * time.Second,
+	Timeout:       10 * time.Second,
+	MaxRetries:    3,
+	MinBackoff:    time.Second,
+	MaxBackoff:    30 * time.Second,
+	MaxQueueBytes: 64 << 20,
+}
+
+func (rc *RemoteWriteConfig) setDefaults(stateDir string) {
+	if rc.Interval == 0 {
+		rc.Interval = RemoteWriteConfigDefaults.Interval
+	}
+	if rc.Timeout == 0 {
+		rc.Timeout = RemoteWriteConfigDefaults.Timeout
+	}
+	if rc.MaxRetries == 0 {
+		rc.MaxRetries = RemoteWriteConfigDefaults.MaxRetries
+	}
+	if rc.MinBackoff == 0 {
+		rc.MinBackoff = RemoteWriteConfigDefaults.MinBackoff
+	}
+	if rc.MaxBackoff == 0 {
+		rc.MaxBackoff = RemoteWriteConfigDefaults.MaxBackoff
+	}
+	if rc.MaxQueueBytes == 0 {
+		rc.MaxQueueBytes = RemoteWriteConfigDefaults.MaxQueueBytes
+	}
+	if rc.QueueDirectory == "" {
+		rc.QueueDirectory = filepath.Join(stateDir, "remote_write")
+	}
+}
+
+func (rc *RemoteWriteConfig) validate() error {
+	u, err := url.Parse(rc.URL)
+	if err != nil {
+		return fmt.Errorf("remote_write.url: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("remote_write.url %q must be a http or https URL", rc.URL)
+	}
+	if rc.Interval < 0 || rc.Timeout < 0 || rc.MinBackoff < 0 || rc.MaxBackoff < rc.MinBackoff {
+		return fmt.Errorf("remote_write: interval, timeout and backoffs must be positive and max_backoff must not be smaller than min_backoff")
+	}
+	if rc.MaxRetries < 0 || rc.MaxQueueBytes < 0 {
+		return fmt.Errorf("remote_write: max_retries and max_queue_bytes must not be negative")
+	}
+	if rc.BearerToken != "" && rc.BearerTokenFile != "" {
+		return fmt.Errorf("remote_write: only one of bearer_token and bearer_token_file can be specified")
+	}
+	if rc.BasicAuth != nil {
+		if rc.BearerToken != "" || rc.BearerTokenFile != "" {
+			return fmt.Errorf("remote_write: only one of basic_auth and bearer_token can be specified")
+		}
+		if rc.BasicAuth.Password != "" && rc.BasicAuth.PasswordFile != "" {
+			return fmt.Errorf("remote_write.basic_auth: only one of password and password_file can be specified")
+		}
+	}
+	return nil
+}
+
+const (
+	OTLPProtocolHTTP = "http/protobuf"
+	OTLPProtocolGRPC = "grpc"
+)
+
+// OTLPConfig pushes the cached metrics to an OpenTelemetry collector
+type OTLPConfig struct {
+	// Endpoint is the URL of the metrics endpoint for http/protobuf or the host:port for grpc
+	Endpoint string `yaml:"endpoint"`
+	Protocol string `yaml:"protocol"`
+	// Insecure disables TLS for grpc
+	Insecure bool `yaml:"insecure"`
+	// Interval between two pushes
+	Interval time.Duration `yaml:"interval"`
+	// PushOnIngest pushes the metrics after every received message in addition to the interval
+	PushOnIngest bool              `yaml:"push_on_ingest"`
+	Timeout      time.Duration     `yaml:"timeout"`
+	Headers      map[string]string `yaml:"headers"`
+	// ResourceAttributes are added to the resource of every device
+	ResourceAttributes map[string]string `yaml:"resource_attributes"`
+}
+
+var OTLPConfigDefaults = OTLPConfig{
+	Protocol: OTLPProtocolHTTP,
+	Interval: 30 * time.Second,
+	Timeout:  10 * time.Second,
+}
+
+func (oc *OTLPConfig) setDefaults() {
+	if oc.Protocol == "" {
+		oc.Protocol = OTLPConfigDefaults.Protocol
+	}
+	if oc.Interval == 0 {
+		oc.Interval = OTLPConfigDefaults.Interval
+	}
+	if oc.Timeout == 0 {
+		oc.Timeout = OTLPConfigDefaults.Timeout
+	}
+}
+
+func (oc *OTLPConfig) validate() error {
+	switch oc.Protocol {
+	case OTLPProtocolHTTP:
+		u, err := url.Parse(oc.Endpoint)
+		if err != nil {
+			return fmt.Errorf("otlp.endpoint: %w", err)
+		}
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("otlp.endpoint %q must be a http or https URL", oc.Endpoint)
+		}
+	case OTLPProtocolGRPC:
+		if oc.Endpoint == "" {
+			return fmt.Errorf("otlp.endpoint must not be empty")
+		}
+	default:
+		return fmt.Errorf("otlp.protocol %q must be %s or %s", oc.Protocol, OTLPProtocolHTTP, OTLPProtocolGRPC)
+	}
+	if oc.Interval < 0 || oc.Timeout < 0 {
+		return fmt.Errorf("otlp: interval and timeout must be positive")
+	}
+	return nil
+}
+
+// ShardingConfig splits the devices between multiple exporter instances. Each instance only handles the devices whose
+// device ID hashes to its shard index.
+type ShardingConfig struct {
+	Shards uint `yaml:"shards"`
+	Index  uint `yaml:"index"`
 }
 
 type CacheConfig struct {
-	Timeout  time.Duration `yaml:"timeout"`
-	StateDir string        `yaml:"state_directory"`
+	Timeout     time.Duration      `yaml:"timeout"`
+	StateDir    string             `yaml:"state_directory"`
+	SeriesLimit *SeriesLimitConfig `yaml:"series_limit"`
+	// SnapshotInterval persists the cache to the state directory in this interval and on shutdown. Zero disables it.
+	SnapshotInterval time.Duration `yaml:"snapshot_interval"`
+	// DeviceRetention is the time after which the series of a device which stopped sending messages are removed
+	DeviceRetention time.Duration `yaml:"device_retention"`
+}
+
+// SnapshotFile returns the path of the cache snapshot in the state directory.
+func (cc *CacheConfig) SnapshotFile() string {
+	return filepath.Join(cc.StateDir, "cache-snapshot.json")
+}
+
+const (
+	DropNewSeriesPolicy     = "drop_new"
+	EvictOldestSeriesPolicy = "evict_oldest"
+)
+
+// SeriesLimitConfig limits the number of cached series. Zero disables a limit.
+type SeriesLimitConfig struct {
+	MaxSeries          int `yaml:"max_series"`
+	MaxSeriesPerMetric int `yaml:"max_series_per_metric"`
+	MaxSeriesPerDevice int `yaml:"max_series_per_device"`
+	// Policy is either drop_new or evict_oldest
+	Policy string `yaml:"policy"`
+}
+
+func (sc *SeriesLimitConfig) validate() error {
+	if sc.MaxSeries < 0 || sc.MaxSeriesPerMetric < 0 || sc.MaxSeriesPerDevice < 0 {
+		return fmt.Errorf("cache.series_limit: limits must not be negative")
+	}
+	switch sc.Policy {
+	case "":
+		sc.Policy = DropNewSeriesPolicy
+	case DropNewSeriesPolicy, EvictOldestSeriesPolicy:
+	default:
+		return fmt.Errorf("cache.series_limit.policy %q must be %s or %s", sc.Policy, DropNewSeriesPolicy, EvictOldestSeriesPolicy)
+	}
+	return nil
 }
 
 type JsonParsingConfig struct {
@@ -109,23 +336,108 @@ type JsonParsingConfig struct {
 
 type MQTTConfig struct {
 	Server               string                `yaml:"server"`
+	ProtocolVersion      uint                  `yaml:"protocol_version"`
 	TopicPath            string                `yaml:"topic_path"`
 	DeviceIDRegex        *Regexp               `yaml:"device_id_regex"`
+	TopicLabelsRegex     *Regexp               `yaml:"topic_labels_regex"`
 	User                 string                `yaml:"user"`
 	Password             string                `yaml:"password"`
 	QoS                  byte                  `yaml:"qos"`
 	ObjectPerTopicConfig *ObjectPerTopicConfig `yaml:"object_per_topic_config"`
 	MetricPerTopicConfig *MetricPerTopicConfig `yaml:"metric_per_topic_config"`
+	HomieConfig          *HomieConfig          `yaml:"homie_config"`
+	Subscriptions        []SubscriptionConfig  `yaml:"subscriptions"`
+	Availability         []AvailabilityConfig  `yaml:"availability"`
+	SharedGroup          string                `yaml:"shared_subscription_group"`
 	CACert               string                `yaml:"ca_cert"`
 	ClientCert           string                `yaml:"client_cert"`
 	ClientKey            string                `yaml:"client_key"`
 	ClientID             string                `yaml:"client_id"`
+	TimestampConfig      `yaml:",inline"`
+	// HomeAssistantDiscovery creates metrics and subscriptions from the Home Assistant MQTT discovery messages
+	HomeAssistantDiscovery *HomeAssistantDiscoveryConfig `yaml:"homeassistant_discovery"`
 }
 
-const EncodingJSON = "JSON"
+// SubscriptionConfig is a single topic filter together with the settings to extract metrics from its messages.
+type SubscriptionConfig struct {
+	TopicPath     string  `yaml:"topic_path"`
+	DeviceIDRegex *Regexp `yaml:"device_id_regex"`
+	// TopicLabelsRegex extracts a label from the topic for every named group
+	TopicLabelsRegex     *Regexp               `yaml:"topic_labels_regex"`
+	QoS                  byte                  `yaml:"qos"`
+	ObjectPerTopicConfig *ObjectPerTopicConfig `yaml:"object_per_topic_config"`
+	MetricPerTopicConfig *MetricPerTopicConfig `yaml:"metric_per_topic_config"`
+	HomieConfig          *HomieConfig          `yaml:"homie_config"`
+	// TimestampConfig defaults to the timestamp settings of the mqtt section if no timestamp_field is set
+	TimestampConfig `yaml:",inline"`
+	// CacheTimeout and OnExpiry are the defaults of the metrics of the subscription
+	CacheTimeout time.Duration `yaml:"cache_timeout"`
+	OnExpiry     string        `yaml:"on_expiry"`
+	// Metrics defaults to the global metrics list if empty
+	Metrics []MetricConfig `yaml:"metrics"`
+}
+
+const (
+	EncodingJSON       = "JSON"
+	EncodingSparkplugB = "SPARKPLUG_B"
+	EncodingInfluxLine = "INFLUX_LINE"
+	EncodingMsgpack    = "MSGPACK"
+	EncodingCBOR       = "CBOR"
+)
 
 type ObjectPerTopicConfig struct {
-	Encoding string `yaml:"encoding"` // Currently only JSON is a valid value
+	Encoding     string              `yaml:"encoding"` // JSON, MSGPACK, CBOR, SPARKPLUG_B or INFLUX_LINE, case-insensitive
+	AutoDiscover *AutoDiscoverConfig `yaml:"auto_discover"`
+	// TagLabels are the tags of INFLUX_LINE payloads which become labels of all metrics
+	TagLabels []string `yaml:"tag_labels"`
+}
+
+// jsonDocument returns true for the encodings which are decoded into the same documents as JSON.
+func (o *ObjectPerTopicConfig) jsonDocument() bool {
+	switch o.Encoding {
+	case EncodingJSON, EncodingMsgpack, EncodingCBOR:
+		return true
+	}
+	return false
+}
+
+// AutoDiscoverConfig exports every numeric or boolean field of a JSON object as gauge
+type AutoDiscoverConfig struct {
+	// Prefix is prepended to the sanitised path of a field to build the metric name.
+	Prefix string `yaml:"prefix"`
+	// AllowPaths restricts the discovery to the paths matching at least one of the patterns.
+	AllowPaths []*Regexp `yaml:"allow_paths"`
+	// DenyPaths excludes the paths matching any of the patterns.
+	DenyPaths []*Regexp `yaml:"deny_paths"`
+}
+
+var invalidMetricNameChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// MetricName returns the prometheus name of a discovered field.
+func (ac *AutoDiscoverConfig) MetricName(path string) string {
+	name := ac.Prefix + invalidMetricNameChars.ReplaceAllString(path, "_")
+	if name != "" && name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+	return name
+}
+
+// Discover returns true if the given path is allowed and not denied.
+func (ac *AutoDiscoverConfig) Discover(path string) bool {
+	for _, r := range ac.DenyPaths {
+		if r.RegEx().MatchString(path) {
+			return false
+		}
+	}
+	if len(ac.AllowPaths) == 0 {
+		return true
+	}
+	for _, r := range ac.AllowPaths {
+		if r.RegEx().MatchString(path) {
+			return true
+		}
+	}
+	return false
 }
 
 type MetricPerTopicConfig struct {
@@ -150,6 +462,50 @@ type MetricConfig struct {
 	MQTTValueScale     float64                   `yaml:"mqtt_value_scale"`
 	// ErrorValue is used while error during value parsing
 	ErrorValue         *float64                  `yaml:"error_value"`
+	// Buckets are the upper bounds of the classic histogram buckets. Only used by histograms.
+	Buckets []float64 `yaml:"buckets"`
+	// NativeHistogram enables a native histogram in addition to, or instead of, the classic buckets.
+	NativeHistogram *NativeHistogramConfig `yaml:"native_histogram"`
+	// Objectives are the quantiles of a summary with their allowed absolute error.
+	Objectives map[float64]float64 `yaml:"objectives"`
+	// MaxAge is the duration for which observations stay relevant for the summary quantiles.
+	MaxAge time.Duration `yaml:"max_age"`
+	// InfoLabel is the label holding the string value of an info metric.
+	InfoLabel string `yaml:"info_label"`
+	// States are all possible states of a stateset metric.
+	States []string `yaml:"states"`
+	// WildcardLabels name the labels of the wildcard segments in mqtt_name, in order.
+	WildcardLabels []WildcardLabelConfig `yaml:"wildcard_labels"`
+	// MaxSeries overrides cache.series_limit.max_series_per_metric for this metric.
+	MaxSeries int `yaml:"max_series"`
+	// RelabelConfigs rewrite the labels of the metric. The global relabel configs are prepended while loading the config.
+	RelabelConfigs []RelabelConfig `yaml:"relabel_configs"`
+	// TopicLabels are the labels extracted from the topic. They are set from the subscription while loading the config.
+	TopicLabels []string `yaml:"-"`
+	// TagLabels are the labels from the tags of line protocol payloads. They are set from the subscription while loading
+	// the config.
+	TagLabels []string `yaml:"-"`
+	// CacheTimeout overrides cache.timeout for this metric. Zero uses the timeout of the subscription or the cache.
+	CacheTimeout time.Duration `yaml:"cache_timeout"`
+	// OnExpiry is drop, keep or stale. Defaults to the setting of the subscription or drop.
+	OnExpiry string `yaml:"on_expiry"`
+	// ExportAge exposes the age of the cached values as <prom_name>_age_seconds.
+	ExportAge bool `yaml:"export_age"`
+}
+
+// WildcardLabelConfig defines the label of a wildcard segment in a mqtt_name path
+type WildcardLabelConfig struct {
+	Name string `yaml:"name"`
+	// Field is the path of a field relative to the matched element. Its value is used as label value instead of the
+	// matched key or array index.
+	Field string `yaml:"field"`
+}
+
+// NativeHistogramConfig configures the sparse buckets of a native histogram
+type NativeHistogramConfig struct {
+	BucketFactor     float64       `yaml:"bucket_factor"`
+	MaxBucketNumber  uint32        `yaml:"max_bucket_number"`
+	MinResetDuration time.Duration `yaml:"min_reset_duration"`
 }
 
 // StringValueMappingConfig defines the mapping from string to float
@@ -161,7 +517,7 @@ type StringValueMappingConfig struct {
 }
 
 func (mc *MetricConfig) PrometheusDescription() *prometheus.Desc {
-	labels := append([]string{"sensor", "topic"}, mc.DynamicLabelsKeys()...)
+	labels := append([]string{"sensor", "topic"}, mc.LabelsKeys()...)
 	return prometheus.NewDesc(
 		mc.PrometheusName, mc.Help, labels, mc.ConstantLabels,
 	)
@@ -173,11 +529,178 @@ func (mc *MetricConfig) PrometheusValueType() prometheus.ValueType {
 		return prometheus.GaugeValue
 	case CounterValueType:
 		return prometheus.CounterValue
+	case InfoValueType, StateSetValueType:
+		return prometheus.GaugeValue
 	default:
 		return prometheus.UntypedValue
 	}
 }
 
+// Accumulating returns true if the metric accumulates observations instead of exporting the last value.
+func (mc *MetricConfig) Accumulating() bool {
+	return mc.ValueType == HistogramValueType || mc.ValueType == SummaryValueType
+}
+
+// StringValued returns true if the metric exports the string value of a message as label.
+func (mc *MetricConfig) StringValued() bool {
+	return mc.ValueType == InfoValueType || mc.ValueType == StateSetValueType
+}
+
+// StateLabel returns the label holding the string value of info and stateset metrics. It is empty for other metrics.
+func (mc *MetricConfig) StateLabel() string {
+	switch mc.ValueType {
+	case InfoValueType:
+		if mc.InfoLabel != "" {
+			return mc.InfoLabel
+		}
+		return DefaultInfoLabel
+	case StateSetValueType:
+		return mc.PrometheusName
+	default:
+		return ""
+	}
+}
+
+// WildcardSegments returns the number of wildcard segments in the mqtt_name path.
+func (mc *MetricConfig) WildcardSegments(separator string) int {
+	var n int
+	for _, segment := range strings.Split(mc.MQTTName, separator) {
+		if segment == WildcardPathSegment {
+			n++
+		}
+	}
+	return n
+}
+
+func (mc *MetricConfig) validate(separator string) error {
+	if n := mc.WildcardSegments(separator); n != len(mc.WildcardLabels) {
+		return fmt.Errorf("metric %q: mqtt_name %q has %d wildcard segments, but %d wildcard_labels are configured", mc.PrometheusName, mc.MQTTName, n, len(mc.WildcardLabels))
+	}
+	if err := mc.validateLabels(); err != nil {
+		return err
+	}
+	if mc.MaxSeries < 0 {
+		return fmt.Errorf("metric %q: max_series must not be negative", mc.PrometheusName)
+	}
+	if err := validateRelabelConfigs(mc.RelabelConfigs); err != nil {
+		return fmt.Errorf("metric %q: %w", mc.PrometheusName, err)
+	}
+	if err := validateOnExpiry(mc.OnExpiry); err != nil {
+		return fmt.Errorf("metric %q: %w", mc.PrometheusName, err)
+	}
+	if mc.OnExpiry == OnExpiryStale && mc.Accumulating() {
+		return fmt.Errorf("metric %q: on_expiry %q cannot be used with type %q", mc.PrometheusName, OnExpiryStale, mc.ValueType)
+	}
+	if mc.ValueType != InfoValueType && mc.InfoLabel != "" {
+		return fmt.Errorf("metric %q: info_label requires type %q", mc.PrometheusName, InfoValueType)
+	}
+	if mc.ValueType != StateSetValueType && len(mc.States) > 0 {
+		return fmt.Errorf("metric %q: states require type %q", mc.PrometheusName, StateSetValueType)
+	}
+	if !mc.Accumulating() {
+		if len(mc.Buckets) > 0 || mc.NativeHistogram != nil || len(mc.Objectives) > 0 || mc.MaxAge != 0 {
+			return fmt.Errorf("metric %q: buckets, native_histogram, objectives and max_age require type %q or %q", mc.PrometheusName, HistogramValueType, SummaryValueType)
+		}
+		if mc.StringValued() {
+			return mc.validateStringValued()
+		}
+		return nil
+	}
+	if mc.ForceMonotonicy {
+		return fmt.Errorf("metric %q: force_monotonicy cannot be used with type %q", mc.PrometheusName, mc.ValueType)
+	}
+	if mc.ValueType == HistogramValueType {
+		if len(mc.Objectives) > 0 || mc.MaxAge != 0 {
+			return fmt.Errorf("metric %q: objectives and max_age require type %q", mc.PrometheusName, SummaryValueType)
+		}
+		for i := 1; i < len(mc.Buckets); i++ {
+			if mc.Buckets[i] <= mc.Buckets[i-1] {
+				return fmt.Errorf("metric %q: buckets must be in increasing order", mc.PrometheusName)
+			}
+		}
+		if mc.NativeHistogram != nil && mc.NativeHistogram.BucketFactor <= 1 {
+			return fmt.Errorf("metric %q: native_histogram.bucket_factor must be greater than 1", mc.PrometheusName)
+		}
+		return nil
+	}
+	if len(mc.Buckets) > 0 || mc.NativeHistogram != nil {
+		return fmt.Errorf("metric %q: buckets and native_histogram require type %q", mc.PrometheusName, HistogramValueType)
+	}
+	for q, e := range mc.Objectives {
+		if q < 0 || q > 1 || e < 0 || e > 1 {
+			return fmt.Errorf("metric %q: objectives must map quantiles between 0 and 1 to errors between 0 and 1", mc.PrometheusName)
+		}
+	}
+	if mc.MaxAge < 0 {
+		return fmt.Errorf("metric %q: max_age must not be negative", mc.PrometheusName)
+	}
+	return nil
+}
+
+func validateOnExpiry(onExpiry string) error {
+	switch onExpiry {
+	case "", OnExpiryDrop, OnExpiryKeep, OnExpiryStale:
+		return nil
+	}
+	return fmt.Errorf("on_expiry must be one of %q, %q or %q, got %q", OnExpiryDrop, OnExpiryKeep, OnExpiryStale, onExpiry)
+}
+
+func (mc *MetricConfig) validateStringValued() error {
+	if mc.Expression != "" || mc.RawExpression != "" || mc.ForceMonotonicy || mc.StringValueMapping != nil || mc.MQTTValueScale != 0 || mc.ErrorValue != nil {
+		return fmt.Errorf("metric %q: expression, raw_expression, force_monotonicy, string_value_mapping, mqtt_value_scale and error_value cannot be used with type %q", mc.PrometheusName, mc.ValueType)
+	}
+	if mc.ValueType == InfoValueType && !strings.HasSuffix(mc.PrometheusName, "_info") {
+		return fmt.Errorf("metric %q: the name of an info metric must end with \"_info\"", mc.PrometheusName)
+	}
+	if mc.ValueType == StateSetValueType {
+		if len(mc.States) == 0 {
+			return fmt.Errorf("metric %q: type %q requires states", mc.PrometheusName, StateSetValueType)
+		}
+		seen := make(map[string]bool, len(mc.States))
+		for _, state := range mc.States {
+			if seen[state] {
+				return fmt.Errorf("metric %q: duplicate state %q", mc.PrometheusName, state)
+			}
+			seen[state] = true
+		}
+	}
+	return nil
+}
+
+// validateLabels ensures that no label is defined twice.
+func (mc *MetricConfig) validateLabels() error {
+	used := map[string]bool{"sensor": true, "topic": true}
+	for k := range mc.ConstantLabels {
+		used[k] = true
+	}
+	for _, label := range mc.LabelsKeys() {
+		if label == "" {
+			return fmt.Errorf("metric %q: label names must not be empty", mc.PrometheusName)
+		}
+		if used[label] {
+			return fmt.Errorf("metric %q: label %q is already used", mc.PrometheusName, label)
+		}
+		used[label] = true
+	}
+	return nil
+}
+
+// LabelsKeys returns the variable labels of the metric after "sensor" and "topic". The topic labels, the tag labels
+// and the labels of wildcard segments follow the dynamic labels, the state label of info and stateset metrics comes
+// last.
+func (mc *MetricConfig) LabelsKeys() []string {
+	labels := mc.DynamicLabelsKeys()
+	labels = append(labels, mc.TopicLabels...)
+	labels = append(labels, mc.TagLabels...)
+	for _, l := range mc.WildcardLabels {
+		labels = append(labels, l.Name)
+	}
+	if label := mc.StateLabel(); label != "" {
+		labels = append(labels, label)
+	}
+	return labels
+}
+
 func (mc *MetricConfig) DynamicLabelsKeys() []string {
 	var labels []string
 	for k := range mc.DynamicLabels {
@@ -187,7 +710,22 @@ func (mc *MetricConfig) DynamicLabelsKeys() []string {
 	return labels
 }
 
+// LoadConfig reads and validates the config file and creates the state directory if needed.
 func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
+	cfg, err := ReadConfig(configFile, logger)
+	if err != nil {
+		return Config{}, err
+	}
+	if cfg.NeedsStateDir() {
+		if err := os.MkdirAll(cfg.Cache.StateDir, 0755); err != nil {
+			return Config{}, fmt.Errorf("failed to create directory %q: %w", cfg.Cache.StateDir, err)
+		}
+	}
+	return cfg, nil
+}
+
+// ReadConfig reads and validates the config file without touching the state directory.
+func ReadConfig(configFile string, logger *zap.Logger) (Config, error) {
 	configData, err := ioutil.ReadFile(configFile)
 	if err != nil {
 		return Config{}, err
@@ -197,7 +735,8 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 		return cfg, err
 	}
 	if cfg.MQTT == nil {
-		cfg.MQTT = &MQTTConfigDefaults
+		mqttDefaults := MQTTConfigDefaults
+		cfg.MQTT = &mqttDefaults
 	}
 	if cfg.Cache == nil {
 		cfg.Cache = &CacheConfigDefaults
@@ -205,51 +744,129 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 	if cfg.Cache.StateDir == "" {
 		cfg.Cache.StateDir = CacheConfigDefaults.StateDir
 	}
+	if cfg.Cache.DeviceRetention == 0 {
+		cfg.Cache.DeviceRetention = CacheConfigDefaults.DeviceRetention
+	}
+	if cfg.Cache.SeriesLimit != nil {
+		if err := cfg.Cache.SeriesLimit.validate(); err != nil {
+			return Config{}, err
+		}
+	}
+	if cfg.Cache.SnapshotInterval < 0 {
+		return Config{}, fmt.Errorf("cache.snapshot_interval must not be negative")
+	}
 	if cfg.JsonParsing == nil {
 		cfg.JsonParsing = &JsonParsingConfigDefaults
 	}
 	if cfg.MQTT.DeviceIDRegex == nil {
 		cfg.MQTT.DeviceIDRegex = MQTTConfigDefaults.DeviceIDRegex
 	}
-	var validRegex bool
-	for _, name := range cfg.MQTT.DeviceIDRegex.RegEx().SubexpNames() {
-		if name == DeviceIDRegexGroup {
-			validRegex = true
+	switch cfg.MQTT.ProtocolVersion {
+	case 0, 3, 4, 5:
+	default:
+		return Config{}, fmt.Errorf("unsupported mqtt protocol_version %d: valid values are 3 (MQTT 3.1), 4 (MQTT 3.1.1) and 5 (MQTT 5)", cfg.MQTT.ProtocolVersion)
+	}
+
+	if cfg.Sharding != nil {
+		if cfg.Sharding.Shards == 0 {
+			return Config{}, fmt.Errorf("sharding.shards must be greater than zero")
+		}
+		if cfg.Sharding.Index >= cfg.Sharding.Shards {
+			return Config{}, fmt.Errorf("sharding.index %d must be smaller than sharding.shards %d", cfg.Sharding.Index, cfg.Sharding.Shards)
+		}
+		if cfg.MQTT.SharedGroup != "" {
+			return Config{}, fmt.Errorf("sharding cannot be combined with mqtt.shared_subscription_group: the broker does not distribute the messages by device")
 		}
 	}
-	if !validRegex {
-		return Config{}, fmt.Errorf("device id regex %q does not contain required regex group %q", cfg.MQTT.DeviceIDRegex.pattern, DeviceIDRegexGroup)
+
+	if cfg.RemoteWrite != nil {
+		cfg.RemoteWrite.setDefaults(cfg.Cache.StateDir)
+		if err := cfg.RemoteWrite.validate(); err != nil {
+			return Config{}, err
+		}
 	}
 
-	if cfg.MQTT.ObjectPerTopicConfig != nil && cfg.MQTT.MetricPerTopicConfig != nil {
-		return Config{}, fmt.Errorf("only one of object_per_topic_config and metric_per_topic_config can be specified")
+	if cfg.OTLP != nil {
+		cfg.OTLP.setDefaults()
+		if err := cfg.OTLP.validate(); err != nil {
+			return Config{}, err
+		}
 	}
 
-	if cfg.MQTT.ObjectPerTopicConfig == nil && cfg.MQTT.MetricPerTopicConfig == nil {
-		cfg.MQTT.ObjectPerTopicConfig = &ObjectPerTopicConfig{
-			Encoding: EncodingJSON,
+	if err := validateRelabelConfigs(cfg.RelabelConfigs); err != nil {
+		return Config{}, err
+	}
+
+	legacySubscription := len(cfg.MQTT.Subscriptions) == 0
+	// with home assistant discovery, the subscriptions may be discovered only
+	discoveryOnly := cfg.MQTT.HomeAssistantDiscovery != nil && cfg.MQTT.TopicPath == "" && cfg.MQTT.ObjectPerTopicConfig == nil && cfg.MQTT.MetricPerTopicConfig == nil && cfg.MQTT.HomieConfig == nil
+	if legacySubscription && !discoveryOnly {
+		cfg.MQTT.Subscriptions = []SubscriptionConfig{
+			{
+				TopicPath:            cfg.MQTT.TopicPath,
+				DeviceIDRegex:        cfg.MQTT.DeviceIDRegex,
+				TopicLabelsRegex:     cfg.MQTT.TopicLabelsRegex,
+				TimestampConfig:      cfg.MQTT.TimestampConfig,
+				QoS:                  cfg.MQTT.QoS,
+				ObjectPerTopicConfig: cfg.MQTT.ObjectPerTopicConfig,
+				MetricPerTopicConfig: cfg.MQTT.MetricPerTopicConfig,
+				HomieConfig:          cfg.MQTT.HomieConfig,
+			},
 		}
+	} else if cfg.MQTT.TopicPath != "" || cfg.MQTT.ObjectPerTopicConfig != nil || cfg.MQTT.MetricPerTopicConfig != nil || cfg.MQTT.HomieConfig != nil {
+		return Config{}, fmt.Errorf("mqtt.subscriptions cannot be combined with topic_path, object_per_topic_config, metric_per_topic_config or homie_config")
 	}
 
-	if cfg.MQTT.MetricPerTopicConfig != nil {
-		validRegex = false
-		for _, name := range cfg.MQTT.MetricPerTopicConfig.MetricNameRegex.RegEx().SubexpNames() {
-			if name == MetricNameRegexGroup {
-				validRegex = true
+	for i := range cfg.MQTT.Subscriptions {
+		sub := &cfg.MQTT.Subscriptions[i]
+		if sub.DeviceIDRegex == nil {
+			sub.DeviceIDRegex = cfg.MQTT.DeviceIDRegex
+		}
+		if sub.TopicLabelsRegex == nil {
+			sub.TopicLabelsRegex = cfg.MQTT.TopicLabelsRegex
+		}
+		if sub.TimestampField == "" {
+			sub.TimestampConfig = cfg.MQTT.TimestampConfig
+		}
+		if len(sub.Metrics) == 0 {
+			// copy the metrics, since validating a subscription may set their defaults
+			sub.Metrics = append([]MetricConfig(nil), cfg.Metrics...)
+		}
+		if len(cfg.RelabelConfigs) > 0 {
+			for j := range sub.Metrics {
+				m := &sub.Metrics[j]
+				m.RelabelConfigs = append(append([]RelabelConfig(nil), cfg.RelabelConfigs...), m.RelabelConfigs...)
 			}
 		}
-		if !validRegex {
-			return Config{}, fmt.Errorf("metric name regex %q does not contain required regex group %q", cfg.MQTT.DeviceIDRegex.pattern, MetricNameRegexGroup)
+		if err := sub.validate(cfg.MQTT.SharedGroup, cfg.JsonParsing.Separator); err != nil {
+			if legacySubscription {
+				return Config{}, err
+			}
+			return Config{}, fmt.Errorf("subscription %d (%q): %w", i, sub.TopicPath, err)
+		}
+	}
+	if err := unifyLabels(cfg.MQTT.Subscriptions); err != nil {
+		return Config{}, err
+	}
+
+	for i := range cfg.MQTT.Availability {
+		a := &cfg.MQTT.Availability[i]
+		if a.DeviceIDRegex == nil {
+			a.DeviceIDRegex = cfg.MQTT.DeviceIDRegex
+		}
+		if err := a.validate(cfg.MQTT.SharedGroup); err != nil {
+			return Config{}, fmt.Errorf("availability %d (%q): %w", i, a.TopicPath, err)
 		}
 	}
 
-	// If any metric forces monotonicy, we need a state directory.
-	forcesMonotonicy := false
-	for _, m := range cfg.Metrics {
-		if m.ForceMonotonicy {
-			forcesMonotonicy = true
+	if cfg.MQTT.HomeAssistantDiscovery != nil {
+		if err := cfg.MQTT.HomeAssistantDiscovery.validate(cfg.MQTT.SharedGroup); err != nil {
+			return Config{}, err
 		}
+	}
 
+	// If any metric forces monotonicy or evaluates expressions, we need a state directory.
+	for _, m := range cfg.AllMetrics() {
 		if m.StringValueMapping != nil && m.StringValueMapping.ErrorValue != nil {
 			if m.ErrorValue != nil {
 				return Config{}, fmt.Errorf("metric %s/%s: cannot set both string_value_mapping.error_value and error_value (string_value_mapping.error_value is deprecated).", m.MQTTName, m.PrometheusName)
@@ -261,11 +878,278 @@ func LoadConfig(configFile string, logger *zap.Logger) (Config, error) {
 			return Config{}, fmt.Errorf("metric %s/%s: expression and raw_expression are mutually exclusive.", m.MQTTName, m.PrometheusName)
 		}
 	}
-	if forcesMonotonicy {
-		if err := os.MkdirAll(cfg.Cache.StateDir, 0755); err != nil {
-			return Config{}, fmt.Errorf("failed to create directory %q: %w", cfg.Cache.StateDir, err)
+	return cfg, nil
+}
+
+// unifyLabels gives all metrics with the same name the topic and tag labels of all subscriptions, since all series of
+// a metric must have the same labels. Labels which are not set by a subscription are empty. Metrics with the same name
+// and other differing labels, constant label names or help texts are rejected.
+func unifyLabels(subscriptions []SubscriptionConfig) error {
+	topicLabels := make(map[string][]string)
+	tagLabels := make(map[string][]string)
+	for _, sub := range subscriptions {
+		for _, m := range sub.Metrics {
+			topicLabels[m.PrometheusName] = appendMissing(topicLabels[m.PrometheusName], m.TopicLabels)
+			tagLabels[m.PrometheusName] = appendMissing(tagLabels[m.PrometheusName], m.TagLabels)
+		}
+	}
+	for _, l := range topicLabels {
+		sort.Strings(l)
+	}
+	first := make(map[string]*MetricConfig)
+	for i := range subscriptions {
+		for j := range subscriptions[i].Metrics {
+			m := &subscriptions[i].Metrics[j]
+			m.TopicLabels = topicLabels[m.PrometheusName]
+			m.TagLabels = tagLabels[m.PrometheusName]
+			f, ok := first[m.PrometheusName]
+			if !ok {
+				first[m.PrometheusName] = m
+				continue
+			}
+			if !reflect.DeepEqual(f.LabelsKeys(), m.LabelsKeys()) {
+				return fmt.Errorf("metric %q has the labels %v and %v: all metrics with the same prom_name must have the same labels", m.PrometheusName, f.LabelsKeys(), m.LabelsKeys())
+			}
+			if !reflect.DeepEqual(constantLabelsKeys(f), constantLabelsKeys(m)) {
+				return fmt.Errorf("metric %q has the constant labels %v and %v: all metrics with the same prom_name must have the same constant labels", m.PrometheusName, constantLabelsKeys(f), constantLabelsKeys(m))
+			}
+			if f.Help != m.Help {
+				return fmt.Errorf("metric %q has the help texts %q and %q: all metrics with the same prom_name must have the same help text", m.PrometheusName, f.Help, m.Help)
+			}
 		}
 	}
+	return nil
+}
 
-	return cfg, nil
+func constantLabelsKeys(mc *MetricConfig) []string {
+	var keys []string
+	for k := range mc.ConstantLabels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func appendMissing(labels []string, add []string) []string {
+	for _, l := range add {
+		var found bool
+		for _, existing := range labels {
+			found = found || existing == l
+		}
+		if !found {
+			labels = append(labels, l)
+		}
+	}
+	return labels
+}
+
+// NeedsStateDir returns true if the cache is persisted or any metric forces monotonicy or evaluates expressions.
+func (c Config) NeedsStateDir() bool {
+	if c.Cache != nil && c.Cache.SnapshotInterval > 0 {
+		return true
+	}
+	for _, m := range c.AllMetrics() {
+		if m.ForceMonotonicy || m.Expression != "" || m.RawExpression != "" || len(m.DynamicLabels) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// AllMetrics returns the metric configs of all subscriptions.
+func (c Config) AllMetrics() []MetricConfig {
+	if c.MQTT == nil {
+		return c.Metrics
+	}
+	var metrics []MetricConfig
+	for _, sub := range c.MQTT.Subscriptions {
+		metrics = append(metrics, sub.Metrics...)
+	}
+	return metrics
+}
+
+// topicRegexes returns the regexes which extract labels from the topic, in the order of precedence.
+func (sc *SubscriptionConfig) topicRegexes() []*Regexp {
+	regexes := []*Regexp{sc.DeviceIDRegex}
+	if sc.MetricPerTopicConfig != nil {
+		regexes = append(regexes, sc.MetricPerTopicConfig.MetricNameRegex)
+	}
+	if sc.TopicLabelsRegex != nil {
+		regexes = append(regexes, sc.TopicLabelsRegex)
+	}
+	return regexes
+}
+
+// TopicLabels returns the sorted names of the named groups in device_id_regex, metric_name_regex and
+// topic_labels_regex, except for the deviceid and metricname groups. Sparkplug B subscriptions add group, node and
+// device.
+func (sc *SubscriptionConfig) TopicLabels() []string {
+	seen := make(map[string]bool)
+	var labels []string
+	for _, r := range sc.topicRegexes() {
+		if r == nil || r.RegEx() == nil {
+			continue
+		}
+		for _, name := range r.RegEx().SubexpNames() {
+			if name == "" || name == DeviceIDRegexGroup || name == MetricNameRegexGroup || seen[name] {
+				continue
+			}
+			seen[name] = true
+			labels = append(labels, name)
+		}
+	}
+	if sc.sparkplug() {
+		for _, name := range SparkplugLabels {
+			if !seen[name] {
+				seen[name] = true
+				labels = append(labels, name)
+			}
+		}
+	}
+	sort.Strings(labels)
+	return labels
+}
+
+// TopicLabelValues extracts the values of the topic labels from the topic. Groups which did not match have an empty
+// value. If multiple regexes have the same group, the value of a later matching regex wins. Matching groups override
+// the Sparkplug B labels.
+func (sc *SubscriptionConfig) TopicLabelValues(topic string) map[string]string {
+	labels := sc.TopicLabels()
+	values := make(map[string]string, len(labels))
+	for _, name := range labels {
+		values[name] = ""
+	}
+	if t, ok := ParseSparkplugTopic(topic); ok && sc.sparkplug() {
+		values[SparkplugGroupLabel] = t.Group
+		values[SparkplugNodeLabel] = t.Node
+		values[SparkplugDeviceLabel] = t.Device
+	}
+	for _, r := range sc.topicRegexes() {
+		if r == nil || r.RegEx() == nil {
+			continue
+		}
+		for name, value := range r.GroupValues(topic) {
+			if _, ok := values[name]; ok && value != "" {
+				values[name] = value
+			}
+		}
+	}
+	return values
+}
+
+func (sc *SubscriptionConfig) validate(sharedGroup, separator string) error {
+	if sc.TopicPath == "" {
+		return fmt.Errorf("topic_path must not be empty")
+	}
+	if sharedGroup != "" && strings.HasPrefix(sc.TopicPath, "$share/") {
+		return fmt.Errorf("topic_path %q is already a shared subscription, it cannot be combined with shared_subscription_group", sc.TopicPath)
+	}
+	if sc.HomieConfig != nil {
+		if err := sc.HomieConfig.validate(sharedGroup); err != nil {
+			return err
+		}
+		// the default regex would use the last topic segment instead of the Homie device ID
+		if sc.DeviceIDRegex == MQTTConfigDefaults.DeviceIDRegex {
+			sc.DeviceIDRegex = sc.HomieConfig.deviceIDRegex()
+		}
+	}
+	var validRegex bool
+	for _, name := range sc.DeviceIDRegex.RegEx().SubexpNames() {
+		if name == DeviceIDRegexGroup {
+			validRegex = true
+		}
+	}
+	if !validRegex {
+		return fmt.Errorf("device id regex %q does not contain required regex group %q", sc.DeviceIDRegex.pattern, DeviceIDRegexGroup)
+	}
+
+	var extractors int
+	for _, configured := range []bool{sc.ObjectPerTopicConfig != nil, sc.MetricPerTopicConfig != nil, sc.HomieConfig != nil} {
+		if configured {
+			extractors++
+		}
+	}
+	if extractors > 1 {
+		return fmt.Errorf("only one of object_per_topic_config, metric_per_topic_config and homie_config can be specified")
+	}
+
+	if extractors == 0 {
+		sc.ObjectPerTopicConfig = &ObjectPerTopicConfig{
+			Encoding: EncodingJSON,
+		}
+	}
+	var tagLabels []string
+	if sc.ObjectPerTopicConfig != nil {
+		sc.ObjectPerTopicConfig.Encoding = strings.ToUpper(sc.ObjectPerTopicConfig.Encoding)
+		if len(sc.ObjectPerTopicConfig.TagLabels) > 0 && sc.ObjectPerTopicConfig.Encoding != EncodingInfluxLine {
+			return fmt.Errorf("tag_labels are only supported for the encoding %q", EncodingInfluxLine)
+		}
+		tagLabels = sc.ObjectPerTopicConfig.TagLabels
+	}
+	if sc.sparkplug() && sharedGroup != "" {
+		return fmt.Errorf("encoding %q cannot be combined with shared_subscription_group: every exporter needs the birth certificates of all edge nodes", EncodingSparkplugB)
+	}
+	for _, label := range tagLabels {
+		if !IsValidLabelName(label) {
+			return fmt.Errorf("tag label %q is not a valid label name", label)
+		}
+	}
+
+	if err := sc.TimestampConfig.validate(); err != nil {
+		return err
+	}
+
+	topicLabels := sc.TopicLabels()
+	for _, label := range topicLabels {
+		if !IsValidLabelName(label) {
+			return fmt.Errorf("topic label %q is not a valid label name", label)
+		}
+	}
+	if err := validateOnExpiry(sc.OnExpiry); err != nil {
+		return err
+	}
+	if sc.HomieConfig != nil {
+		sc.HomieConfig.TopicLabels = topicLabels
+	}
+	for i := range sc.Metrics {
+		sc.Metrics[i].TopicLabels = topicLabels
+		sc.Metrics[i].TagLabels = tagLabels
+		if sc.Metrics[i].CacheTimeout == 0 {
+			sc.Metrics[i].CacheTimeout = sc.CacheTimeout
+		}
+		if sc.Metrics[i].OnExpiry == "" && !(sc.OnExpiry == OnExpiryStale && sc.Metrics[i].Accumulating()) {
+			sc.Metrics[i].OnExpiry = sc.OnExpiry
+		}
+		if sc.Metrics[i].PrometheusName == "" && sc.ObjectPerTopicConfig != nil && sc.ObjectPerTopicConfig.AutoDiscover != nil {
+			// metrics overriding a discovered field keep the discovered name
+			sc.Metrics[i].PrometheusName = sc.ObjectPerTopicConfig.AutoDiscover.MetricName(sc.Metrics[i].MQTTName)
+		}
+		if err := sc.Metrics[i].validate(separator); err != nil {
+			return err
+		}
+		nonJSON := sc.ObjectPerTopicConfig != nil && !sc.ObjectPerTopicConfig.jsonDocument()
+		if (sc.MetricPerTopicConfig != nil || nonJSON) && len(sc.Metrics[i].WildcardLabels) > 0 {
+			return fmt.Errorf("metric %q: wildcard paths are only supported with object_per_topic_config and the encodings JSON, MSGPACK and CBOR", sc.Metrics[i].PrometheusName)
+		}
+	}
+
+	if sc.ObjectPerTopicConfig != nil && sc.ObjectPerTopicConfig.AutoDiscover != nil && !sc.ObjectPerTopicConfig.jsonDocument() {
+		return fmt.Errorf("auto_discover is only supported for the encodings JSON, MSGPACK and CBOR")
+	}
+	if sc.ObjectPerTopicConfig != nil && !sc.ObjectPerTopicConfig.jsonDocument() && sc.TimestampField != "" {
+		return fmt.Errorf("timestamp_field is not supported for the encoding %q, the timestamps of the payload are used", sc.ObjectPerTopicConfig.Encoding)
+	}
+
+	if sc.MetricPerTopicConfig != nil {
+		validRegex = false
+		for _, name := range sc.MetricPerTopicConfig.MetricNameRegex.RegEx().SubexpNames() {
+			if name == MetricNameRegexGroup {
+				validRegex = true
+			}
+		}
+		if !validRegex {
+			return fmt.Errorf("metric name regex %q does not contain required regex group %q", sc.MetricPerTopicConfig.MetricNameRegex.pattern, MetricNameRegexGroup)
+		}
+	}
+	return nil
 }
@@ -1,8 +1,14 @@
 package config
 
 import (
+	"fmt"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
+
+	"go.uber.org/zap"
 )
 
 func TestRegexp_GroupValue(t *testing.T) {
@@ -148,3 +154,947 @@ func TestRegexp_MarshalYAML(t *testing.T) {
 		})
 	}
 }
+
+func TestLoadConfig_Subscriptions(t *testing.T) {
+	tests := []struct {
+		name       string
+		config     string
+		wantTopics []string
+		wantErr    bool
+	}{
+		{
+			name: "legacy topic path",
+			config: `
+mqtt:
+  topic_path: tele/+/SENSOR
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`,
+			wantTopics: []string{"tele/+/SENSOR"},
+		},
+		{
+			name: "multiple subscriptions",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+    - topic_path: homie/+/+/+
+      metric_per_topic_config:
+        metric_name_regex: "homie/(?P<deviceid>.*)/(.*)/(?P<metricname>.*)"
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`,
+			wantTopics: []string{"tele/+/SENSOR", "homie/+/+/+"},
+		},
+		{
+			name: "subscriptions and topic path",
+			config: `
+mqtt:
+  topic_path: tele/+/SENSOR
+  subscriptions:
+    - topic_path: homie/+/+/+
+`,
+			wantErr: true,
+		},
+		{
+			name: "subscription with both extractors",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: homie/+/+/+
+      object_per_topic_config:
+        encoding: JSON
+      metric_per_topic_config:
+        metric_name_regex: "(?P<metricname>.*)"
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := LoadConfig(configFile, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var topics []string
+			for _, sub := range cfg.MQTT.Subscriptions {
+				topics = append(topics, sub.TopicPath)
+				if sub.DeviceIDRegex == nil {
+					t.Errorf("subscription %q has no device id regex", sub.TopicPath)
+				}
+				if (sub.ObjectPerTopicConfig == nil) == (sub.MetricPerTopicConfig == nil) {
+					t.Errorf("subscription %q must have exactly one extractor", sub.TopicPath)
+				}
+				if !reflect.DeepEqual(sub.Metrics, cfg.Metrics) {
+					t.Errorf("subscription %q got metrics %v, want %v", sub.TopicPath, sub.Metrics, cfg.Metrics)
+				}
+			}
+			if !reflect.DeepEqual(topics, tt.wantTopics) {
+				t.Errorf("LoadConfig() got topics %v, want %v", topics, tt.wantTopics)
+			}
+		})
+	}
+}
+
+func TestMetricConfig_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  MetricConfig
+		wantErr bool
+	}{
+		{name: "gauge", metric: MetricConfig{PrometheusName: "temperature", ValueType: GaugeValueType}},
+		{name: "histogram with buckets", metric: MetricConfig{PrometheusName: "latency", ValueType: HistogramValueType, Buckets: []float64{0.1, 1, 10}}},
+		{name: "native histogram", metric: MetricConfig{PrometheusName: "latency", ValueType: HistogramValueType, NativeHistogram: &NativeHistogramConfig{BucketFactor: 1.1}}},
+		{name: "summary with objectives", metric: MetricConfig{PrometheusName: "latency", ValueType: SummaryValueType, Objectives: map[float64]float64{0.5: 0.05, 0.99: 0.001}, MaxAge: time.Minute}},
+		{name: "buckets on gauge", metric: MetricConfig{PrometheusName: "temperature", ValueType: GaugeValueType, Buckets: []float64{1}}, wantErr: true},
+		{name: "unsorted buckets", metric: MetricConfig{PrometheusName: "latency", ValueType: HistogramValueType, Buckets: []float64{10, 1}}, wantErr: true},
+		{name: "native bucket factor too small", metric: MetricConfig{PrometheusName: "latency", ValueType: HistogramValueType, NativeHistogram: &NativeHistogramConfig{BucketFactor: 1}}, wantErr: true},
+		{name: "objectives on histogram", metric: MetricConfig{PrometheusName: "latency", ValueType: HistogramValueType, Objectives: map[float64]float64{0.5: 0.05}}, wantErr: true},
+		{name: "buckets on summary", metric: MetricConfig{PrometheusName: "latency", ValueType: SummaryValueType, Buckets: []float64{1}}, wantErr: true},
+		{name: "invalid quantile", metric: MetricConfig{PrometheusName: "latency", ValueType: SummaryValueType, Objectives: map[float64]float64{1.5: 0.05}}, wantErr: true},
+		{name: "info", metric: MetricConfig{PrometheusName: "firmware_info", ValueType: InfoValueType, InfoLabel: "version"}},
+		{name: "info without suffix", metric: MetricConfig{PrometheusName: "firmware", ValueType: InfoValueType}, wantErr: true},
+		{name: "info with expression", metric: MetricConfig{PrometheusName: "firmware_info", ValueType: InfoValueType, Expression: "value"}, wantErr: true},
+		{name: "info label on gauge", metric: MetricConfig{PrometheusName: "temperature", ValueType: GaugeValueType, InfoLabel: "version"}, wantErr: true},
+		{name: "info label clashes with dynamic label", metric: MetricConfig{PrometheusName: "firmware_info", ValueType: InfoValueType, DynamicLabels: map[string]string{"value": "raw_value"}}, wantErr: true},
+		{name: "stateset", metric: MetricConfig{PrometheusName: "power", ValueType: StateSetValueType, States: []string{"on", "off"}}},
+		{name: "stateset without states", metric: MetricConfig{PrometheusName: "power", ValueType: StateSetValueType}, wantErr: true},
+		{name: "stateset with duplicate states", metric: MetricConfig{PrometheusName: "power", ValueType: StateSetValueType, States: []string{"on", "on"}}, wantErr: true},
+		{name: "wildcard", metric: MetricConfig{PrometheusName: "temperature", MQTTName: "sensors.*.temp", WildcardLabels: []WildcardLabelConfig{{Name: "id", Field: "id"}}}},
+		{name: "wildcard without label", metric: MetricConfig{PrometheusName: "temperature", MQTTName: "sensors.*.temp"}, wantErr: true},
+		{name: "wildcard label without wildcard", metric: MetricConfig{PrometheusName: "temperature", MQTTName: "temp", WildcardLabels: []WildcardLabelConfig{{Name: "id"}}}, wantErr: true},
+		{name: "wildcard label clashes with constant label", metric: MetricConfig{PrometheusName: "temperature", MQTTName: "sensors.*.temp", ConstantLabels: map[string]string{"id": "x"}, WildcardLabels: []WildcardLabelConfig{{Name: "id"}}}, wantErr: true},
+		{name: "monotonic histogram", metric: MetricConfig{PrometheusName: "latency", ValueType: HistogramValueType, ForceMonotonicy: true}, wantErr: true},
+		{name: "negative max_series", metric: MetricConfig{PrometheusName: "temperature", MaxSeries: -1}, wantErr: true},
+		{name: "relabel", metric: MetricConfig{PrometheusName: "temperature", RelabelConfigs: []RelabelConfig{{Action: RelabelReplace, Regex: "(.*)", SourceLabels: []string{"sensor"}, TargetLabel: "device"}}}},
+		{name: "relabel with invalid regex", metric: MetricConfig{PrometheusName: "temperature", RelabelConfigs: []RelabelConfig{{Action: RelabelDrop, Regex: "(", SourceLabels: []string{"sensor"}}}}, wantErr: true},
+		{name: "relabel replace without target", metric: MetricConfig{PrometheusName: "temperature", RelabelConfigs: []RelabelConfig{{Action: RelabelReplace, SourceLabels: []string{"sensor"}}}}, wantErr: true},
+		{name: "relabel hashmod without modulus", metric: MetricConfig{PrometheusName: "temperature", RelabelConfigs: []RelabelConfig{{Action: RelabelHashMod, SourceLabels: []string{"sensor"}, TargetLabel: "shard"}}}, wantErr: true},
+		{name: "relabel labeldrop with source labels", metric: MetricConfig{PrometheusName: "temperature", RelabelConfigs: []RelabelConfig{{Action: RelabelLabelDrop, SourceLabels: []string{"sensor"}}}}, wantErr: true},
+		{name: "relabel unknown action", metric: MetricConfig{PrometheusName: "temperature", RelabelConfigs: []RelabelConfig{{Action: "rename"}}}, wantErr: true},
+		{name: "stale on expiry", metric: MetricConfig{PrometheusName: "temperature", CacheTimeout: time.Hour, OnExpiry: OnExpiryStale, ExportAge: true}},
+		{name: "unknown on expiry", metric: MetricConfig{PrometheusName: "temperature", OnExpiry: "nan"}, wantErr: true},
+		{name: "stale histogram", metric: MetricConfig{PrometheusName: "latency", ValueType: HistogramValueType, OnExpiry: OnExpiryStale}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.metric.validate("."); (err != nil) != tt.wantErr {
+				t.Errorf("validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestAutoDiscoverConfig_MetricName(t *testing.T) {
+	tests := []struct {
+		prefix string
+		path   string
+		want   string
+	}{
+		{prefix: "", path: "ENERGY.Power", want: "ENERGY_Power"},
+		{prefix: "", path: "0.temp", want: "_0_temp"},
+		{prefix: "mqtt_", path: "SDS0X1->PM2.5", want: "mqtt_SDS0X1__PM2_5"},
+	}
+	for _, tt := range tests {
+		ac := &AutoDiscoverConfig{Prefix: tt.prefix}
+		if got := ac.MetricName(tt.path); got != tt.want {
+			t.Errorf("MetricName(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLoadConfig_AutoDiscover(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+mqtt:
+  subscriptions:
+    - topic_path: tele/+/SENSOR
+      object_per_topic_config:
+        encoding: JSON
+        auto_discover:
+          prefix: tasmota_
+          deny_paths: ["^Wifi\\."]
+    - topic_path: devices/+
+metrics:
+  - mqtt_name: ENERGY.Power
+    help: Current power draw
+    mqtt_value_scale: 1000
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("LoadConfig() error = %v", err)
+	}
+	if got := cfg.MQTT.Subscriptions[0].Metrics[0].PrometheusName; got != "tasmota_ENERGY_Power" {
+		t.Errorf("expected the discovered name for the overriding metric, got %q", got)
+	}
+	if got := cfg.MQTT.Subscriptions[1].Metrics[0].PrometheusName; got != "" {
+		t.Errorf("expected the subscription without auto discovery to be unchanged, got %q", got)
+	}
+	ad := cfg.MQTT.Subscriptions[0].ObjectPerTopicConfig.AutoDiscover
+	if ad.Discover("Wifi.RSSI") || !ad.Discover("ENERGY.Today") {
+		t.Errorf("expected Wifi.RSSI to be denied and ENERGY.Today to be allowed")
+	}
+}
+
+func TestLoadConfig_RelabelConfigs(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+relabel_configs:
+  - source_labels: [sensor]
+    regex: test-.*
+    action: drop
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+    relabel_configs:
+      - source_labels: [topic]
+        regex: home/([^/]+)/.*
+        target_label: room
+  - prom_name: humidity
+    mqtt_name: humidity
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadConfig(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	var got [][]string
+	for _, m := range cfg.MQTT.Subscriptions[0].Metrics {
+		var actions []string
+		for _, rc := range m.RelabelConfigs {
+			actions = append(actions, rc.Action+" "+rc.TargetLabel+" "+rc.Replacement+" "+rc.Separator)
+		}
+		got = append(got, actions)
+	}
+	want := [][]string{
+		{"drop  $1 ;", "replace room $1 ;"},
+		{"drop  $1 ;"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the global relabel configs with defaults before the metric ones, got %q, want %q", got, want)
+	}
+	if len(cfg.Metrics[1].RelabelConfigs) != 0 {
+		t.Errorf("expected the global metrics to be unchanged, got %v", cfg.Metrics[1].RelabelConfigs)
+	}
+}
+
+func TestLoadConfig_TopicLabels(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+mqtt:
+  subscriptions:
+    - topic_path: home/+/+/SENSOR
+      device_id_regex: "home/(?P<room>[^/]+)/(?P<deviceid>[^/]+)/.*"
+      topic_labels_regex: "(?P<site>[^/]+)/(?P<room>[^/]+)/.*"
+    - topic_path: homie/+/+/+
+      metric_per_topic_config:
+        metric_name_regex: "homie/(?P<deviceid>[^/]+)/(?P<node>[^/]+)/(?P<metricname>.*)"
+    - topic_path: spBv1.0/#
+      object_per_topic_config:
+        encoding: SPARKPLUG_B
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+    dynamic_labels:
+      unit: celsius
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadConfig(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	tests := []struct {
+		topic      string
+		wantLabels []string
+		wantKeys   []string
+		wantValues map[string]string
+	}{
+		{
+			topic:      "home/kitchen/dht22/SENSOR",
+			wantLabels: []string{"room", "site"},
+			wantKeys:   []string{"unit", "device", "group", "node", "room", "site"},
+			wantValues: map[string]string{"room": "kitchen", "site": "home"},
+		},
+		{
+			topic:      "homie/dht22/climate/temperature",
+			wantLabels: []string{"node"},
+			wantKeys:   []string{"unit", "device", "group", "node", "room", "site"},
+			wantValues: map[string]string{"node": "climate"},
+		},
+		{
+			topic:      "spBv1.0/plant/DDATA/gateway/pump-1",
+			wantLabels: []string{"device", "group", "node"},
+			wantKeys:   []string{"unit", "device", "group", "node", "room", "site"},
+			wantValues: map[string]string{"device": "pump-1", "group": "plant", "node": "gateway"},
+		},
+	}
+	for i, tt := range tests {
+		sub := cfg.MQTT.Subscriptions[i]
+		if got := sub.TopicLabels(); !reflect.DeepEqual(got, tt.wantLabels) {
+			t.Errorf("TopicLabels() = %v, want %v", got, tt.wantLabels)
+		}
+		if got := sub.Metrics[0].LabelsKeys(); !reflect.DeepEqual(got, tt.wantKeys) {
+			t.Errorf("LabelsKeys() = %v, want %v", got, tt.wantKeys)
+		}
+		if got := sub.TopicLabelValues(tt.topic); !reflect.DeepEqual(got, tt.wantValues) {
+			t.Errorf("TopicLabelValues(%q) = %v, want %v", tt.topic, got, tt.wantValues)
+		}
+	}
+	if len(cfg.Metrics[0].TopicLabels) != 0 {
+		t.Errorf("expected the global metrics to be unchanged, got %v", cfg.Metrics[0].TopicLabels)
+	}
+}
+
+func TestLoadConfig_SharedMetricLabels(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		wantKeys []string
+		wantErr  bool
+	}{
+		{
+			name: "topic, Sparkplug B and tag labels",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: home/+/+/SENSOR
+      topic_labels_regex: "home/(?P<room>[^/]+)/.*"
+    - topic_path: spBv1.0/#
+      object_per_topic_config:
+        encoding: SPARKPLUG_B
+    - topic_path: telegraf/#
+      object_per_topic_config:
+        encoding: INFLUX_LINE
+        tag_labels: [station]
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`,
+			wantKeys: []string{"device", "group", "node", "room", "station"},
+		},
+		{
+			name: "subscription metrics",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: home/+/+/SENSOR
+      topic_labels_regex: "home/(?P<room>[^/]+)/.*"
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+        - prom_name: humidity
+          mqtt_name: humidity
+    - topic_path: office/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temp
+`,
+			wantKeys: []string{"room"},
+		},
+		{
+			name: "different dynamic labels",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: home/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+          dynamic_labels:
+            unit: celsius
+    - topic_path: office/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+`,
+			wantErr: true,
+		},
+		{
+			name: "different help texts",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: home/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+          help: Temperature A
+    - topic_path: office/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+          help: Temperature B
+`,
+			wantErr: true,
+		},
+		{
+			name: "different constant labels",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: home/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+          const_labels:
+            site: home
+    - topic_path: office/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+          const_labels:
+            building: office
+`,
+			wantErr: true,
+		},
+		{
+			name: "different constant label values",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: home/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+          const_labels:
+            site: home
+    - topic_path: office/+/SENSOR
+      metrics:
+        - prom_name: temperature
+          mqtt_name: temperature
+          const_labels:
+            site: office
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ReadConfig(configFile, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			// all series of a metric must have the same description, otherwise registering the collector fails
+			for _, m := range cfg.AllMetrics() {
+				if m.PrometheusName != "temperature" {
+					continue
+				}
+				if got := m.LabelsKeys(); !reflect.DeepEqual(got, tt.wantKeys) {
+					t.Errorf("LabelsKeys() = %v, want %v", got, tt.wantKeys)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Timestamp(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+mqtt:
+  timestamp_field: time
+  subscriptions:
+    - topic_path: zigbee2mqtt/+
+    - topic_path: lora/+
+      timestamp_field: received_at
+      timestamp_format: "2006-01-02 15:04:05"
+      timestamp_timezone: Europe/Berlin
+      max_timestamp_age: 24h
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadConfig(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	var got []string
+	for _, sub := range cfg.MQTT.Subscriptions {
+		tc := sub.TimestampConfig
+		got = append(got, fmt.Sprintf("%s %s %s %s %s", tc.TimestampField, tc.TimestampFormat, tc.Location(), tc.MaxTimestampAge, tc.MaxTimestampFuture))
+	}
+	want := []string{
+		"time rfc3339 UTC 1h0m0s 5m0s",
+		"received_at 2006-01-02 15:04:05 Europe/Berlin 24h0m0s 5m0s",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the timestamp settings with defaults, got %q, want %q", got, want)
+	}
+}
+
+func TestLoadConfig_CacheTimeout(t *testing.T) {
+	configFile := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(configFile, []byte(`
+mqtt:
+  subscriptions:
+    - topic_path: zigbee2mqtt/+
+      cache_timeout: 12h
+      on_expiry: stale
+metrics:
+  - prom_name: battery
+    mqtt_name: battery
+  - prom_name: power
+    mqtt_name: power
+    cache_timeout: 1m
+    on_expiry: drop
+    export_age: true
+  - prom_name: latency
+    mqtt_name: latency
+    type: histogram
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadConfig(configFile, zap.NewNop())
+	if err != nil {
+		t.Fatalf("ReadConfig() error = %v", err)
+	}
+	var got []string
+	for _, m := range cfg.MQTT.Subscriptions[0].Metrics {
+		got = append(got, fmt.Sprintf("%s %s %q %v", m.PrometheusName, m.CacheTimeout, m.OnExpiry, m.ExportAge))
+	}
+	want := []string{
+		`battery 12h0m0s "stale" false`,
+		`power 1m0s "drop" true`,
+		`latency 12h0m0s "" false`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the subscription defaults for metrics without their own settings, got %q, want %q", got, want)
+	}
+}
+
+func TestLoadConfig_Availability(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			config: `
+mqtt:
+  device_id_regex: "tele/(?P<deviceid>.*)/.*"
+  availability:
+    - topic_path: tele/+/LWT
+      payload_online: Online
+      payload_offline: Offline
+      expire_on_offline: true
+    - topic_path: zigbee2mqtt/+/availability
+      device_id_regex: "zigbee2mqtt/(?P<deviceid>.*)/availability"
+      payload_field: state
+`,
+			want: []string{
+				`tele/(?P<deviceid>.*)/.* "Online" "Offline" true`,
+				`zigbee2mqtt/(?P<deviceid>.*)/availability "online" "offline" false`,
+			},
+		},
+		{
+			name: "missing topic path",
+			config: `
+mqtt:
+  availability:
+    - payload_online: up
+`,
+			wantErr: true,
+		},
+		{
+			name: "same payloads",
+			config: `
+mqtt:
+  availability:
+    - topic_path: tele/+/LWT
+      payload_online: online
+      payload_offline: Online
+`,
+			wantErr: true,
+		},
+		{
+			name: "missing device id group",
+			config: `
+mqtt:
+  availability:
+    - topic_path: tele/+/LWT
+      device_id_regex: "tele/.*/LWT"
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.config+`
+  topic_path: tele/+/SENSOR
+metrics:
+  - prom_name: temperature
+    mqtt_name: temperature
+`), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ReadConfig(configFile, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got []string
+			for _, a := range cfg.MQTT.Availability {
+				got = append(got, fmt.Sprintf("%s %q %q %v", a.DeviceIDRegex.RegEx(), a.PayloadOnline, a.PayloadOffline, a.ExpireOnOffline))
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHomeAssistantDiscoveryConfig_MetricName(t *testing.T) {
+	tests := []struct {
+		component string
+		name      string
+		unit      string
+		counter   bool
+		want      string
+	}{
+		{component: HomeAssistantSensor, name: "temperature", unit: "°C", want: "sensor_temperature_celsius"},
+		{component: HomeAssistantSensor, name: "energy", unit: "kWh", counter: true, want: "sensor_energy_kilowatt_hours_total"},
+		{component: HomeAssistantSensor, name: "co2", unit: "ppm", want: "sensor_co2_ppm"},
+		{component: HomeAssistantSensor, name: "rain", unit: "mm/d", want: "sensor_rain_mm_d"},
+		{component: HomeAssistantSensor, name: "power_watts", unit: "W", want: "sensor_power_watts"},
+		{component: HomeAssistantBinarySensor, name: "motion", want: "binary_sensor_motion"},
+		{component: HomeAssistantBinarySensor, name: "door-1", want: "binary_sensor_door_1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			hc := HomeAssistantDiscoveryConfig{}
+			if got := hc.MetricName(tt.component, tt.name, tt.unit, tt.counter); got != tt.want {
+				t.Errorf("MetricName() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_HomeAssistantDiscovery(t *testing.T) {
+	tests := []struct {
+		name              string
+		config            string
+		wantSubscriptions int
+		wantErr           bool
+	}{
+		{
+			name: "discovery only",
+			config: `
+mqtt:
+  homeassistant_discovery: {}
+`,
+		},
+		{
+			name: "with subscriptions",
+			config: `
+mqtt:
+  topic_path: tele/+/SENSOR
+  homeassistant_discovery:
+    components: [sensor]
+`,
+			wantSubscriptions: 1,
+		},
+		{
+			name: "unsupported component",
+			config: `
+mqtt:
+  homeassistant_discovery:
+    components: [light]
+`,
+			wantErr: true,
+		},
+		{
+			name: "shared subscription group",
+			config: `
+mqtt:
+  shared_subscription_group: exporters
+  homeassistant_discovery: {}
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ReadConfig(configFile, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(cfg.MQTT.Subscriptions) != tt.wantSubscriptions {
+				t.Errorf("expected %d subscriptions, got %d", tt.wantSubscriptions, len(cfg.MQTT.Subscriptions))
+			}
+			hc := cfg.MQTT.HomeAssistantDiscovery
+			if hc.Prefix != DefaultHomeAssistantDiscoveryPrefix || len(hc.Components) == 0 {
+				t.Errorf("expected the defaults, got %+v", hc)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_Homie(t *testing.T) {
+	tests := []struct {
+		name          string
+		config        string
+		wantDeviceID  string
+		wantBaseTopic string
+		wantErr       bool
+	}{
+		{
+			name: "defaults",
+			config: `
+mqtt:
+  topic_path: homie/#
+  homie_config: {}
+`,
+			wantDeviceID:  "^homie/(?P<deviceid>[^/]+)(/|$)",
+			wantBaseTopic: "homie",
+		},
+		{
+			name: "custom base topic and device id regex",
+			config: `
+mqtt:
+  subscriptions:
+    - topic_path: devices/homie/#
+      device_id_regex: "devices/homie/(?P<deviceid>[^/]+)/.*"
+      homie_config:
+        base_topic: devices/homie/
+`,
+			wantDeviceID:  "devices/homie/(?P<deviceid>[^/]+)/.*",
+			wantBaseTopic: "devices/homie",
+		},
+		{
+			name: "combined with metric_per_topic_config",
+			config: `
+mqtt:
+  topic_path: homie/#
+  homie_config: {}
+  metric_per_topic_config:
+    metric_name_regex: "homie/(?P<metricname>.*)"
+`,
+			wantErr: true,
+		},
+		{
+			name: "wildcard base topic",
+			config: `
+mqtt:
+  topic_path: homie/#
+  homie_config:
+    base_topic: homie/+
+`,
+			wantErr: true,
+		},
+		{
+			name: "shared subscription group",
+			config: `
+mqtt:
+  topic_path: homie/#
+  shared_subscription_group: exporters
+  homie_config: {}
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ReadConfig(configFile, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			sub := cfg.MQTT.Subscriptions[0]
+			if sub.ObjectPerTopicConfig != nil {
+				t.Errorf("expected no object_per_topic_config")
+			}
+			if got := sub.DeviceIDRegex.RegEx().String(); got != tt.wantDeviceID {
+				t.Errorf("device id regex = %q, want %q", got, tt.wantDeviceID)
+			}
+			if sub.HomieConfig.BaseTopic != tt.wantBaseTopic {
+				t.Errorf("base topic = %q, want %q", sub.HomieConfig.BaseTopic, tt.wantBaseTopic)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_InfluxLine(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		wantEncoding string
+		wantKeys     []string
+		wantErr      bool
+	}{
+		{
+			name: "tag labels",
+			config: `
+mqtt:
+  topic_path: telegraf/#
+  object_per_topic_config:
+    encoding: influx_line
+    tag_labels: [station, host]
+metrics:
+  - prom_name: temperature
+    mqtt_name: temp
+`,
+			wantEncoding: EncodingInfluxLine,
+			wantKeys:     []string{"station", "host"},
+		},
+		{
+			name: "tag labels with JSON",
+			config: `
+mqtt:
+  topic_path: telegraf/#
+  object_per_topic_config:
+    encoding: JSON
+    tag_labels: [station]
+`,
+			wantErr: true,
+		},
+		{
+			name: "invalid tag label",
+			config: `
+mqtt:
+  topic_path: telegraf/#
+  object_per_topic_config:
+    encoding: INFLUX_LINE
+    tag_labels: [station-id]
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ReadConfig(configFile, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			sub := cfg.MQTT.Subscriptions[0]
+			if sub.ObjectPerTopicConfig.Encoding != tt.wantEncoding {
+				t.Errorf("encoding = %q, want %q", sub.ObjectPerTopicConfig.Encoding, tt.wantEncoding)
+			}
+			if got := sub.Metrics[0].LabelsKeys(); !reflect.DeepEqual(got, tt.wantKeys) {
+				t.Errorf("LabelsKeys() = %v, want %v", got, tt.wantKeys)
+			}
+		})
+	}
+}
+
+func TestLoadConfig_BinaryEncodings(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       string
+		wantEncoding string
+		wantErr      bool
+	}{
+		{
+			name: "msgpack",
+			config: `
+mqtt:
+  topic_path: esp/+
+  object_per_topic_config:
+    encoding: msgpack
+metrics:
+  - prom_name: temperature
+    mqtt_name: sensors.*.temperature
+    wildcard_labels:
+      - name: sensor_name
+`,
+			wantEncoding: EncodingMsgpack,
+		},
+		{
+			name: "cbor with auto discovery and payload timestamps",
+			config: `
+mqtt:
+  topic_path: esp/+
+  timestamp_field: time
+  object_per_topic_config:
+    encoding: CBOR
+    auto_discover:
+      prefix: esp_
+`,
+			wantEncoding: EncodingCBOR,
+		},
+		{
+			name: "auto discovery with sparkplug",
+			config: `
+mqtt:
+  topic_path: spBv1.0/#
+  object_per_topic_config:
+    encoding: SPARKPLUG_B
+    auto_discover: {}
+`,
+			wantErr: true,
+		},
+		{
+			name: "sparkplug with shared subscription group",
+			config: `
+mqtt:
+  topic_path: spBv1.0/#
+  shared_subscription_group: exporters
+  object_per_topic_config:
+    encoding: SPARKPLUG_B
+`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			configFile := filepath.Join(t.TempDir(), "config.yaml")
+			if err := os.WriteFile(configFile, []byte(tt.config), 0644); err != nil {
+				t.Fatal(err)
+			}
+			cfg, err := ReadConfig(configFile, zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ReadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := cfg.MQTT.Subscriptions[0].ObjectPerTopicConfig.Encoding; got != tt.wantEncoding {
+				t.Errorf("encoding = %q, want %q", got, tt.wantEncoding)
+			}
+		})
+	}
+}
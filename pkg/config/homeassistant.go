@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	DefaultHomeAssistantDiscoveryPrefix = "homeassistant"
+	HomeAssistantSensor                 = "sensor"
+	HomeAssistantBinarySensor           = "binary_sensor"
+)
+
+// HomeAssistantDiscoveryConfig creates metrics from the Home Assistant MQTT discovery messages published on
+// <prefix>/<component>/[<node_id>/]<object_id>/config.
+type HomeAssistantDiscoveryConfig struct {
+	// Prefix is the discovery prefix, it defaults to homeassistant
+	Prefix string `yaml:"prefix"`
+	// Components are the discovered components, they default to sensor and binary_sensor
+	Components []string `yaml:"components"`
+	// MetricPrefix is prepended to the names of the discovered metrics
+	MetricPrefix string `yaml:"metric_prefix"`
+	// QoS is used for the discovery and the state topics
+	QoS byte `yaml:"qos"`
+}
+
+// MetricName returns the prometheus name of a discovered entity: <metric_prefix><component>_<name>_<unit>. Counters
+// get the suffix _total.
+func (hc *HomeAssistantDiscoveryConfig) MetricName(component, name, unit string, counter bool) string {
+	parts := []string{component, name}
+	if suffix := unitSuffix(unit); suffix != "" && !strings.HasSuffix(name, suffix) {
+		parts = append(parts, suffix)
+	}
+	if counter {
+		parts = append(parts, "total")
+	}
+	metricName := hc.MetricPrefix + invalidMetricNameChars.ReplaceAllString(strings.Join(parts, "_"), "_")
+	if metricName[0] >= '0' && metricName[0] <= '9' {
+		metricName = "_" + metricName
+	}
+	return metricName
+}
+
+// Discovers returns true if the given component is discovered.
+func (hc *HomeAssistantDiscoveryConfig) Discovers(component string) bool {
+	for _, c := range hc.Components {
+		if c == component {
+			return true
+		}
+	}
+	return false
+}
+
+func (hc *HomeAssistantDiscoveryConfig) validate(sharedGroup string) error {
+	if sharedGroup != "" {
+		return fmt.Errorf("homeassistant_discovery cannot be combined with shared_subscription_group: every exporter needs all discovery messages")
+	}
+	if hc.Prefix == "" {
+		hc.Prefix = DefaultHomeAssistantDiscoveryPrefix
+	}
+	if len(hc.Components) == 0 {
+		hc.Components = []string{HomeAssistantSensor, HomeAssistantBinarySensor}
+	}
+	for _, c := range hc.Components {
+		if c != HomeAssistantSensor && c != HomeAssistantBinarySensor {
+			return fmt.Errorf("homeassistant_discovery: unsupported component %q, supported are %s and %s", c, HomeAssistantSensor, HomeAssistantBinarySensor)
+		}
+	}
+	if hc.MetricPrefix != "" && !IsValidLabelName(hc.MetricPrefix) {
+		return fmt.Errorf("homeassistant_discovery: metric_prefix %q is not a valid metric name prefix", hc.MetricPrefix)
+	}
+	return nil
+}
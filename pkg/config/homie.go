@@ -0,0 +1,59 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const DefaultHomieBaseTopic = "homie"
+
+// HomieConfig extracts the properties of devices following the Homie convention (https://homieiot.github.io/).
+type HomieConfig struct {
+	// BaseTopic is the topic below which the devices publish, it defaults to homie
+	BaseTopic string `yaml:"base_topic"`
+	// MetricPrefix is prepended to the names of the property metrics
+	MetricPrefix string `yaml:"metric_prefix"`
+	// TopicLabels are the labels extracted from the topic. They are set from the subscription while loading the config.
+	TopicLabels []string `yaml:"-"`
+}
+
+// MetricName returns the prometheus name of a property: <metric_prefix><node>_<property>_<unit>.
+func (hc *HomieConfig) MetricName(node, property, unit string) string {
+	name := node + "_" + property
+	if suffix := unitSuffix(unit); suffix != "" && !strings.HasSuffix(name, suffix) {
+		name += "_" + suffix
+	}
+	metricName := hc.MetricPrefix + invalidMetricNameChars.ReplaceAllString(name, "_")
+	if metricName[0] >= '0' && metricName[0] <= '9' {
+		metricName = "_" + metricName
+	}
+	return metricName
+}
+
+// StateMetricName returns the prometheus name of the device state metric.
+func (hc *HomieConfig) StateMetricName() string {
+	return hc.MetricPrefix + "homie_device_state"
+}
+
+// deviceIDRegex returns a device id regex matching the Homie device ID below the base topic.
+func (hc *HomieConfig) deviceIDRegex() *Regexp {
+	return MustNewRegexp(fmt.Sprintf("^%s/(?P<%s>[^/]+)(/|$)", regexp.QuoteMeta(hc.BaseTopic), DeviceIDRegexGroup))
+}
+
+func (hc *HomieConfig) validate(sharedGroup string) error {
+	if sharedGroup != "" {
+		return fmt.Errorf("homie_config cannot be combined with shared_subscription_group: every exporter needs the retained attributes of all devices")
+	}
+	hc.BaseTopic = strings.TrimRight(hc.BaseTopic, "/")
+	if hc.BaseTopic == "" {
+		hc.BaseTopic = DefaultHomieBaseTopic
+	}
+	if strings.ContainsAny(hc.BaseTopic, "+#") {
+		return fmt.Errorf("homie_config: base_topic %q must not contain wildcards", hc.BaseTopic)
+	}
+	if hc.MetricPrefix != "" && !IsValidLabelName(hc.MetricPrefix) {
+		return fmt.Errorf("homie_config: metric_prefix %q is not a valid metric name prefix", hc.MetricPrefix)
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+	RelabelHashMod   = "hashmod"
+)
+
+var labelNameRegexp = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+
+// RelabelConfigDefaults are the defaults of prometheus relabel configs
+var RelabelConfigDefaults = RelabelConfig{
+	Action:      RelabelReplace,
+	Separator:   ";",
+	Regex:       "(.*)",
+	Replacement: "$1",
+}
+
+// RelabelConfig rewrites the labels of a metric with the semantics of prometheus relabel_configs. It works on the
+// "sensor", "topic", constant and dynamic labels.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow"`
+	Separator    string   `yaml:"separator"`
+	// Regex is anchored at both ends
+	Regex       string `yaml:"regex"`
+	Modulus     uint64 `yaml:"modulus"`
+	TargetLabel string `yaml:"target_label"`
+	Replacement string `yaml:"replacement"`
+	Action      string `yaml:"action"`
+
+	regex *regexp.Regexp
+}
+
+// MustNewRelabelConfig validates the relabel config and compiles its regex. It panics if the config is invalid.
+func MustNewRelabelConfig(rc RelabelConfig) RelabelConfig {
+	if err := rc.validate(); err != nil {
+		panic(err)
+	}
+	return rc
+}
+
+func (rc *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*rc = RelabelConfigDefaults
+	type plain RelabelConfig
+	return unmarshal((*plain)(rc))
+}
+
+func (rc *RelabelConfig) MarshalYAML() (interface{}, error) {
+	type plain RelabelConfig
+	return (*plain)(rc), nil
+}
+
+// IsValidLabelName reports whether the name is a valid prometheus label name.
+func IsValidLabelName(name string) bool {
+	return labelNameRegexp.MatchString(name)
+}
+
+// Regexp returns the compiled, anchored regex. It is only set after the config was validated.
+func (rc *RelabelConfig) Regexp() *regexp.Regexp {
+	return rc.regex
+}
+
+func (rc *RelabelConfig) validate() error {
+	regex, err := regexp.Compile("^(?:" + rc.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %q: %w", rc.Regex, err)
+	}
+	rc.regex = regex
+	switch rc.Action {
+	case RelabelReplace, RelabelHashMod:
+		if rc.TargetLabel == "" {
+			return fmt.Errorf("action %q requires a target_label", rc.Action)
+		}
+		if rc.Action == RelabelHashMod {
+			if rc.Modulus == 0 {
+				return fmt.Errorf("action %q requires a modulus greater than zero", rc.Action)
+			}
+			if !labelNameRegexp.MatchString(rc.TargetLabel) {
+				return fmt.Errorf("invalid target_label %q", rc.TargetLabel)
+			}
+		}
+	case RelabelKeep, RelabelDrop:
+		if len(rc.SourceLabels) == 0 {
+			return fmt.Errorf("action %q requires source_labels", rc.Action)
+		}
+	case RelabelLabelMap, RelabelLabelDrop, RelabelLabelKeep:
+		if len(rc.SourceLabels) > 0 || rc.TargetLabel != "" {
+			return fmt.Errorf("action %q works on the label names and cannot be used with source_labels or target_label", rc.Action)
+		}
+	default:
+		return fmt.Errorf("unknown action %q", rc.Action)
+	}
+	return nil
+}
+
+func validateRelabelConfigs(configs []RelabelConfig) error {
+	for i := range configs {
+		if err := configs[i].validate(); err != nil {
+			return fmt.Errorf("relabel_configs[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
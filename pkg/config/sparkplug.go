@@ -0,0 +1,48 @@
+package config
+
+import "strings"
+
+const (
+	SparkplugNamespace = "spBv1.0"
+
+	SparkplugGroupLabel  = "group"
+	SparkplugNodeLabel   = "node"
+	SparkplugDeviceLabel = "device"
+)
+
+// SparkplugLabels are the labels of the metrics of Sparkplug B subscriptions.
+var SparkplugLabels = []string{SparkplugGroupLabel, SparkplugNodeLabel, SparkplugDeviceLabel}
+
+// SparkplugTopic is a topic of the Sparkplug B namespace: spBv1.0/<group>/<message type>/<node>[/<device>].
+type SparkplugTopic struct {
+	Group       string
+	MessageType string
+	Node        string
+	// Device is empty for the messages of the edge node
+	Device string
+}
+
+// ParseSparkplugTopic splits a Sparkplug B topic. It returns false for other topics and for the STATE messages of
+// host applications.
+func ParseSparkplugTopic(topic string) (SparkplugTopic, bool) {
+	segments := strings.Split(topic, "/")
+	if len(segments) < 4 || len(segments) > 5 || segments[0] != SparkplugNamespace {
+		return SparkplugTopic{}, false
+	}
+	t := SparkplugTopic{Group: segments[1], MessageType: segments[2], Node: segments[3]}
+	if len(segments) == 5 {
+		t.Device = segments[4]
+	}
+	return t, true
+}
+
+// IsSparkplugStateTopic returns true for the STATE messages of host applications: spBv1.0/STATE/<host>.
+func IsSparkplugStateTopic(topic string) bool {
+	segments := strings.Split(topic, "/")
+	return len(segments) == 3 && segments[0] == SparkplugNamespace && segments[1] == "STATE"
+}
+
+// sparkplug returns true if the subscription decodes Sparkplug B payloads.
+func (sc *SubscriptionConfig) sparkplug() bool {
+	return sc.ObjectPerTopicConfig != nil && sc.ObjectPerTopicConfig.Encoding == EncodingSparkplugB
+}
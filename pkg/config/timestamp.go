@@ -0,0 +1,71 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	TimestampFormatRFC3339 = "rfc3339"
+	TimestampFormatUnix    = "unix"
+	TimestampFormatUnixMs  = "unix_ms"
+	TimestampFormatUnixNs  = "unix_ns"
+)
+
+var TimestampConfigDefaults = TimestampConfig{
+	TimestampFormat:    TimestampFormatRFC3339,
+	MaxTimestampAge:    time.Hour,
+	MaxTimestampFuture: 5 * time.Minute,
+}
+
+// TimestampConfig reads the timestamp of the metrics from a field of the payload instead of using the ingest time.
+type TimestampConfig struct {
+	// TimestampField is the path of the timestamp in the payload
+	TimestampField string `yaml:"timestamp_field"`
+	// TimestampFormat is rfc3339, unix, unix_ms, unix_ns or a go time layout
+	TimestampFormat string `yaml:"timestamp_format"`
+	// TimestampTimezone is used for layouts without a time zone. Defaults to UTC.
+	TimestampTimezone string `yaml:"timestamp_timezone"`
+	// MaxTimestampAge and MaxTimestampFuture reject timestamps too far from the ingest time. A negative value disables the check.
+	MaxTimestampAge    time.Duration `yaml:"max_timestamp_age"`
+	MaxTimestampFuture time.Duration `yaml:"max_timestamp_future"`
+
+	location *time.Location
+}
+
+// MustNewTimestampConfig validates the timestamp config and sets its defaults. It panics if the config is invalid.
+func MustNewTimestampConfig(tc TimestampConfig) TimestampConfig {
+	if err := tc.validate(); err != nil {
+		panic(err)
+	}
+	return tc
+}
+
+// Location returns the time zone of timestamps without a zone. It is only set after the config was validated.
+func (tc *TimestampConfig) Location() *time.Location {
+	if tc.location == nil {
+		return time.UTC
+	}
+	return tc.location
+}
+
+func (tc *TimestampConfig) validate() error {
+	if tc.TimestampField == "" {
+		return nil
+	}
+	if tc.TimestampFormat == "" {
+		tc.TimestampFormat = TimestampConfigDefaults.TimestampFormat
+	}
+	if tc.MaxTimestampAge == 0 {
+		tc.MaxTimestampAge = TimestampConfigDefaults.MaxTimestampAge
+	}
+	if tc.MaxTimestampFuture == 0 {
+		tc.MaxTimestampFuture = TimestampConfigDefaults.MaxTimestampFuture
+	}
+	location, err := time.LoadLocation(tc.TimestampTimezone)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp_timezone %q: %w", tc.TimestampTimezone, err)
+	}
+	tc.location = location
+	return nil
+}
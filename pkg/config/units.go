@@ -0,0 +1,68 @@
+package config
+
+import "strings"
+
+// unitSuffixes are the metric name suffixes of common units of measurement.
+var unitSuffixes = map[string]string{
+	"°C":     "celsius",
+	"°F":     "fahrenheit",
+	"K":      "kelvin",
+	"%":      "percent",
+	"W":      "watts",
+	"kW":     "kilowatts",
+	"Wh":     "watt_hours",
+	"kWh":    "kilowatt_hours",
+	"V":      "volts",
+	"mV":     "millivolts",
+	"A":      "amperes",
+	"mA":     "milliamperes",
+	"VA":     "volt_amperes",
+	"Hz":     "hertz",
+	"lx":     "lux",
+	"Pa":     "pascals",
+	"hPa":    "hectopascals",
+	"dB":     "decibels",
+	"dBm":    "dbm",
+	"s":      "seconds",
+	"ms":     "milliseconds",
+	"min":    "minutes",
+	"h":      "hours",
+	"m³":     "cubic_meters",
+	"L":      "liters",
+	"µg/m³":  "micrograms_per_cubic_meter",
+	"mg/m³":  "milligrams_per_cubic_meter",
+	"ppm":    "ppm",
+	"ppb":    "ppb",
+	"m³/h":   "cubic_meters_per_hour",
+	"L/min":  "liters_per_minute",
+	"km/h":   "kilometers_per_hour",
+	"m/s":    "meters_per_second",
+	"mm":     "millimeters",
+	"mm/h":   "millimeters_per_hour",
+	"W/m²":   "watts_per_square_meter",
+	"µS/cm":  "microsiemens_per_centimeter",
+	"lm":     "lumens",
+	"°":      "degrees",
+	"kg":     "kilograms",
+	"g":      "grams",
+	"B":      "bytes",
+	"kB":     "kilobytes",
+	"MB":     "megabytes",
+	"GB":     "gigabytes",
+	"bit/s":  "bits_per_second",
+	"kbit/s": "kilobits_per_second",
+	"Mbit/s": "megabits_per_second",
+	"m":      "meters",
+	"ft":     "feet",
+	"gal":    "gallons",
+	"psi":    "psi",
+}
+
+// unitSuffix returns the metric name suffix of a unit of measurement. Unknown units are sanitised.
+func unitSuffix(unit string) string {
+	suffix, ok := unitSuffixes[unit]
+	if !ok {
+		suffix = strings.ToLower(invalidMetricNameChars.ReplaceAllString(unit, "_"))
+	}
+	return strings.Trim(suffix, "_")
+}
@@ -0,0 +1,102 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	gojsonq "github.com/thedevsaddam/gojsonq/v2"
+)
+
+// Availability records the online state of the devices from the messages of an availability topic.
+type Availability struct {
+	lock      sync.Mutex
+	inFlight  sync.WaitGroup
+	cfg       config.AvailabilityConfig
+	separator string
+	sharding  *config.ShardingConfig
+	collector Collector
+	devices   *DeviceTracker
+}
+
+// NewAvailability creates the availability tracking of the given config. If sharding is not nil, only the devices of
+// the configured shard are tracked.
+func NewAvailability(cfg config.AvailabilityConfig, separator string, collector Collector, devices *DeviceTracker, sharding *config.ShardingConfig) *Availability {
+	return &Availability{
+		cfg:       cfg,
+		separator: separator,
+		sharding:  sharding,
+		collector: collector,
+		devices:   devices,
+	}
+}
+
+// Update replaces the availability config. The topic path of the config is ignored.
+func (a *Availability) Update(cfg config.AvailabilityConfig, separator string) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.cfg = cfg
+	a.separator = separator
+}
+
+func (a *Availability) store(m mqttclient.Message) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	deviceID := a.cfg.DeviceIDRegex.GroupValue(m.Topic, config.DeviceIDRegexGroup)
+	if deviceID == "" {
+		return fmt.Errorf("could not extract the device id")
+	}
+	if !ownsDevice(a.sharding, deviceID) {
+		return nil
+	}
+	online, err := a.online(m.Payload)
+	if err != nil {
+		return err
+	}
+	a.devices.SetAvailable(deviceID, online)
+	if !online && a.cfg.ExpireOnOffline {
+		a.collector.ExpireDevice(deviceID)
+	}
+	return nil
+}
+
+// online compares the state in the payload with the configured online and offline payloads.
+func (a *Availability) online(payload []byte) (bool, error) {
+	state := string(payload)
+	if a.cfg.PayloadField != "" {
+		parsed := gojsonq.New(gojsonq.SetSeparator(a.separator)).FromString(state)
+		switch v := parsed.Find(a.cfg.PayloadField).(type) {
+		case string:
+			state = v
+		case bool:
+			return v, nil
+		default:
+			return false, fmt.Errorf("payload has no string field %q", a.cfg.PayloadField)
+		}
+	}
+	state = strings.TrimSpace(state)
+	switch {
+	case strings.EqualFold(state, a.cfg.PayloadOnline):
+		return true, nil
+	case strings.EqualFold(state, a.cfg.PayloadOffline):
+		return false, nil
+	}
+	return false, fmt.Errorf("unknown availability %q, expected %q or %q", state, a.cfg.PayloadOnline, a.cfg.PayloadOffline)
+}
+
+func (a *Availability) SetupSubscriptionHandler(errChan chan<- error) mqttclient.MessageHandler {
+	return func(m mqttclient.Message) {
+		a.inFlight.Add(1)
+		defer a.inFlight.Done()
+		if err := a.store(m); err != nil {
+			errChan <- fmt.Errorf("could not store availability '%s' on topic %s: %s", string(m.Payload), m.Topic, err.Error())
+		}
+	}
+}
+
+// Drain blocks until all messages which are currently processed are stored.
+func (a *Availability) Drain() {
+	a.inFlight.Wait()
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+)
+
+func TestAvailability_online(t *testing.T) {
+	tests := []struct {
+		name         string
+		payloadField string
+		payload      string
+		want         bool
+		wantErr      bool
+	}{
+		{name: "online", payload: "Online", want: true},
+		{name: "offline", payload: "offline\n", want: false},
+		{name: "unknown", payload: "rebooting", wantErr: true},
+		{name: "json field", payloadField: "state", payload: `{"state": "ONLINE"}`, want: true},
+		{name: "json bool", payloadField: "state", payload: `{"state": false}`, want: false},
+		{name: "missing json field", payloadField: "state", payload: `{"available": true}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := NewAvailability(config.AvailabilityConfig{
+				PayloadField:   tt.payloadField,
+				PayloadOnline:  config.DefaultPayloadOnline,
+				PayloadOffline: config.DefaultPayloadOffline,
+			}, ".", nil, nil, nil)
+			got, err := a.online([]byte(tt.payload))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("online() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("online() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAvailability_ExpireOnOffline(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = testNow
+	temperature := config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge"}
+	battery := config.MetricConfig{PrometheusName: "battery", ValueType: "gauge", OnExpiry: config.OnExpiryKeep}
+	power := config.MetricConfig{PrometheusName: "power", ValueType: "gauge", OnExpiry: config.OnExpiryStale}
+	c := NewCollector(time.Hour, []config.MetricConfig{temperature, battery, power}, zap.NewNop())
+	for _, device := range []string{"plug", "dht22"} {
+		c.Observe(device, MetricCollection{
+			{Description: temperature.PrometheusDescription(), Value: 21.5, ValueType: temperature.PrometheusValueType()},
+			{Description: battery.PrometheusDescription(), Value: 80, ValueType: battery.PrometheusValueType()},
+			{Description: power.PrometheusDescription(), Value: 12, ValueType: power.PrometheusValueType()},
+		})
+	}
+	devices := NewDeviceTracker(time.Hour)
+	a := NewAvailability(config.AvailabilityConfig{
+		DeviceIDRegex:   config.MustNewRegexp("tele/(?P<deviceid>.*)/LWT"),
+		PayloadOnline:   "Online",
+		PayloadOffline:  "Offline",
+		ExpireOnOffline: true,
+	}, ".", c, devices, nil)
+	for _, m := range []mqttclient.Message{
+		{Topic: "tele/dht22/LWT", Payload: []byte("Online")},
+		{Topic: "tele/plug/LWT", Payload: []byte("Offline")},
+	} {
+		if err := a.store(m); err != nil {
+			t.Fatalf("store() error = %v", err)
+		}
+	}
+
+	want := `
+# HELP mqtt2prometheus_device_up Whether the device reported to be online on its availability topic
+# TYPE mqtt2prometheus_device_up gauge
+mqtt2prometheus_device_up{sensor="dht22"} 1
+mqtt2prometheus_device_up{sensor="plug"} 0
+`
+	if err := testutil.CollectAndCompare(devices, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	got := map[string]float64{}
+	for _, raw := range c.(*MemoryCachedCollector).cache.Items() {
+		item := raw.Object.(CacheItem)
+		if item.DeviceID == "plug" {
+			got[item.Metric.Description.String()] = item.Metric.Value
+			if item.Metric.Description.String() == power.PrometheusDescription().String() && !item.Expires.Equal(testNow()) {
+				t.Errorf("expected the stale metric to expire now, expires at %v", item.Expires)
+			}
+		}
+	}
+	if _, ok := got[temperature.PrometheusDescription().String()]; ok || len(got) != 2 {
+		t.Errorf("expected only the kept and the stale metric of the offline device, got %v", got)
+	}
+	if n := testutil.CollectAndCount(c, "temperature"); n != 1 {
+		t.Errorf("expected the temperature of the online device, got %d series", n)
+	}
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// PayloadDecoder converts a binary payload to JSON.
+type PayloadDecoder func(payload []byte) ([]byte, error)
+
+// WithPayloadDecoder converts every payload to JSON before it is passed to the extractor. Like this, binary encodings
+// support the same paths, wildcards and payload timestamps as JSON.
+func WithPayloadDecoder(extractor Extractor, decode PayloadDecoder) Extractor {
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
+		converted, err := decode(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode payload: %w", err)
+		}
+		return extractor(topic, converted, deviceID, props)
+	}
+}
+
+// DecodeMsgpack converts a MessagePack payload to JSON.
+func DecodeMsgpack(payload []byte) ([]byte, error) {
+	var doc interface{}
+	if err := msgpack.Unmarshal(payload, &doc); err != nil {
+		return nil, err
+	}
+	return marshalDocument(doc)
+}
+
+// DecodeCBOR converts a CBOR payload to JSON.
+func DecodeCBOR(payload []byte) ([]byte, error) {
+	var doc interface{}
+	if err := cbor.Unmarshal(payload, &doc); err != nil {
+		return nil, err
+	}
+	return marshalDocument(doc)
+}
+
+// marshalDocument encodes the decoded document as JSON. Map keys which are not strings, like integer keys, are
+// formatted as strings. NaN and infinite values, which JSON cannot represent, become the strings "NaN", "+Inf" and
+// "-Inf" and are parsed like numbers again. Byte strings are base64 encoded.
+func marshalDocument(doc interface{}) ([]byte, error) {
+	return json.Marshal(stringKeys(doc))
+}
+
+func stringKeys(doc interface{}) interface{} {
+	switch v := doc.(type) {
+	case map[string]interface{}:
+		for k, value := range v {
+			v[k] = stringKeys(value)
+		}
+		return v
+	case map[interface{}]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			converted[fmt.Sprint(k)] = stringKeys(value)
+		}
+		return converted
+	case []interface{}:
+		for i, value := range v {
+			v[i] = stringKeys(value)
+		}
+		return v
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v)
+	case float32:
+		return finite(float64(v), doc)
+	case float64:
+		return finite(v, doc)
+	}
+	return doc
+}
+
+func finite(f float64, doc interface{}) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return doc
+}
@@ -0,0 +1,162 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+func TestWithPayloadDecoder(t *testing.T) {
+	now = testNow
+	defer func() { now = time.Now }()
+	metricConfigs := []config.MetricConfig{
+		{PrometheusName: "temperature", MQTTName: "DHT22.Temperature", ValueType: config.GaugeValueType},
+		{PrometheusName: "temperature_kelvin", MQTTName: "DHT22.Temperature", ValueType: config.GaugeValueType, Expression: "value + 273.15"},
+		{PrometheusName: "state", MQTTName: "POWER", ValueType: config.GaugeValueType, StringValueMapping: &config.StringValueMappingConfig{Map: map[string]float64{"ON": 1, "OFF": 0}}},
+		{PrometheusName: "online", MQTTName: "online", ValueType: config.GaugeValueType},
+		{PrometheusName: "first_channel", MQTTName: "channels.[1]", ValueType: config.GaugeValueType},
+	}
+	doc := map[string]interface{}{
+		"DHT22":    map[string]interface{}{"Temperature": 21.5},
+		"POWER":    "ON",
+		"online":   true,
+		"channels": []interface{}{int8(3), uint64(7)},
+	}
+	gauge := func(name string, value float64) Metric {
+		return Metric{
+			Description: prometheus.NewDesc(name, "", []string{"sensor", "topic"}, nil),
+			Value:       value,
+			ValueType:   prometheus.GaugeValue,
+			IngestTime:  testNow(),
+			Topic:       "tele/sensor",
+		}
+	}
+	want := MetricCollection{
+		gauge("first_channel", 7),
+		gauge("online", 1),
+		gauge("state", 1),
+		gauge("temperature", 21.5),
+		gauge("temperature_kelvin", 294.65),
+	}
+	msgpackPayload, err := msgpack.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cborPayload, err := cbor.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	integerKeys, err := cbor.Marshal(map[interface{}]interface{}{"DHT22": map[int]float64{1: 20}, "online": false})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonFinite := map[string]interface{}{
+		"DHT22":  map[string]interface{}{"Temperature": math.Inf(-1)},
+		"online": float32(math.Inf(1)),
+		"raw":    []byte{0xff, 0x00},
+		"unused": math.NaN(),
+		"POWER":  math.NaN(),
+	}
+	msgpackNonFinite, err := msgpack.Marshal(nonFinite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cborNonFinite, err := cbor.Marshal(nonFinite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantNonFinite := MetricCollection{
+		gauge("online", math.Inf(1)),
+		gauge("state", math.NaN()),
+		gauge("temperature", math.Inf(-1)),
+		gauge("temperature_kelvin", math.Inf(-1)),
+	}
+
+	tests := []struct {
+		name    string
+		decode  PayloadDecoder
+		payload []byte
+		want    MetricCollection
+		wantErr bool
+	}{
+		{
+			name:    "msgpack",
+			decode:  DecodeMsgpack,
+			payload: msgpackPayload,
+			want:    want,
+		},
+		{
+			name:    "cbor",
+			decode:  DecodeCBOR,
+			payload: cborPayload,
+			want:    want,
+		},
+		{
+			name:    "cbor with integer keys",
+			decode:  DecodeCBOR,
+			payload: integerKeys,
+			want:    MetricCollection{gauge("online", 0)},
+		},
+		{
+			name:    "msgpack with non-finite values",
+			decode:  DecodeMsgpack,
+			payload: msgpackNonFinite,
+			want:    wantNonFinite,
+		},
+		{
+			name:    "cbor with non-finite values",
+			decode:  DecodeCBOR,
+			payload: cborNonFinite,
+			want:    wantNonFinite,
+		},
+		{
+			name:    "invalid msgpack",
+			decode:  DecodeMsgpack,
+			payload: []byte{0xc1},
+			wantErr: true,
+		},
+		{
+			name:    "invalid cbor",
+			decode:  DecodeCBOR,
+			payload: []byte{0xff},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extractor := WithPayloadDecoder(NewJSONObjectExtractor(NewParser(metricConfigs, ".", ""), nil), tt.decode)
+			mc, err := extractor("tele/sensor", tt.payload, "sensor", MessageProperties{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			sort.Slice(mc, func(i, j int) bool { return mc[i].Description.String() < mc[j].Description.String() })
+			if !equalMetrics(mc, tt.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", mc, tt.want)
+			}
+		})
+	}
+}
+
+// equalMetrics compares the metrics like reflect.DeepEqual, but treats NaN values as equal.
+func equalMetrics(got, want MetricCollection) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		g, w := got[i], want[i]
+		if math.IsNaN(g.Value) && math.IsNaN(w.Value) {
+			g.Value, w.Value = 0, 0
+		}
+		if !reflect.DeepEqual(g, w) {
+			return false
+		}
+	}
+	return true
+}
@@ -2,6 +2,10 @@ package metrics
 
 import (
 	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
@@ -13,14 +17,32 @@ import (
 type Collector interface {
 	prometheus.Collector
 	Observe(deviceID string, collection MetricCollection)
+	Update(possibleMetrics []config.MetricConfig)
+	WriteSnapshot(file string) error
+	RestoreSnapshot(file string) (int, error)
+	ExpireDevice(deviceID string)
+	DeleteMetric(deviceID string, description *prometheus.Desc)
 }
 
 type MemoryCachedCollector struct {
 	cache        *gocache.Cache
+	timeout      time.Duration
+	lock         sync.RWMutex
 	descriptions []*prometheus.Desc
-	logger       *zap.Logger
+	// accumulating are the histogram and summary configs by description
+	accumulating    map[string]config.MetricConfig
+	accumulatorLock sync.Mutex
+	// relabeled are the configs of metrics with relabel configs by description
+	relabeled map[string]config.MetricConfig
+	// expiring are the configs of metrics with their own cache timeout, expiry behaviour or age series by description
+	expiring map[string]config.MetricConfig
+	limiter  *seriesLimiter
+	logger   *zap.Logger
 }
 
+// staleNaN is the prometheus staleness marker
+var staleNaN = math.Float64frombits(0x7ff0000000000002)
+
 type Metric struct {
 	Description *prometheus.Desc
 	Value       float64
@@ -29,49 +51,376 @@ type Metric struct {
 	Topic       string
 	Labels      map[string]string
 	LabelsKeys  []string
+	// Expiry overrides the cache timeout if it is shorter. Zero uses the cache timeout.
+	Expiry time.Duration
+	// Path is the matched JSON path of metrics with wildcards in their mqtt_name or the series key of a line protocol
+	// line. Each path is a separate series.
+	Path string
+	// States are all possible states of a stateset metric. The current state is the value of the last label.
+	States []string
+	// Discovered is the config of metrics which are not part of the config file, like automatically discovered fields,
+	// Home Assistant entities and Homie properties. It is nil for configured metrics.
+	Discovered *config.MetricConfig
 }
 
 type CacheItem struct {
 	DeviceID string
 	Metric   Metric
+	// Accumulator holds the observations of histograms and summaries
+	Accumulator Accumulator
+	// Updated is the time the item was cached
+	Updated time.Time
+	// Expires is set for metrics which are exposed once more as stale when they expire. The cache does not expire them.
+	Expires time.Time
+}
+
+// age returns the age of the cached value. Metrics without a timestamp are as old as the cache item.
+func (item CacheItem) age(t time.Time) float64 {
+	ingestTime := item.Metric.IngestTime
+	if ingestTime.IsZero() {
+		ingestTime = item.Updated
+	}
+	return t.Sub(ingestTime).Seconds()
+}
+
+// Accumulator is a histogram or summary
+type Accumulator interface {
+	prometheus.Metric
+	prometheus.Observer
 }
 
 type MetricCollection []Metric
 
 func NewCollector(defaultTimeout time.Duration, possibleMetrics []config.MetricConfig, logger *zap.Logger) Collector {
+	return NewLimitedCollector(defaultTimeout, nil, possibleMetrics, logger)
+}
+
+// NewLimitedCollector creates a collector which enforces the given series limits. The max_series of the possible
+// metrics are enforced even without limits.
+func NewLimitedCollector(defaultTimeout time.Duration, limits *config.SeriesLimitConfig, possibleMetrics []config.MetricConfig, logger *zap.Logger) Collector {
+	limiter := newSeriesLimiter(limits, possibleMetrics, logger)
+	cache := gocache.New(defaultTimeout, defaultTimeout*10)
+	cache.OnEvicted(func(key string, _ interface{}) {
+		limiter.remove(key)
+	})
+	return &MemoryCachedCollector{
+		cache:        cache,
+		timeout:      defaultTimeout,
+		descriptions: descriptions(possibleMetrics),
+		accumulating: accumulating(possibleMetrics),
+		relabeled:    relabeled(possibleMetrics),
+		expiring:     expiring(possibleMetrics),
+		limiter:      limiter,
+		logger:       logger,
+	}
+}
+
+func accumulating(possibleMetrics []config.MetricConfig) map[string]config.MetricConfig {
+	configs := make(map[string]config.MetricConfig)
+	for _, m := range possibleMetrics {
+		if m.Accumulating() {
+			configs[m.PrometheusDescription().String()] = m
+		}
+	}
+	return configs
+}
+
+func relabeled(possibleMetrics []config.MetricConfig) map[string]config.MetricConfig {
+	configs := make(map[string]config.MetricConfig)
+	for _, m := range possibleMetrics {
+		if len(m.RelabelConfigs) > 0 && !m.Accumulating() {
+			configs[m.PrometheusDescription().String()] = m
+		}
+	}
+	return configs
+}
+
+func expiring(possibleMetrics []config.MetricConfig) map[string]config.MetricConfig {
+	configs := make(map[string]config.MetricConfig)
+	for _, m := range possibleMetrics {
+		if m.CacheTimeout != 0 || (m.OnExpiry != "" && m.OnExpiry != config.OnExpiryDrop) || m.ExportAge {
+			configs[m.PrometheusDescription().String()] = m
+		}
+	}
+	return configs
+}
+
+// descriptions returns the descriptions of the metrics and of their age series.
+func descriptions(possibleMetrics []config.MetricConfig) []*prometheus.Desc {
 	var descs []*prometheus.Desc
 	for _, m := range possibleMetrics {
 		descs = append(descs, m.PrometheusDescription())
+		if m.ExportAge {
+			descs = append(descs, configuredAgeDescription(m))
+		}
 	}
-	return &MemoryCachedCollector{
-		cache:        gocache.New(defaultTimeout, defaultTimeout*10),
-		descriptions: descs,
-		logger:       logger,
+	return descs
+}
+
+// Update replaces the possible metrics. Cached metrics which were configured before but are not part of the given
+// metrics anymore are dropped. Discovered metrics are kept. Accumulated observations are dropped as well if the
+// histogram or summary config changed.
+func (c *MemoryCachedCollector) Update(possibleMetrics []config.MetricConfig) {
+	descs := descriptions(possibleMetrics)
+	known := make(map[string]bool, len(descs))
+	for _, d := range descs {
+		known[d.String()] = true
+	}
+	acc := accumulating(possibleMetrics)
+
+	c.limiter.update(possibleMetrics)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	removed := make(map[string]bool, len(c.descriptions))
+	for _, d := range c.descriptions {
+		if !known[d.String()] {
+			removed[d.String()] = true
+		}
+	}
+	previous := c.accumulating
+	c.descriptions = descs
+	c.accumulating = acc
+	c.relabeled = relabeled(possibleMetrics)
+	c.expiring = expiring(possibleMetrics)
+	for key, metricsRaw := range c.cache.Items() {
+		item := metricsRaw.Object.(CacheItem)
+		if item.Metric.Description == nil || removed[item.Metric.Description.String()] {
+			c.cache.Delete(key)
+			continue
+		}
+		desc := item.Metric.Description.String()
+		_, isAccumulating := acc[desc]
+		if isAccumulating != (item.Accumulator != nil) || !reflect.DeepEqual(previous[desc], acc[desc]) {
+			c.cache.Delete(key)
+		}
 	}
 }
 
 func (c *MemoryCachedCollector) Observe(deviceID string, collection MetricCollection) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	for _, m := range collection {
+		if cfg, ok := c.accumulating[m.Description.String()]; ok {
+			c.accumulate(deviceID, cfg, m)
+			continue
+		}
+		if cfg, ok := c.relabeled[m.Description.String()]; ok {
+			// dropped metrics are not cached at all, the labels are relabeled when collected
+			if _, keep := relabel(metricLabels(cfg, deviceID, m), cfg.RelabelConfigs); !keep {
+				continue
+			}
+		}
 		item := CacheItem{
 			DeviceID: deviceID,
 			Metric:   m,
+			Updated:  now(),
+		}
+		key := fmt.Sprintf("%s-%s", deviceID, m.Description.String())
+		if m.Path != "" {
+			key = fmt.Sprintf("%s-%s", key, m.Path)
+		}
+		if cached, ok := c.cache.Get(key); ok && cached.(CacheItem).Metric.IngestTime.After(m.IngestTime) {
+			// messages with a payload timestamp may arrive out of order
+			continue
+		}
+		if !c.admit(key, deviceID, m) {
+			continue
+		}
+		expiration := c.expiration(m)
+		if expiration > 0 && c.expiring[m.Description.String()].OnExpiry == config.OnExpiryStale {
+			// the item is removed after the staleness marker was collected
+			item.Expires = now().Add(expiration)
+			expiration = gocache.NoExpiration
+		}
+		c.cache.Set(key, item, expiration)
+	}
+}
+
+// admit reports whether the series may be cached and deletes the series evicted in favor of it.
+func (c *MemoryCachedCollector) admit(key, deviceID string, m Metric) bool {
+	var expires time.Time
+	if expiration := c.expiration(m); expiration > 0 {
+		expires = now().Add(expiration)
+	}
+	evicted, ok := c.limiter.admit(key, deviceID, m.Description.String(), expires)
+	for _, k := range evicted {
+		c.cache.Delete(k)
+	}
+	return ok
+}
+
+// accumulate adds the metric value as observation to the histogram or summary of the device and label set.
+func (c *MemoryCachedCollector) accumulate(deviceID string, cfg config.MetricConfig, m Metric) {
+	labels, keep := relabel(metricLabels(cfg, deviceID, m), cfg.RelabelConfigs)
+	if !keep {
+		return
+	}
+	var values []string
+	for _, k := range sortedKeys(labels) {
+		values = append(values, k, labels[k])
+	}
+	key := fmt.Sprintf("%s-%s-%s", deviceID, m.Description.String(), strings.Join(values, "\xff"))
+
+	c.accumulatorLock.Lock()
+	defer c.accumulatorLock.Unlock()
+	if !c.admit(key, deviceID, m) {
+		return
+	}
+	var item CacheItem
+	if cached, ok := c.cache.Get(key); ok {
+		item = cached.(CacheItem)
+	} else {
+		item = CacheItem{
+			DeviceID:    deviceID,
+			Accumulator: newAccumulator(cfg, prometheus.Labels(labels)),
+		}
+	}
+	item.Metric = m
+	item.Updated = now()
+	item.Accumulator.Observe(m.Value)
+	c.cache.Set(key, item, c.expiration(m))
+}
+
+func newAccumulator(cfg config.MetricConfig, labels prometheus.Labels) Accumulator {
+	if cfg.ValueType == config.SummaryValueType {
+		return prometheus.NewSummary(prometheus.SummaryOpts{
+			Name:        cfg.PrometheusName,
+			Help:        cfg.Help,
+			ConstLabels: labels,
+			Objectives:  cfg.Objectives,
+			MaxAge:      cfg.MaxAge,
+		})
+	}
+	opts := prometheus.HistogramOpts{
+		Name:        cfg.PrometheusName,
+		Help:        cfg.Help,
+		ConstLabels: labels,
+		Buckets:     cfg.Buckets,
+	}
+	if cfg.NativeHistogram != nil {
+		opts.NativeHistogramBucketFactor = cfg.NativeHistogram.BucketFactor
+		opts.NativeHistogramMaxBucketNumber = cfg.NativeHistogram.MaxBucketNumber
+		opts.NativeHistogramMinResetDuration = cfg.NativeHistogram.MinResetDuration
+	}
+	return prometheus.NewHistogram(opts)
+}
+
+// expiration returns the cache expiration of the given metric. The cache timeout of the metric config overrides the
+// default timeout, a shorter message expiry overrides both. Metrics which are kept on expiry never expire.
+func (c *MemoryCachedCollector) expiration(m Metric) time.Duration {
+	timeout := c.timeout
+	if cfg, ok := c.expiring[m.Description.String()]; ok {
+		if cfg.OnExpiry == config.OnExpiryKeep {
+			return gocache.NoExpiration
+		}
+		if cfg.CacheTimeout != 0 {
+			timeout = cfg.CacheTimeout
+		}
+	}
+	if m.Expiry > 0 && (timeout <= 0 || m.Expiry < timeout) {
+		return m.Expiry
+	}
+	if timeout <= 0 {
+		return gocache.NoExpiration
+	}
+	return timeout
+}
+
+// expire removes the expired item from the cache. It returns false if the item was removed or updated in the meantime.
+func (c *MemoryCachedCollector) expire(key string, item CacheItem) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	cached, ok := c.cache.Get(key)
+	if !ok || !cached.(CacheItem).Expires.Equal(item.Expires) {
+		return false
+	}
+	c.cache.Delete(key)
+	return true
+}
+
+// ExpireDevice expires all cached metrics of the device as if their cache timeout elapsed. Metrics which are kept on
+// expiry are not changed.
+func (c *MemoryCachedCollector) ExpireDevice(deviceID string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	expiredAt := now()
+	for key, raw := range c.cache.Items() {
+		item := raw.Object.(CacheItem)
+		if item.DeviceID != deviceID || item.Metric.Description == nil {
+			continue
+		}
+		switch c.expiring[item.Metric.Description.String()].OnExpiry {
+		case config.OnExpiryKeep:
+		case config.OnExpiryStale:
+			if item.Expires.IsZero() || item.Expires.After(expiredAt) {
+				item.Expires = expiredAt
+				c.cache.Set(key, item, gocache.NoExpiration)
+			}
+		default:
+			c.cache.Delete(key)
+		}
+	}
+}
+
+// DeleteMetric deletes all cached series of the device with the description.
+func (c *MemoryCachedCollector) DeleteMetric(deviceID string, description *prometheus.Desc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for key, raw := range c.cache.Items() {
+		item := raw.Object.(CacheItem)
+		if item.DeviceID == deviceID && item.Metric.Description != nil && item.Metric.Description.String() == description.String() {
+			c.cache.Delete(key)
 		}
-		c.cache.Set(fmt.Sprintf("%s-%s", deviceID, m.Description.String()), item, gocache.DefaultExpiration)
 	}
 }
 
 func (c *MemoryCachedCollector) Describe(ch chan<- *prometheus.Desc) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
 	for i := range c.descriptions {
 		ch <- c.descriptions[i]
 	}
+	c.limiter.droppedMetric.Describe(ch)
 }
 
 func (c *MemoryCachedCollector) Collect(mc chan<- prometheus.Metric) {
-	for _, metricsRaw := range c.cache.Items() {
+	c.limiter.droppedMetric.Collect(mc)
+	c.lock.RLock()
+	accumulatingConfigs, relabeledConfigs, expiringConfigs := c.accumulating, c.relabeled, c.expiring
+	c.lock.RUnlock()
+
+	collectedAt := now()
+	// relabeled series of different devices may collide, only the most recent one is collected
+	relabeledSeries := make(map[string]series)
+	for key, metricsRaw := range c.cache.Items() {
 		item := metricsRaw.Object.(CacheItem)
+		if item.Accumulator != nil {
+			mc <- item.Accumulator
+			if cfg, ok := accumulatingConfigs[item.Metric.Description.String()]; ok && cfg.ExportAge {
+				collectAccumulatorAge(mc, cfg, item, collectedAt)
+			}
+			continue
+		}
 		device, metric := item.DeviceID, item.Metric
+		// expired items are exposed once more with the staleness marker instead of their value
+		stale := !item.Expires.IsZero() && !collectedAt.Before(item.Expires)
+		if stale {
+			if !c.expire(key, item) {
+				continue
+			}
+			metric.Value = staleNaN
+			metric.IngestTime = time.Time{}
+		}
 		if metric.Description == nil {
 			c.logger.Warn("empty description", zap.String("topic", metric.Topic), zap.Float64("value", metric.Value))
+		} else if cfg, ok := relabeledConfigs[metric.Description.String()]; ok {
+			if s, keep := relabelSeries(cfg, device, metric); keep {
+				if previous, found := relabeledSeries[s.id]; !found || previous.metric.IngestTime.Before(metric.IngestTime) {
+					s.stale, s.age = stale, item.age(collectedAt)
+					relabeledSeries[s.id] = s
+				}
+			}
+			continue
 		}
 
 		// set dynamic labels with the right order starting with "sensor" and "topic"
@@ -79,19 +428,145 @@ func (c *MemoryCachedCollector) Collect(mc chan<- prometheus.Metric) {
 		for _, k := range metric.LabelsKeys {
 			labels = append(labels, metric.Labels[k])
 		}
+		collect(mc, metric.Description, metric, labels)
+		if cfg, ok := expiringConfigs[metric.Description.String()]; ok && cfg.ExportAge && !stale {
+			if len(metric.States) > 0 {
+				labels = labels[:len(labels)-1]
+			}
+			mc <- prometheus.MustNewConstMetric(configuredAgeDescription(cfg), prometheus.GaugeValue, item.age(collectedAt), labels...)
+		}
+	}
+	for _, s := range relabeledSeries {
+		collect(mc, s.desc, s.metric, s.labels)
+		if s.ageDesc != nil && !s.stale {
+			labels := s.labels
+			if len(s.metric.States) > 0 {
+				labels = labels[:len(labels)-1]
+			}
+			mc <- prometheus.MustNewConstMetric(s.ageDesc, prometheus.GaugeValue, s.age, labels...)
+		}
+	}
+}
+
+// collectAccumulatorAge sends the age of the last observation of a histogram or summary.
+func collectAccumulatorAge(mc chan<- prometheus.Metric, cfg config.MetricConfig, item CacheItem, collectedAt time.Time) {
+	labels, keep := relabel(metricLabels(cfg, item.DeviceID, item.Metric), cfg.RelabelConfigs)
+	if !keep {
+		return
+	}
+	mc <- prometheus.MustNewConstMetric(ageDescription(cfg, nil, labels), prometheus.GaugeValue, item.age(collectedAt))
+}
+
+// ageDescription returns the description of the <prom_name>_age_seconds series of the metric.
+func ageDescription(cfg config.MetricConfig, variableLabels []string, constLabels prometheus.Labels) *prometheus.Desc {
+	return prometheus.NewDesc(cfg.PrometheusName+"_age_seconds", fmt.Sprintf("Age of the cached value of %s", cfg.PrometheusName), variableLabels, constLabels)
+}
+
+// configuredAgeDescription returns the age description with the labels of the metric config, without the state label.
+func configuredAgeDescription(cfg config.MetricConfig) *prometheus.Desc {
+	labels := append([]string{"sensor", "topic"}, cfg.LabelsKeys()...)
+	if cfg.StateLabel() != "" {
+		labels = labels[:len(labels)-1]
+	}
+	return ageDescription(cfg, labels, cfg.ConstantLabels)
+}
+
+// series is a metric with its relabeled description and label values
+type series struct {
+	id     string
+	desc   *prometheus.Desc
+	metric Metric
+	labels []string
+	// ageDesc is only set if the age of the metric is exported
+	ageDesc *prometheus.Desc
+	age     float64
+	stale   bool
+}
+
+// metricLabels returns all labels of the metric, including the constant labels and the metric name as __name__.
+func metricLabels(cfg config.MetricConfig, deviceID string, m Metric) map[string]string {
+	labels := map[string]string{"__name__": cfg.PrometheusName, "sensor": deviceID, "topic": m.Topic}
+	for k, v := range cfg.ConstantLabels {
+		labels[k] = v
+	}
+	for _, k := range m.LabelsKeys {
+		labels[k] = m.Labels[k]
+	}
+	return labels
+}
 
-		m := prometheus.MustNewConstMetric(
-			metric.Description,
-			metric.ValueType,
-			metric.Value,
-			labels...,
-		)
+// relabelSeries applies the relabel configs to the labels of the metric. The state label of statesets is not relabeled.
+func relabelSeries(cfg config.MetricConfig, deviceID string, m Metric) (series, bool) {
+	labels := metricLabels(cfg, deviceID, m)
+	var state string
+	if len(m.States) > 0 {
+		state = m.LabelsKeys[len(m.LabelsKeys)-1]
+		delete(labels, state)
+	}
+	labels, keep := relabel(labels, cfg.RelabelConfigs)
+	if !keep {
+		return series{}, false
+	}
+	delete(labels, state)
+	names := sortedKeys(labels)
+	values := make([]string, 0, len(names)+1)
+	for _, name := range names {
+		values = append(values, labels[name])
+	}
+	if state != "" {
+		names = append(names, state)
+		values = append(values, m.Labels[state])
+	}
+	s := series{
+		id:     strings.Join(names, "\xff") + "\xfe" + strings.Join(values, "\xff"),
+		desc:   prometheus.NewDesc(cfg.PrometheusName, cfg.Help, names, nil),
+		metric: m,
+		labels: values,
+	}
+	if cfg.ExportAge {
+		if state != "" {
+			names = names[:len(names)-1]
+		}
+		s.ageDesc = ageDescription(cfg, names, nil)
+	}
+	return s, true
+}
 
-		if metric.IngestTime.IsZero() {
-			mc <- m
-		} else {
-			mc <- prometheus.NewMetricWithTimestamp(metric.IngestTime, m)
+// collect sends the metric with the given label values. A stateset has one series per state, the current state is
+// set to 1.
+func collect(mc chan<- prometheus.Metric, desc *prometheus.Desc, metric Metric, labels []string) {
+	if len(metric.States) > 0 {
+		current := labels[len(labels)-1]
+		for _, state := range metric.States {
+			var value float64
+			if math.IsNaN(metric.Value) {
+				value = metric.Value
+			} else if state == current {
+				value = 1
+			}
+			labels[len(labels)-1] = state
+			mc <- withTimestamp(metric.IngestTime, prometheus.MustNewConstMetric(
+				desc,
+				metric.ValueType,
+				value,
+				labels...,
+			))
 		}
+		return
+	}
+
+	m := prometheus.MustNewConstMetric(
+		desc,
+		metric.ValueType,
+		metric.Value,
+		labels...,
+	)
+	mc <- withTimestamp(metric.IngestTime, m)
+}
 
+func withTimestamp(t time.Time, m prometheus.Metric) prometheus.Metric {
+	if t.IsZero() {
+		return m
 	}
+	return prometheus.NewMetricWithTimestamp(t, m)
 }
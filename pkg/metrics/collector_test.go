@@ -0,0 +1,433 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"go.uber.org/zap"
+)
+
+func TestMemoryCachedCollector_Update(t *testing.T) {
+	temperature := config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge"}
+	humidity := config.MetricConfig{PrometheusName: "humidity", ValueType: "gauge"}
+	discovered := config.MetricConfig{PrometheusName: "power", ValueType: "gauge"}
+	c := NewCollector(time.Minute, []config.MetricConfig{temperature, humidity}, zap.NewNop())
+	c.Observe("dht22", MetricCollection{
+		{Description: temperature.PrometheusDescription(), Value: 12.6, ValueType: temperature.PrometheusValueType()},
+		{Description: humidity.PrometheusDescription(), Value: 51.6, ValueType: humidity.PrometheusValueType()},
+		{Description: discovered.PrometheusDescription(), Value: 3.2, ValueType: discovered.PrometheusValueType(), Discovered: &discovered},
+	})
+
+	c.Update([]config.MetricConfig{temperature})
+
+	var got []float64
+	for _, raw := range c.(*MemoryCachedCollector).cache.Items() {
+		got = append(got, raw.Object.(CacheItem).Metric.Value)
+	}
+	sort.Float64s(got)
+	if want := []float64{3.2, 12.6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected temperature and the discovered metric to be kept, got values %v, want %v", got, want)
+	}
+	if got := len(c.(*MemoryCachedCollector).descriptions); got != 1 {
+		t.Errorf("expected one description after update, got %d", got)
+	}
+}
+
+func TestMemoryCachedCollector_ObserveExpiry(t *testing.T) {
+	temperature := config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge"}
+	c := NewCollector(time.Hour, []config.MetricConfig{temperature}, zap.NewNop())
+	c.Observe("dht22", MetricCollection{
+		{Description: temperature.PrometheusDescription(), Value: 12.6, ValueType: temperature.PrometheusValueType(), Expiry: time.Minute},
+	})
+	for _, raw := range c.(*MemoryCachedCollector).cache.Items() {
+		if remaining := time.Until(time.Unix(0, raw.Expiration)); remaining > time.Minute {
+			t.Errorf("expected the message expiry to limit the cache timeout, got %v", remaining)
+		}
+	}
+}
+
+func TestMemoryCachedCollector_ObserveOutOfOrder(t *testing.T) {
+	temperature := config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge"}
+	c := NewCollector(time.Hour, []config.MetricConfig{temperature}, zap.NewNop())
+	for i, ingestTime := range []time.Time{testNow(), testNow().Add(-time.Minute), testNow().Add(time.Second)} {
+		c.Observe("dht22", MetricCollection{
+			{Description: temperature.PrometheusDescription(), Value: float64(i), ValueType: temperature.PrometheusValueType(), IngestTime: ingestTime},
+		})
+	}
+	for _, raw := range c.(*MemoryCachedCollector).cache.Items() {
+		if got := raw.Object.(CacheItem).Metric.Value; got != 2 {
+			t.Errorf("expected the older message to be ignored, got value %v", got)
+		}
+	}
+}
+
+func TestMemoryCachedCollector_ObserveAccumulating(t *testing.T) {
+	latency := config.MetricConfig{PrometheusName: "latency", ValueType: config.HistogramValueType, Buckets: []float64{1, 10}}
+	power := config.MetricConfig{PrometheusName: "power", ValueType: config.SummaryValueType}
+	c := NewCollector(time.Minute, []config.MetricConfig{latency, power}, zap.NewNop())
+	for _, v := range []float64{0.5, 5, 50} {
+		c.Observe("dht22", MetricCollection{
+			{Description: latency.PrometheusDescription(), Value: v, Topic: "a"},
+			{Description: power.PrometheusDescription(), Value: v, Topic: "a"},
+		})
+	}
+	c.Observe("dht22", MetricCollection{{Description: latency.PrometheusDescription(), Value: 2, Topic: "b"}})
+
+	type series struct {
+		count   uint64
+		sum     float64
+		buckets []uint64
+	}
+	got := map[string]series{}
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	for m := range ch {
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		var topic string
+		for _, l := range out.GetLabel() {
+			if l.GetName() == "topic" {
+				topic = l.GetValue()
+			}
+		}
+		if h := out.GetHistogram(); h != nil {
+			s := series{count: h.GetSampleCount(), sum: h.GetSampleSum()}
+			for _, b := range h.GetBucket() {
+				s.buckets = append(s.buckets, b.GetCumulativeCount())
+			}
+			got["latency/"+topic] = s
+		}
+		if s := out.GetSummary(); s != nil {
+			got["power/"+topic] = series{count: s.GetSampleCount(), sum: s.GetSampleSum()}
+		}
+	}
+	want := map[string]series{
+		"latency/a": {count: 3, sum: 55.5, buckets: []uint64{1, 2}},
+		"latency/b": {count: 1, sum: 2, buckets: []uint64{0, 1}},
+		"power/a":   {count: 3, sum: 55.5},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %+v, want %+v", got, want)
+	}
+
+	latency.Buckets = []float64{1, 10, 100}
+	c.Update([]config.MetricConfig{latency, power})
+	if items := c.(*MemoryCachedCollector).cache.Items(); len(items) != 1 {
+		t.Errorf("expected only the unchanged summary to be kept after update, got %d items", len(items))
+	}
+}
+
+func TestMemoryCachedCollector_CollectStateSet(t *testing.T) {
+	power := config.MetricConfig{PrometheusName: "power", ValueType: config.StateSetValueType, States: []string{"on", "off", "standby"}}
+	c := NewCollector(time.Minute, []config.MetricConfig{power}, zap.NewNop())
+	c.Observe("plug", MetricCollection{{
+		Description: power.PrometheusDescription(),
+		Value:       1,
+		ValueType:   power.PrometheusValueType(),
+		Topic:       "plug/power",
+		Labels:      map[string]string{"power": "off"},
+		LabelsKeys:  power.LabelsKeys(),
+		States:      power.States,
+	}})
+
+	got := map[string]float64{}
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	for m := range ch {
+		var out dto.Metric
+		if err := m.Write(&out); err != nil {
+			t.Fatal(err)
+		}
+		for _, l := range out.GetLabel() {
+			if l.GetName() == "power" {
+				got[l.GetValue()] = out.GetGauge().GetValue()
+			}
+		}
+	}
+	want := map[string]float64{"on": 0, "off": 1, "standby": 0}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Collect() = %v, want %v", got, want)
+	}
+}
+
+func TestMemoryCachedCollector_ObserveSeriesLimits(t *testing.T) {
+	temperature := config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge"}
+	humidity := config.MetricConfig{PrometheusName: "humidity", ValueType: "gauge", MaxSeries: 1}
+	type observation struct {
+		device string
+		metric config.MetricConfig
+	}
+	observations := []observation{
+		{"a", temperature},
+		{"a", humidity},
+		{"b", temperature},
+		{"b", humidity},
+		{"c", temperature},
+		// updates of existing series never exceed a limit
+		{"a", temperature},
+	}
+	tests := []struct {
+		name        string
+		limits      *config.SeriesLimitConfig
+		want        []string
+		wantDropped map[string]float64
+	}{
+		{
+			name:        "per metric limit without global limits",
+			want:        []string{"a-humidity", "a-temperature", "b-temperature", "c-temperature"},
+			wantDropped: map[string]float64{metricLimit: 1},
+		},
+		{
+			name:        "drop new series",
+			limits:      &config.SeriesLimitConfig{MaxSeries: 3, Policy: config.DropNewSeriesPolicy},
+			want:        []string{"a-humidity", "a-temperature", "b-temperature"},
+			wantDropped: map[string]float64{globalLimit: 2},
+		},
+		{
+			name:        "evict oldest series",
+			limits:      &config.SeriesLimitConfig{MaxSeries: 3, Policy: config.EvictOldestSeriesPolicy},
+			want:        []string{"a-temperature", "b-humidity", "c-temperature"},
+			wantDropped: map[string]float64{globalLimit: 2, metricLimit: 1},
+		},
+		{
+			name:        "per device limit",
+			limits:      &config.SeriesLimitConfig{MaxSeriesPerDevice: 1, Policy: config.DropNewSeriesPolicy},
+			want:        []string{"a-temperature", "b-temperature", "c-temperature"},
+			wantDropped: map[string]float64{deviceLimit: 2},
+		},
+		{
+			name:        "per metric limit overrides the default",
+			limits:      &config.SeriesLimitConfig{MaxSeriesPerMetric: 2, Policy: config.EvictOldestSeriesPolicy},
+			want:        []string{"a-temperature", "b-humidity", "c-temperature"},
+			wantDropped: map[string]float64{metricLimit: 3},
+		},
+	}
+	defer func(previous func() time.Time) { now = previous }(now)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			now = func() time.Time {
+				clock = clock.Add(time.Second)
+				return clock
+			}
+			c := NewLimitedCollector(time.Hour, tt.limits, []config.MetricConfig{temperature, humidity}, zap.NewNop()).(*MemoryCachedCollector)
+			for _, o := range observations {
+				c.Observe(o.device, MetricCollection{{Description: o.metric.PrometheusDescription(), ValueType: prometheus.GaugeValue}})
+			}
+
+			var got []string
+			for _, raw := range c.cache.Items() {
+				item := raw.Object.(CacheItem)
+				name := temperature.PrometheusName
+				if item.Metric.Description.String() == humidity.PrometheusDescription().String() {
+					name = humidity.PrometheusName
+				}
+				got = append(got, item.DeviceID+"-"+name)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("cached series = %v, want %v", got, tt.want)
+			}
+			dropped := make(map[string]float64)
+			for _, limit := range []string{globalLimit, metricLimit, deviceLimit} {
+				if v := testutil.ToFloat64(c.limiter.droppedMetric.WithLabelValues(limit)); v > 0 {
+					dropped[limit] = v
+				}
+			}
+			if !reflect.DeepEqual(dropped, tt.wantDropped) {
+				t.Errorf("dropped series = %v, want %v", dropped, tt.wantDropped)
+			}
+			if len(c.limiter.series) != len(got) {
+				t.Errorf("expected the limiter to track %d series, got %d", len(got), len(c.limiter.series))
+			}
+		})
+	}
+}
+
+func TestMemoryCachedCollector_CollectRelabeled(t *testing.T) {
+	temperature := config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		ConstantLabels: map[string]string{"sensor_type": "dht22"},
+		RelabelConfigs: []config.RelabelConfig{
+			relabelConfig(config.RelabelDrop, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"sensor"}
+				rc.Regex = "test"
+			}),
+			relabelConfig(config.RelabelReplace, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"sensor"}
+				rc.Regex = "(old-)?(.*)"
+				rc.TargetLabel = "sensor"
+				rc.Replacement = "$2"
+			}),
+			relabelConfig(config.RelabelLabelDrop, func(rc *config.RelabelConfig) {
+				rc.Regex = "topic"
+			}),
+			relabelConfig(config.RelabelReplace, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"__name__"}
+				rc.Regex = "([a-z]+)ure"
+				rc.TargetLabel = "kind"
+				rc.Replacement = "$1"
+			}),
+		},
+	}
+	c := NewCollector(time.Minute, []config.MetricConfig{temperature}, zap.NewNop())
+	observe := func(device string, value float64, ingestTime time.Time) {
+		c.Observe(device, MetricCollection{{Description: temperature.PrometheusDescription(), Value: value, ValueType: prometheus.GaugeValue, IngestTime: ingestTime, Topic: device}})
+	}
+	observe("test", 1, testNow())
+	// both devices are relabeled to the same series, the most recent one wins
+	observe("kitchen", 2, testNow())
+	observe("old-kitchen", 3, testNow().Add(-time.Minute))
+
+	if got := len(c.(*MemoryCachedCollector).cache.Items()); got != 2 {
+		t.Errorf("expected the dropped device not to be cached, got %d cached metrics", got)
+	}
+	ch := make(chan prometheus.Metric, 10)
+	c.Collect(ch)
+	close(ch)
+	var got []map[string]string
+	for m := range ch {
+		var metric dto.Metric
+		if err := m.Write(&metric); err != nil {
+			t.Fatal(err)
+		}
+		labels := map[string]string{"value": fmt.Sprint(metric.GetGauge().GetValue())}
+		for _, l := range metric.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		got = append(got, labels)
+	}
+	want := []map[string]string{{"kind": "temperat", "sensor": "kitchen", "sensor_type": "dht22", "value": "2"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("collected %v, want %v", got, want)
+	}
+}
+
+func TestMemoryCachedCollector_ObserveCacheTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		metric  config.MetricConfig
+		expiry  time.Duration
+		wantTTL time.Duration
+	}{
+		{
+			name:    "cache timeout",
+			metric:  config.MetricConfig{PrometheusName: "battery", ValueType: "gauge"},
+			wantTTL: time.Hour,
+		},
+		{
+			name:    "metric timeout",
+			metric:  config.MetricConfig{PrometheusName: "battery", ValueType: "gauge", CacheTimeout: 6 * time.Hour},
+			wantTTL: 6 * time.Hour,
+		},
+		{
+			name:    "message expiry is shorter",
+			metric:  config.MetricConfig{PrometheusName: "battery", ValueType: "gauge", CacheTimeout: 6 * time.Hour},
+			expiry:  time.Minute,
+			wantTTL: time.Minute,
+		},
+		{
+			name:   "metric never expires",
+			metric: config.MetricConfig{PrometheusName: "battery", ValueType: "gauge", CacheTimeout: -1},
+		},
+		{
+			name:   "keep",
+			metric: config.MetricConfig{PrometheusName: "battery", ValueType: "gauge", OnExpiry: config.OnExpiryKeep},
+			expiry: time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewCollector(time.Hour, []config.MetricConfig{tt.metric}, zap.NewNop())
+			c.Observe("sensor", MetricCollection{
+				{Description: tt.metric.PrometheusDescription(), Value: 80, ValueType: tt.metric.PrometheusValueType(), Expiry: tt.expiry},
+			})
+			for _, raw := range c.(*MemoryCachedCollector).cache.Items() {
+				var ttl time.Duration
+				if raw.Expiration > 0 {
+					ttl = time.Until(time.Unix(0, raw.Expiration))
+				}
+				if diff := tt.wantTTL - ttl; diff < 0 || diff > time.Second {
+					t.Errorf("ttl = %v, want %v", ttl, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryCachedCollector_CollectStaleAndAge(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = testNow
+	temperature := config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge", CacheTimeout: time.Minute, OnExpiry: config.OnExpiryStale, ExportAge: true}
+	power := config.MetricConfig{PrometheusName: "power", ValueType: "stateset", States: []string{"on", "off"}, OnExpiry: config.OnExpiryStale, ExportAge: true, OmitTimestamp: true}
+	c := NewCollector(time.Hour, []config.MetricConfig{temperature, power}, zap.NewNop())
+	c.Observe("dht22", MetricCollection{
+		{Description: temperature.PrometheusDescription(), Value: 21.5, ValueType: temperature.PrometheusValueType(), IngestTime: testNow().Add(-10 * time.Second)},
+		{Description: power.PrometheusDescription(), Value: 1, ValueType: power.PrometheusValueType(), Labels: map[string]string{"power": "on"}, LabelsKeys: power.LabelsKeys(), States: power.States},
+	})
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	gather := func() []string {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, family := range families {
+			if family.GetName() == "mqtt2prometheus_series_dropped_total" {
+				continue
+			}
+			for _, m := range family.GetMetric() {
+				var labels []string
+				for _, l := range m.GetLabel() {
+					if l.GetName() != "topic" {
+						labels = append(labels, l.GetName()+"="+l.GetValue())
+					}
+				}
+				got = append(got, fmt.Sprintf("%s{%s} %v", family.GetName(), strings.Join(labels, ","), m.GetGauge().GetValue()))
+			}
+		}
+		return got
+	}
+
+	if got, want := gather(), []string{
+		"power{power=off,sensor=dht22} 0",
+		"power{power=on,sensor=dht22} 1",
+		"power_age_seconds{sensor=dht22} 0",
+		"temperature{sensor=dht22} 21.5",
+		"temperature_age_seconds{sensor=dht22} 10",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("before expiry got %v, want %v", got, want)
+	}
+
+	now = func() time.Time { return testNow().Add(90 * time.Second) }
+	if got, want := gather(), []string{
+		"power{power=off,sensor=dht22} 0",
+		"power{power=on,sensor=dht22} 1",
+		"power_age_seconds{sensor=dht22} 90",
+		"temperature{sensor=dht22} NaN",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after expiry got %v, want %v", got, want)
+	}
+	if got, want := gather(), []string{
+		"power{power=off,sensor=dht22} 0",
+		"power{power=on,sensor=dht22} 1",
+		"power_age_seconds{sensor=dht22} 90",
+	}; !reflect.DeepEqual(got, want) {
+		t.Errorf("expected the staleness marker only once, got %v, want %v", got, want)
+	}
+}
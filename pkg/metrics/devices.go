@@ -0,0 +1,125 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DeviceTracker exposes when every device was last seen, how many messages and parse errors it sent and whether it
+// reported to be online. Devices which were not seen within the retention are forgotten.
+type DeviceTracker struct {
+	lock      sync.Mutex
+	retention time.Duration
+	devices   map[string]*deviceStats
+
+	lastSeenDesc    *prometheus.Desc
+	messagesDesc    *prometheus.Desc
+	parseErrorsDesc *prometheus.Desc
+	upDesc          *prometheus.Desc
+}
+
+type deviceStats struct {
+	lastSeen    time.Time
+	messages    float64
+	parseErrors float64
+	// upUpdated is zero if the device never reported its availability
+	upUpdated time.Time
+	up        float64
+}
+
+// updated returns the time of the last message or availability report.
+func (s *deviceStats) updated() time.Time {
+	if s.upUpdated.After(s.lastSeen) {
+		return s.upUpdated
+	}
+	return s.lastSeen
+}
+
+// NewDeviceTracker creates a device tracker. A retention less or equal to zero keeps the devices forever.
+func NewDeviceTracker(retention time.Duration) *DeviceTracker {
+	return &DeviceTracker{
+		retention: retention,
+		devices:   make(map[string]*deviceStats),
+		lastSeenDesc: prometheus.NewDesc(
+			"mqtt2prometheus_device_last_seen_timestamp_seconds",
+			"Unix timestamp of the last message of the device",
+			[]string{"sensor"}, nil,
+		),
+		messagesDesc: prometheus.NewDesc(
+			"mqtt2prometheus_device_messages_total",
+			"Total number of messages received from the device",
+			[]string{"sensor"}, nil,
+		),
+		parseErrorsDesc: prometheus.NewDesc(
+			"mqtt2prometheus_device_parse_errors_total",
+			"Total number of messages of the device which could not be parsed",
+			[]string{"sensor"}, nil,
+		),
+		upDesc: prometheus.NewDesc(
+			"mqtt2prometheus_device_up",
+			"Whether the device reported to be online on its availability topic",
+			[]string{"sensor"}, nil,
+		),
+	}
+}
+
+// Seen records a message of the device.
+func (t *DeviceTracker) Seen(deviceID string, parseError bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	stats := t.device(deviceID)
+	stats.lastSeen = now()
+	stats.messages++
+	if parseError {
+		stats.parseErrors++
+	}
+}
+
+// SetAvailable records the availability reported by the device.
+func (t *DeviceTracker) SetAvailable(deviceID string, available bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	stats := t.device(deviceID)
+	stats.upUpdated = now()
+	stats.up = 0
+	if available {
+		stats.up = 1
+	}
+}
+
+func (t *DeviceTracker) device(deviceID string) *deviceStats {
+	stats, ok := t.devices[deviceID]
+	if !ok {
+		stats = &deviceStats{}
+		t.devices[deviceID] = stats
+	}
+	return stats
+}
+
+func (t *DeviceTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.lastSeenDesc
+	ch <- t.messagesDesc
+	ch <- t.parseErrorsDesc
+	ch <- t.upDesc
+}
+
+func (t *DeviceTracker) Collect(ch chan<- prometheus.Metric) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for deviceID, stats := range t.devices {
+		if t.retention > 0 && now().Sub(stats.updated()) > t.retention {
+			delete(t.devices, deviceID)
+			continue
+		}
+		if stats.messages > 0 {
+			ch <- prometheus.MustNewConstMetric(t.lastSeenDesc, prometheus.GaugeValue, float64(stats.lastSeen.UnixNano())/1e9, deviceID)
+			ch <- prometheus.MustNewConstMetric(t.messagesDesc, prometheus.CounterValue, stats.messages, deviceID)
+			ch <- prometheus.MustNewConstMetric(t.parseErrorsDesc, prometheus.CounterValue, stats.parseErrors, deviceID)
+		}
+		if !stats.upUpdated.IsZero() {
+			ch <- prometheus.MustNewConstMetric(t.upDesc, prometheus.GaugeValue, stats.up, deviceID)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestDeviceTracker(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = testNow
+	tracker := NewDeviceTracker(time.Hour)
+	tracker.Seen("dht22", false)
+	tracker.Seen("dht22", true)
+	now = func() time.Time { return testNow().Add(30 * time.Minute) }
+	tracker.Seen("shelly", false)
+
+	want := `
+# HELP mqtt2prometheus_device_last_seen_timestamp_seconds Unix timestamp of the last message of the device
+# TYPE mqtt2prometheus_device_last_seen_timestamp_seconds gauge
+mqtt2prometheus_device_last_seen_timestamp_seconds{sensor="dht22"} 1.604268521e+09
+mqtt2prometheus_device_last_seen_timestamp_seconds{sensor="shelly"} 1.604270321e+09
+# HELP mqtt2prometheus_device_messages_total Total number of messages received from the device
+# TYPE mqtt2prometheus_device_messages_total counter
+mqtt2prometheus_device_messages_total{sensor="dht22"} 2
+mqtt2prometheus_device_messages_total{sensor="shelly"} 1
+# HELP mqtt2prometheus_device_parse_errors_total Total number of messages of the device which could not be parsed
+# TYPE mqtt2prometheus_device_parse_errors_total counter
+mqtt2prometheus_device_parse_errors_total{sensor="dht22"} 1
+mqtt2prometheus_device_parse_errors_total{sensor="shelly"} 0
+`
+	if err := testutil.CollectAndCompare(tracker, strings.NewReader(want)); err != nil {
+		t.Error(err)
+	}
+
+	// dht22 was not seen within the retention
+	now = func() time.Time { return testNow().Add(61 * time.Minute) }
+	if got := testutil.CollectAndCount(tracker, "mqtt2prometheus_device_messages_total"); got != 1 {
+		t.Errorf("expected only the recently seen device, got %d devices", got)
+	}
+}
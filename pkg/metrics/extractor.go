@@ -1,6 +1,7 @@
 package metrics
 
 import (
+	"encoding/json"
 	"fmt"
 	"regexp"
 
@@ -8,7 +9,13 @@ import (
 	gojsonq "github.com/thedevsaddam/gojsonq/v2"
 )
 
-type Extractor func(topic string, payload []byte, deviceID string) (MetricCollection, error)
+type Extractor func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error)
+
+// MessageProperties are the MQTT 5 properties of a message. They are empty for MQTT 3 messages.
+type MessageProperties struct {
+	ContentType    string
+	UserProperties map[string]string
+}
 
 // metricID returns a deterministic identifier per metic config which is safe to use in a file path.
 func metricID(topic, metric, deviceID, promName string) string {
@@ -20,12 +27,42 @@ func metricID(topic, metric, deviceID, promName string) string {
 	return fmt.Sprintf("%s-%s-%s-%s", deviceID, topic, metric, promName)
 }
 
-func NewJSONObjectExtractor(p Parser) Extractor {
-	return func(topic string, payload []byte, deviceID string) (MetricCollection, error) {
+// NewJSONObjectExtractor extracts the configured metrics from JSON objects. If autoDiscover is set, all other numeric
+// and boolean fields are exported as gauges.
+func NewJSONObjectExtractor(p Parser, autoDiscover *config.AutoDiscoverConfig) Extractor {
+	// discovered fields must not clash with the explicitly configured metrics
+	configuredNames := make(map[string]bool)
+	for _, configs := range p.config() {
+		for _, c := range configs {
+			configuredNames[c.PrometheusName] = true
+		}
+	}
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
 		var mc MetricCollection
 		parsed := gojsonq.New(gojsonq.SetSeparator(p.separator)).FromString(string(payload))
+		// doc is decoded on demand for paths with wildcards and auto discovery
+		var doc interface{}
+		if autoDiscover != nil {
+			if err := json.Unmarshal(payload, &doc); err != nil {
+				return nil, fmt.Errorf("failed to decode payload: %w", err)
+			}
+		}
+
+		for path, configs := range p.config() {
+			if configs[0].WildcardSegments(p.separator) > 0 {
+				if doc == nil {
+					if err := json.Unmarshal(payload, &doc); err != nil {
+						return nil, fmt.Errorf("failed to decode payload: %w", err)
+					}
+				}
+				wildcardMetrics, err := p.expandWildcardPath(doc, topic, path, deviceID, props)
+				if err != nil {
+					return nil, err
+				}
+				mc = append(mc, wildcardMetrics...)
+				continue
+			}
 
-		for path := range p.config() {
 			rawValue := parsed.Find(path)
 			parsed.Reset()
 			if rawValue == nil {
@@ -35,7 +72,7 @@ func NewJSONObjectExtractor(p Parser) Extractor {
 			// Find all valid metric configs
 			for _, config := range p.findMetricConfigs(path, deviceID) {
 				id := metricID(topic, path, deviceID, config.PrometheusName)
-				m, err := p.parseMetric(config, id, rawValue)
+				m, err := p.parseMetric(config, id, rawValue, props)
 				if err != nil {
 					return nil, fmt.Errorf("failed to parse valid value from '%v' for metric %q: %w", rawValue, config.PrometheusName, err)
 				}
@@ -43,12 +80,81 @@ func NewJSONObjectExtractor(p Parser) Extractor {
 				mc = append(mc, m)
 			}
 		}
+
+		if autoDiscover != nil {
+			discovered, err := p.discover(doc, mc, topic, deviceID, autoDiscover, configuredNames, props)
+			if err != nil {
+				return nil, err
+			}
+			mc = append(mc, discovered...)
+		}
 		return mc, nil
 	}
 }
 
+// discover parses a gauge for every numeric or boolean field in the document which is not covered by the configured
+// metrics.
+func (p *Parser) discover(doc interface{}, configured MetricCollection, topic, deviceID string, autoDiscover *config.AutoDiscoverConfig, configuredNames map[string]bool, props MessageProperties) (MetricCollection, error) {
+	covered := make(map[string]bool)
+	for _, m := range configured {
+		if m.Path != "" {
+			covered[m.Path] = true
+		}
+	}
+	var mc MetricCollection
+	var err error
+	walkLeaves(doc, nil, p.separator, func(path string, value interface{}) {
+		if err != nil || covered[path] || len(p.config()[path]) > 0 || !autoDiscover.Discover(path) {
+			return
+		}
+		cfg := &config.MetricConfig{
+			PrometheusName: autoDiscover.MetricName(path),
+			MQTTName:       path,
+			Help:           "Automatically discovered from the JSON payload",
+			ValueType:      config.GaugeValueType,
+		}
+		if configuredNames[cfg.PrometheusName] {
+			return
+		}
+		var m Metric
+		if m, err = p.parseMetric(cfg, metricID(topic, path, deviceID, cfg.PrometheusName), value, props); err != nil {
+			err = fmt.Errorf("failed to parse discovered value from '%v' for path %q: %w", value, path, err)
+			return
+		}
+		// without a path, fields with the same sanitised name share one series instead of clashing
+		m.Topic = topic
+		m.Discovered = cfg
+		mc = append(mc, m)
+	})
+	return mc, err
+}
+
+// expandWildcardPath parses a metric for every value matching the path with wildcards.
+func (p *Parser) expandWildcardPath(doc interface{}, topic, path, deviceID string, props MessageProperties) (MetricCollection, error) {
+	var mc MetricCollection
+	for _, config := range p.findMetricConfigs(path, deviceID) {
+		for _, match := range expandPath(doc, path, p.separator, config.WildcardLabels) {
+			id := metricID(topic, match.path, deviceID, config.PrometheusName)
+			m, err := p.parseMetric(config, id, match.value, props)
+			if err != nil {
+				return nil, fmt.Errorf("failed to parse valid value from '%v' at %q for metric %q: %w", match.value, match.path, config.PrometheusName, err)
+			}
+			if m.Labels == nil {
+				m.Labels = make(map[string]string, len(match.labels))
+			}
+			for k, v := range match.labels {
+				m.Labels[k] = v
+			}
+			m.Topic = topic
+			m.Path = match.path
+			mc = append(mc, m)
+		}
+	}
+	return mc, nil
+}
+
 func NewMetricPerTopicExtractor(p Parser, metricNameRegex *config.Regexp) Extractor {
-	return func(topic string, payload []byte, deviceID string) (MetricCollection, error) {
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
 		var mc MetricCollection
 		metricName := metricNameRegex.GroupValue(topic, config.MetricNameRegexGroup)
 		if metricName == "" {
@@ -70,7 +176,7 @@ func NewMetricPerTopicExtractor(p Parser, metricNameRegex *config.Regexp) Extrac
 			}
 
 			id := metricID(topic, metricName, deviceID, config.PrometheusName)
-			m, err := p.parseMetric(config, id, rawValue)
+			m, err := p.parseMetric(config, id, rawValue, props)
 			if err != nil {
 				return nil, fmt.Errorf("failed to parse valid value from '%v' for metric %q: %w", rawValue, config.PrometheusName, err)
 			}
@@ -80,3 +186,25 @@ func NewMetricPerTopicExtractor(p Parser, metricNameRegex *config.Regexp) Extrac
 		return mc, nil
 	}
 }
+
+// WithTopicLabels adds the labels extracted from the topic to every metric of the extractor.
+func WithTopicLabels(extractor Extractor, topicLabels func(topic string) map[string]string) Extractor {
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
+		mc, err := extractor(topic, payload, deviceID, props)
+		if len(mc) == 0 {
+			return mc, err
+		}
+		values := topicLabels(topic)
+		for i := range mc {
+			labels := make(map[string]string, len(mc[i].Labels)+len(values))
+			for k, v := range mc[i].Labels {
+				labels[k] = v
+			}
+			for k, v := range values {
+				labels[k] = v
+			}
+			mc[i].Labels = labels
+		}
+		return mc, err
+	}
+}
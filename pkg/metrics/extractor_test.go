@@ -2,6 +2,7 @@ package metrics
 
 import (
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
@@ -136,9 +137,9 @@ func TestNewJSONObjectExtractor_parseMetric(t *testing.T) {
 				separator:     tt.separator,
 				metricConfigs: tt.fields.metricConfigs,
 			}
-			extractor := NewJSONObjectExtractor(p)
+			extractor := NewJSONObjectExtractor(p, nil)
 
-			got, err := extractor(tt.args.metricPath, []byte(tt.args.value), tt.args.deviceID)
+			got, err := extractor(tt.args.metricPath, []byte(tt.args.value), tt.args.deviceID, MessageProperties{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -156,3 +157,158 @@ func TestNewJSONObjectExtractor_parseMetric(t *testing.T) {
 		})
 	}
 }
+
+func TestNewJSONObjectExtractor_wildcard(t *testing.T) {
+	now = testNow
+	tests := []struct {
+		name    string
+		metric  config.MetricConfig
+		payload string
+		want    map[string]float64
+	}{
+		{
+			name: "array with sibling field",
+			metric: config.MetricConfig{
+				PrometheusName: "temperature",
+				MQTTName:       "sensors.*.temp",
+				ValueType:      "gauge",
+				WildcardLabels: []config.WildcardLabelConfig{{Name: "id", Field: "id"}},
+			},
+			payload: `{"sensors":[{"id":"a","temp":1},{"id":"b","temp":2},{"temp":3}]}`,
+			want:    map[string]float64{"id=a": 1, "id=b": 2},
+		},
+		{
+			name: "array index",
+			metric: config.MetricConfig{
+				PrometheusName: "power",
+				MQTTName:       "ENERGY.Power.*",
+				ValueType:      "gauge",
+				WildcardLabels: []config.WildcardLabelConfig{{Name: "channel"}},
+			},
+			payload: `{"ENERGY":{"Power":[10,20.5]}}`,
+			want:    map[string]float64{"channel=0": 10, "channel=1": 20.5},
+		},
+		{
+			name: "object keys",
+			metric: config.MetricConfig{
+				PrometheusName: "temperature",
+				MQTTName:       "rooms.*.sensors.*",
+				ValueType:      "gauge",
+				WildcardLabels: []config.WildcardLabelConfig{{Name: "room"}, {Name: "sensor_name"}},
+			},
+			payload: `{"rooms":{"kitchen":{"sensors":{"window":18,"oven":40}},"bath":{"sensors":{"floor":22}}}}`,
+			want:    map[string]float64{"room=bath,sensor_name=floor": 22, "room=kitchen,sensor_name=oven": 40, "room=kitchen,sensor_name=window": 18},
+		},
+		{
+			name: "no match",
+			metric: config.MetricConfig{
+				PrometheusName: "temperature",
+				MQTTName:       "sensors.*.temp",
+				ValueType:      "gauge",
+				WildcardLabels: []config.WildcardLabelConfig{{Name: "index"}},
+			},
+			payload: `{"sensors":"none"}`,
+			want:    map[string]float64{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser([]config.MetricConfig{tt.metric}, ".", t.TempDir())
+			mc, err := NewJSONObjectExtractor(p, nil)("topic", []byte(tt.payload), "device", MessageProperties{})
+			if err != nil {
+				t.Fatalf("extractor error = %v", err)
+			}
+			got := map[string]float64{}
+			paths := map[string]bool{}
+			for _, m := range mc {
+				var labels []string
+				for _, k := range m.LabelsKeys {
+					labels = append(labels, k+"="+m.Labels[k])
+				}
+				got[strings.Join(labels, ",")] = m.Value
+				paths[m.Path] = true
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("extractor got = %v, want %v", got, tt.want)
+			}
+			if len(paths) != len(mc) {
+				t.Errorf("expected a distinct path per match, got %v", paths)
+			}
+		})
+	}
+}
+
+func TestNewJSONObjectExtractor_autoDiscover(t *testing.T) {
+	now = testNow
+	metrics := []config.MetricConfig{
+		{PrometheusName: "tasmota_energy_power_watts", MQTTName: "ENERGY.Power", ValueType: "gauge", MQTTValueScale: 2},
+		{PrometheusName: "tasmota_sensor_temperature", MQTTName: "sensors.*.temp", ValueType: "gauge", WildcardLabels: []config.WildcardLabelConfig{{Name: "index"}}},
+	}
+	autoDiscover := &config.AutoDiscoverConfig{
+		Prefix:    "tasmota_",
+		DenyPaths: []*config.Regexp{config.MustNewRegexp(`^Wifi\.`)},
+	}
+	p := NewParser(metrics, ".", t.TempDir())
+	payload := `{"ENERGY":{"Power":10,"Today":1.5,"1st":3},"POWER":"ON","Online":true,"Wifi":{"RSSI":80},"sensors":[{"temp":20,"hum":40}]}`
+	mc, err := NewJSONObjectExtractor(p, autoDiscover)("topic", []byte(payload), "device", MessageProperties{})
+	if err != nil {
+		t.Fatalf("extractor error = %v", err)
+	}
+	got := map[string]float64{}
+	for _, m := range mc {
+		got[m.Description.String()] = m.Value
+	}
+	want := map[string]float64{}
+	for name, value := range map[string]float64{
+		"tasmota_ENERGY_Today":  1.5,
+		"tasmota_ENERGY_1st":    3,
+		"tasmota_Online":        1,
+		"tasmota_sensors_0_hum": 40,
+	} {
+		cfg := config.MetricConfig{PrometheusName: name, Help: "Automatically discovered from the JSON payload"}
+		want[cfg.PrometheusDescription().String()] = value
+	}
+	for _, cfg := range metrics {
+		want[cfg.PrometheusDescription().String()] = map[string]float64{"tasmota_energy_power_watts": 20, "tasmota_sensor_temperature": 20}[cfg.PrometheusName]
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("extractor got = %v, want %v", got, want)
+	}
+}
+
+func TestWithTopicLabels(t *testing.T) {
+	now = testNow
+	sub := config.SubscriptionConfig{
+		DeviceIDRegex:        config.MustNewRegexp("homie/(?P<deviceid>[^/]+)/.*"),
+		TopicLabelsRegex:     config.MustNewRegexp("homie/[^/]+/(?P<node>[^/]+)/.*"),
+		MetricPerTopicConfig: &config.MetricPerTopicConfig{MetricNameRegex: config.MustNewRegexp("homie/.*/(?P<metricname>[^/]+)")},
+	}
+	metric := config.MetricConfig{
+		PrometheusName: "temperature",
+		MQTTName:       "temperature",
+		ValueType:      "gauge",
+		TopicLabels:    sub.TopicLabels(),
+	}
+	p := NewParser([]config.MetricConfig{metric}, ".", t.TempDir())
+	extractor := WithTopicLabels(NewMetricPerTopicExtractor(p, sub.MetricPerTopicConfig.MetricNameRegex), sub.TopicLabelValues)
+
+	mc, err := extractor("homie/dht22/climate/temperature", []byte("21.5"), "dht22", MessageProperties{})
+	if err != nil {
+		t.Fatalf("extractor error = %v", err)
+	}
+	if len(mc) != 1 {
+		t.Fatalf("expected one metric, got %v", mc)
+	}
+	got := map[string]string{}
+	for _, k := range mc[0].LabelsKeys {
+		got[k] = mc[0].Labels[k]
+	}
+	want := map[string]string{"node": "climate"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("labels = %v, want %v", got, want)
+	}
+	wantDesc := prometheus.NewDesc("temperature", "", []string{"sensor", "topic", "node"}, nil)
+	if mc[0].Description.String() != wantDesc.String() {
+		t.Errorf("description = %v, want %v", mc[0].Description, wantDesc)
+	}
+}
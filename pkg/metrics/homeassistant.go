@@ -0,0 +1,555 @@
+package metrics
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+)
+
+// Subscriber changes the subscriptions of a connected client.
+type Subscriber interface {
+	AddSubscription(s mqttclient.Subscription) error
+	RemoveSubscription(topic string) error
+}
+
+// HomeAssistantDiscovery creates metrics from Home Assistant MQTT discovery messages and stores the values published
+// on the state topics of the discovered entities.
+type HomeAssistantDiscovery struct {
+	instrumentation
+	lock      sync.Mutex
+	inFlight  sync.WaitGroup
+	cfg       config.HomeAssistantDiscoveryConfig
+	separator string
+	stateDir  string
+	sharding  *config.ShardingConfig
+	collector Collector
+	devices   *DeviceTracker
+	// entities by discovery topic
+	entities map[string]homeAssistantEntity
+	// states by state topic
+	states map[string]*homeAssistantState
+	// pending are the subscription changes which are not applied yet
+	pending []subscriptionChange
+	wake    chan struct{}
+	logger  *zap.Logger
+}
+
+// homeAssistantEntity is a discovered entity with the metric of its state.
+type homeAssistantEntity struct {
+	stateTopic string
+	deviceID   string
+	// raw is true if the whole payload of the state topic is the value
+	raw    bool
+	metric config.MetricConfig
+	expiry time.Duration
+}
+
+// homeAssistantState holds the extractors of all entities sharing a state topic.
+type homeAssistantState struct {
+	// discoveryTopics are the entities of the state topic
+	discoveryTopics map[string]bool
+	// extractors by device ID
+	extractors map[string]Extractor
+	// expiry by metric description
+	expiry map[string]time.Duration
+	// metrics are the metric configs by description
+	metrics map[string]*config.MetricConfig
+}
+
+type subscriptionChange struct {
+	topic     string
+	subscribe bool
+}
+
+// NewHomeAssistantDiscovery creates the discovery of the given config. If sharding is not nil, only the values of the
+// devices of the configured shard are stored.
+func NewHomeAssistantDiscovery(cfg config.HomeAssistantDiscoveryConfig, separator, stateDir string, collector Collector, devices *DeviceTracker, sharding *config.ShardingConfig) *HomeAssistantDiscovery {
+	return &HomeAssistantDiscovery{
+		instrumentation: defaultInstrumentation,
+		cfg:             cfg,
+		separator:       separator,
+		stateDir:        stateDir,
+		sharding:        sharding,
+		collector:       collector,
+		devices:         devices,
+		entities:        make(map[string]homeAssistantEntity),
+		states:          make(map[string]*homeAssistantState),
+		wake:            make(chan struct{}, 1),
+		logger:          config.ProcessContext.Logger(),
+	}
+}
+
+// Subscriptions returns the subscriptions to the discovery topics of the configured components.
+func (d *HomeAssistantDiscovery) Subscriptions(errChan chan<- error) []mqttclient.Subscription {
+	handler := func(m mqttclient.Message) {
+		d.inFlight.Add(1)
+		defer d.inFlight.Done()
+		if err := d.discover(m.Topic, m.Payload); err != nil {
+			errChan <- fmt.Errorf("could not discover entity '%s' on topic %s: %s", string(m.Payload), m.Topic, err.Error())
+		}
+	}
+	var subs []mqttclient.Subscription
+	for _, component := range d.cfg.Components {
+		for _, topic := range []string{"%s/%s/+/config", "%s/%s/+/+/config"} {
+			subs = append(subs, mqttclient.Subscription{
+				Topic:             fmt.Sprintf(topic, d.cfg.Prefix, component),
+				QoS:               d.cfg.QoS,
+				OnMessageReceived: handler,
+			})
+		}
+	}
+	return subs
+}
+
+// Run subscribes to the state topics of the discovered entities and unsubscribes from the state topics without
+// entities until the context is done. Subscribing from within a message handler would block the client.
+func (d *HomeAssistantDiscovery) Run(ctx context.Context, client Subscriber, errChan chan<- error) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.wake:
+		}
+		d.lock.Lock()
+		changes := d.pending
+		d.pending = nil
+		d.lock.Unlock()
+		for _, c := range changes {
+			var err error
+			if c.subscribe {
+				err = client.AddSubscription(mqttclient.Subscription{
+					Topic:             c.topic,
+					QoS:               d.cfg.QoS,
+					OnMessageReceived: d.stateHandler(c.topic, errChan),
+				})
+			} else {
+				err = client.RemoveSubscription(c.topic)
+			}
+			if err != nil {
+				errChan <- fmt.Errorf("could not change the subscription of the state topic %s: %w", c.topic, err)
+			}
+		}
+	}
+}
+
+func (d *HomeAssistantDiscovery) stateHandler(stateTopic string, errChan chan<- error) mqttclient.MessageHandler {
+	return func(m mqttclient.Message) {
+		d.inFlight.Add(1)
+		defer d.inFlight.Done()
+		d.logger.Debug("Got message", zap.String("topic", m.Topic), zap.String("payload", string(m.Payload)))
+		if err := d.store(stateTopic, m); err != nil {
+			errChan <- fmt.Errorf("could not store metrics '%s' on topic %s: %s", string(m.Payload), m.Topic, err.Error())
+			d.CountStoreError(m.Topic)
+		}
+	}
+}
+
+// Drain blocks until all discovery and state messages which are currently processed are stored.
+func (d *HomeAssistantDiscovery) Drain() {
+	d.inFlight.Wait()
+}
+
+func (d *HomeAssistantDiscovery) store(stateTopic string, m mqttclient.Message) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	state, ok := d.states[stateTopic]
+	if !ok {
+		// all entities of the state topic were removed in the meantime
+		return nil
+	}
+	for deviceID, extractor := range state.extractors {
+		if !ownsDevice(d.sharding, deviceID) {
+			d.CountOtherShard(m.Topic)
+			continue
+		}
+		mc, err := extractor(m.Topic, m.Payload, deviceID, MessageProperties{
+			ContentType:    m.ContentType,
+			UserProperties: m.UserProperties,
+		})
+		if d.devices != nil {
+			d.devices.Seen(deviceID, err != nil)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to extract metric values from topic: %w", err)
+		}
+		for j := range mc {
+			expiry := state.expiry[mc[j].Description.String()]
+			if m.Expiry > 0 && (expiry == 0 || m.Expiry < expiry) {
+				expiry = m.Expiry
+			}
+			mc[j].Expiry = expiry
+			mc[j].Discovered = state.metrics[mc[j].Description.String()]
+		}
+		d.collector.Observe(deviceID, mc)
+	}
+	d.CountSuccess(m.Topic)
+	return nil
+}
+
+// discover adds, updates or removes the entity of the discovery topic. Entities which cannot be exported are removed.
+func (d *HomeAssistantDiscovery) discover(topic string, payload []byte) error {
+	component, nodeID, objectID, ok := d.parseTopic(topic)
+	if !ok {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if len(payload) == 0 {
+		// an empty payload removes the entity
+		d.remove(topic)
+		return nil
+	}
+	p, err := parseHomeAssistantPayload(payload)
+	if err != nil {
+		d.remove(topic)
+		return fmt.Errorf("failed to decode discovery payload: %w", err)
+	}
+	entity, err := d.entity(component, nodeID, objectID, p)
+	if err != nil {
+		d.remove(topic)
+		d.logger.Debug("Ignore Home Assistant entity", zap.String("topic", topic), zap.Error(err))
+		return nil
+	}
+	if previous, ok := d.entities[topic]; ok && reflect.DeepEqual(previous, entity) {
+		return nil
+	}
+	d.remove(topic)
+	d.entities[topic] = entity
+	state, ok := d.states[entity.stateTopic]
+	if !ok {
+		state = &homeAssistantState{discoveryTopics: make(map[string]bool)}
+		d.states[entity.stateTopic] = state
+		d.queue(entity.stateTopic, true)
+	}
+	state.discoveryTopics[topic] = true
+	d.rebuild(state)
+	d.logger.Info("Discovered Home Assistant entity", zap.String("topic", topic), zap.String("metric", entity.metric.PrometheusName), zap.String("stateTopic", entity.stateTopic))
+	return nil
+}
+
+// parseTopic splits the discovery topic <prefix>/<component>/[<node_id>/]<object_id>/config.
+func (d *HomeAssistantDiscovery) parseTopic(topic string) (component, nodeID, objectID string, ok bool) {
+	if !strings.HasPrefix(topic, d.cfg.Prefix+"/") {
+		return "", "", "", false
+	}
+	parts := strings.Split(strings.TrimPrefix(topic, d.cfg.Prefix+"/"), "/")
+	if len(parts) < 3 || len(parts) > 4 || parts[len(parts)-1] != "config" {
+		return "", "", "", false
+	}
+	if len(parts) == 4 {
+		nodeID = parts[1]
+	}
+	return parts[0], nodeID, parts[len(parts)-2], d.cfg.Discovers(parts[0])
+}
+
+// remove removes the entity of the discovery topic and unsubscribes from its state topic if it was the last entity.
+func (d *HomeAssistantDiscovery) remove(topic string) {
+	entity, ok := d.entities[topic]
+	if !ok {
+		return
+	}
+	delete(d.entities, topic)
+	state := d.states[entity.stateTopic]
+	delete(state.discoveryTopics, topic)
+	if len(state.discoveryTopics) == 0 {
+		delete(d.states, entity.stateTopic)
+		d.queue(entity.stateTopic, false)
+		return
+	}
+	d.rebuild(state)
+}
+
+// rebuild creates the extractors of the entities of the state.
+func (d *HomeAssistantDiscovery) rebuild(state *homeAssistantState) {
+	jsonMetrics := make(map[string][]config.MetricConfig)
+	rawMetrics := make(map[string][]config.MetricConfig)
+	var stateTopic string
+	state.expiry = make(map[string]time.Duration)
+	state.metrics = make(map[string]*config.MetricConfig)
+	for topic := range state.discoveryTopics {
+		entity := d.entities[topic]
+		metric := entity.metric
+		state.metrics[metric.PrometheusDescription().String()] = &metric
+		stateTopic = entity.stateTopic
+		if entity.raw {
+			rawMetrics[entity.deviceID] = append(rawMetrics[entity.deviceID], entity.metric)
+		} else {
+			jsonMetrics[entity.deviceID] = append(jsonMetrics[entity.deviceID], entity.metric)
+		}
+		if entity.expiry > 0 {
+			state.expiry[entity.metric.PrometheusDescription().String()] = entity.expiry
+		}
+	}
+	state.extractors = make(map[string]Extractor)
+	for deviceID, metrics := range jsonMetrics {
+		state.extractors[deviceID] = NewJSONObjectExtractor(NewParser(metrics, d.separator, d.stateDir), nil)
+	}
+	for deviceID, metrics := range rawMetrics {
+		extractor := NewMetricPerTopicExtractor(
+			NewParser(metrics, d.separator, d.stateDir),
+			config.MustNewRegexp(fmt.Sprintf("^(?P<%s>%s)$", config.MetricNameRegexGroup, regexp.QuoteMeta(stateTopic))),
+		)
+		if jsonExtractor, ok := state.extractors[deviceID]; ok {
+			extractor = combineExtractors(jsonExtractor, extractor)
+		}
+		state.extractors[deviceID] = extractor
+	}
+}
+
+// queue schedules a subscription change for the next run.
+func (d *HomeAssistantDiscovery) queue(topic string, subscribe bool) {
+	d.pending = append(d.pending, subscriptionChange{topic: topic, subscribe: subscribe})
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+func combineExtractors(extractors ...Extractor) Extractor {
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
+		var mc MetricCollection
+		for _, extractor := range extractors {
+			metrics, err := extractor(topic, payload, deviceID, props)
+			if err != nil {
+				return nil, err
+			}
+			mc = append(mc, metrics...)
+		}
+		return mc, nil
+	}
+}
+
+// homeAssistantPayload is the part of a discovery payload which describes the state of a sensor.
+type homeAssistantPayload struct {
+	Name              string      `json:"name"`
+	ObjectID          string      `json:"object_id"`
+	StateTopic        string      `json:"state_topic"`
+	ValueTemplate     string      `json:"value_template"`
+	UnitOfMeasurement string      `json:"unit_of_measurement"`
+	DeviceClass       string      `json:"device_class"`
+	StateClass        string      `json:"state_class"`
+	ExpireAfter       float64     `json:"expire_after"`
+	PayloadOn         interface{} `json:"payload_on"`
+	PayloadOff        interface{} `json:"payload_off"`
+	Device            struct {
+		Identifiers interface{} `json:"identifiers"`
+		Name        string      `json:"name"`
+	} `json:"device"`
+}
+
+// homeAssistantAbbreviations are the abbreviated keys of the used discovery payload fields.
+var homeAssistantAbbreviations = map[string]string{
+	"stat_t":       "state_topic",
+	"val_tpl":      "value_template",
+	"unit_of_meas": "unit_of_measurement",
+	"dev_cla":      "device_class",
+	"stat_cla":     "state_class",
+	"obj_id":       "object_id",
+	"exp_aft":      "expire_after",
+	"pl_on":        "payload_on",
+	"pl_off":       "payload_off",
+	"dev":          "device",
+	"ids":          "identifiers",
+}
+
+// parseHomeAssistantPayload decodes the discovery payload. Abbreviated keys are expanded and the base topic ~ is
+// replaced in the state topic.
+func parseHomeAssistantPayload(payload []byte) (homeAssistantPayload, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(payload, &raw); err != nil {
+		return homeAssistantPayload{}, err
+	}
+	expanded := expandHomeAssistantKeys(raw)
+	if base, ok := expanded["~"].(string); ok {
+		if topic, ok := expanded["state_topic"].(string); ok {
+			if strings.HasPrefix(topic, "~") {
+				expanded["state_topic"] = base + topic[1:]
+			} else if strings.HasSuffix(topic, "~") {
+				expanded["state_topic"] = topic[:len(topic)-1] + base
+			}
+		}
+	}
+	data, err := json.Marshal(expanded)
+	if err != nil {
+		return homeAssistantPayload{}, err
+	}
+	var p homeAssistantPayload
+	err = json.Unmarshal(data, &p)
+	return p, err
+}
+
+func expandHomeAssistantKeys(raw map[string]interface{}) map[string]interface{} {
+	expanded := make(map[string]interface{}, len(raw))
+	for k, v := range raw {
+		if long, ok := homeAssistantAbbreviations[k]; ok {
+			k = long
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			v = expandHomeAssistantKeys(nested)
+		}
+		expanded[k] = v
+	}
+	return expanded
+}
+
+// nonNumericDeviceClasses are the sensor device classes without a numeric state.
+var nonNumericDeviceClasses = map[string]bool{"date": true, "enum": true, "timestamp": true}
+
+// entity creates the metric of the discovered entity. It returns an error if the state of the entity is not numeric
+// or the value template is not supported.
+func (d *HomeAssistantDiscovery) entity(component, nodeID, objectID string, p homeAssistantPayload) (homeAssistantEntity, error) {
+	if p.StateTopic == "" {
+		return homeAssistantEntity{}, fmt.Errorf("no state_topic")
+	}
+	if component == config.HomeAssistantSensor && ((p.UnitOfMeasurement == "" && p.StateClass == "") || nonNumericDeviceClasses[p.DeviceClass]) {
+		return homeAssistantEntity{}, fmt.Errorf("the state of the sensor is not numeric")
+	}
+	path, err := templatePath(p.ValueTemplate, d.separator)
+	if err != nil {
+		return homeAssistantEntity{}, err
+	}
+	if p.ObjectID != "" {
+		objectID = p.ObjectID
+	}
+	name := p.DeviceClass
+	if name == "" {
+		name = objectID
+	}
+	counter := p.StateClass == "total" || p.StateClass == "total_increasing"
+	metric := config.MetricConfig{
+		PrometheusName: d.cfg.MetricName(component, name, p.UnitOfMeasurement, counter),
+		MQTTName:       path,
+		ValueType:      config.GaugeValueType,
+		ConstantLabels: map[string]string{
+			"entity":        component + "." + objectID,
+			"friendly_name": friendlyName(p),
+		},
+	}
+	metric.Help = "Home Assistant " + strings.ReplaceAll(strings.TrimPrefix(metric.PrometheusName, d.cfg.MetricPrefix), "_", " ")
+	if counter {
+		metric.ValueType = config.CounterValueType
+	}
+	if path == "" {
+		metric.MQTTName = p.StateTopic
+	}
+	if component == config.HomeAssistantBinarySensor {
+		on, off := p.PayloadOn, p.PayloadOff
+		if on == nil {
+			on = "ON"
+		}
+		if off == nil {
+			off = "OFF"
+		}
+		mapping := make(map[string]float64)
+		if s, ok := on.(string); ok {
+			mapping[s] = 1
+		}
+		if s, ok := off.(string); ok {
+			mapping[s] = 0
+		}
+		if len(mapping) > 0 {
+			metric.StringValueMapping = &config.StringValueMappingConfig{Map: mapping}
+		}
+	}
+	return homeAssistantEntity{
+		stateTopic: p.StateTopic,
+		deviceID:   deviceID(nodeID, objectID, p),
+		raw:        path == "",
+		metric:     metric,
+		expiry:     time.Duration(p.ExpireAfter * float64(time.Second)),
+	}, nil
+}
+
+// deviceID returns the node ID of the discovery topic, the first device identifier, the device name or the object ID.
+func deviceID(nodeID, objectID string, p homeAssistantPayload) string {
+	if nodeID != "" {
+		return nodeID
+	}
+	switch ids := p.Device.Identifiers.(type) {
+	case string:
+		if ids != "" {
+			return ids
+		}
+	case []interface{}:
+		if len(ids) > 0 {
+			if id, ok := ids[0].(string); ok && id != "" {
+				return id
+			}
+		}
+	}
+	if p.Device.Name != "" {
+		return p.Device.Name
+	}
+	return objectID
+}
+
+// friendlyName prefixes the entity name with the device name like Home Assistant does.
+func friendlyName(p homeAssistantPayload) string {
+	switch {
+	case p.Name == "":
+		return p.Device.Name
+	case p.Device.Name == "" || strings.HasPrefix(p.Name, p.Device.Name):
+		return p.Name
+	}
+	return p.Device.Name + " " + p.Name
+}
+
+var (
+	valueTemplateRegex   = regexp.MustCompile(`^\{\{\s*(value_json[^|}]*?|value)\s*((?:\|\s*\w+(?:\([^)]*\))?\s*)*)\}\}$`)
+	templateFilterRegex  = regexp.MustCompile(`\|\s*(\w+)`)
+	templateSegmentRegex = regexp.MustCompile(`^(?:\.([A-Za-z_][A-Za-z0-9_]*)|\[\s*'([^']*)'\s*\]|\[\s*"([^"]*)"\s*\]|\[\s*(\d+)\s*\])`)
+	// supportedTemplateFilters do not change the value or are applied by the parser anyway
+	supportedTemplateFilters = map[string]bool{"float": true, "int": true, "round": true, "default": true, "is_defined": true, "trim": true}
+)
+
+// templatePath translates a value template like {{ value_json.temperature | float }} to the path of the value in the
+// JSON payload. The path is empty if the whole payload is the value.
+func templatePath(template, separator string) (string, error) {
+	template = strings.TrimSpace(template)
+	if template == "" {
+		return "", nil
+	}
+	match := valueTemplateRegex.FindStringSubmatch(template)
+	if match == nil {
+		return "", fmt.Errorf("unsupported value_template %q", template)
+	}
+	for _, filter := range templateFilterRegex.FindAllStringSubmatch(match[2], -1) {
+		if !supportedTemplateFilters[filter[1]] {
+			return "", fmt.Errorf("unsupported filter %q in value_template %q", filter[1], template)
+		}
+	}
+	if match[1] == "value" {
+		return "", nil
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(match[1], "value_json"))
+	if rest == "" {
+		return "", fmt.Errorf("unsupported value_template %q", template)
+	}
+	var segments []string
+	for rest != "" {
+		s := templateSegmentRegex.FindStringSubmatch(rest)
+		if s == nil {
+			return "", fmt.Errorf("unsupported value_template %q", template)
+		}
+		segment := s[1] + s[2] + s[3]
+		if s[4] != "" {
+			segment = "[" + s[4] + "]"
+		}
+		if strings.Contains(segment, separator) {
+			return "", fmt.Errorf("the key %q in value_template %q contains the separator %q", segment, template, separator)
+		}
+		segments = append(segments, segment)
+		rest = rest[len(s[0]):]
+	}
+	return strings.Join(segments, separator), nil
+}
@@ -0,0 +1,180 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestTemplatePath(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{template: "", want: ""},
+		{template: "{{ value }}", want: ""},
+		{template: "{{ value_json.temperature }}", want: "temperature"},
+		{template: "{{ value_json.temperature | float }}", want: "temperature"},
+		{template: "{{value_json['DHT11'].Temperature}}", want: "DHT11.Temperature"},
+		{template: `{{ value_json["ENERGY"]["Power"] | round(1) }}`, want: "ENERGY.Power"},
+		{template: "{{ value_json.sensors[0].value }}", want: "sensors.[0].value"},
+		{template: "{{ value_json['a.b'] }}", wantErr: true},
+		{template: "{{ value_json }}", wantErr: true},
+		{template: "{{ value_json.state | upper }}", wantErr: true},
+		{template: "{% if value_json.x %}1{% endif %}", wantErr: true},
+		{template: "{{ value_json.temperature * 10 }}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			got, err := templatePath(tt.template, ".")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("templatePath() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("templatePath() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type fakeSubscriber struct {
+	changes chan string
+}
+
+func (f fakeSubscriber) AddSubscription(s mqttclient.Subscription) error {
+	f.changes <- "+" + s.Topic
+	return nil
+}
+
+func (f fakeSubscriber) RemoveSubscription(topic string) error {
+	f.changes <- "-" + topic
+	return nil
+}
+
+func TestHomeAssistantDiscovery(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = testNow
+	config.SetProcessContext(zap.NewNop())
+	cfg := config.HomeAssistantDiscoveryConfig{
+		Prefix:     config.DefaultHomeAssistantDiscoveryPrefix,
+		Components: []string{config.HomeAssistantSensor, config.HomeAssistantBinarySensor},
+	}
+	c := NewCollector(time.Hour, nil, zap.NewNop())
+	d := NewHomeAssistantDiscovery(cfg, ".", t.TempDir(), c, nil, nil)
+	subscriber := fakeSubscriber{changes: make(chan string, 10)}
+	errChan := make(chan error, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.Run(ctx, subscriber, errChan)
+
+	discoveries := []struct {
+		topic   string
+		payload string
+	}{
+		// zigbee2mqtt
+		{"homeassistant/sensor/0x00158d0001/temperature/config", `{"name": "Temperature", "state_topic": "zigbee2mqtt/living_room", "value_template": "{{ value_json.temperature }}",
+			"unit_of_measurement": "°C", "device_class": "temperature", "state_class": "measurement", "expire_after": 600, "device": {"name": "living_room"}}`},
+		{"homeassistant/binary_sensor/0x00158d0001/occupancy/config", `{"name": "Occupancy", "state_topic": "zigbee2mqtt/living_room", "value_template": "{{ value_json.occupancy }}",
+			"payload_on": true, "payload_off": false, "device_class": "occupancy", "device": {"name": "living_room"}}`},
+		// not numeric
+		{"homeassistant/sensor/0x00158d0001/action/config", `{"name": "Action", "state_topic": "zigbee2mqtt/living_room", "value_template": "{{ value_json.action }}"}`},
+		// tasmota with abbreviations and base topic
+		{"homeassistant/sensor/AABBCC_DHT11_Humidity/config", `{"name": "Humidity", "~": "tele/plug/", "stat_t": "~SENSOR", "val_tpl": "{{value_json['DHT11'].Humidity}}",
+			"unit_of_meas": "%", "dev_cla": "humidity", "dev": {"ids": ["AABBCC"], "name": "Plug"}}`},
+		{"homeassistant/binary_sensor/AABBCC_relay/config", `{"name": "Relay", "stat_t": "stat/plug/POWER", "pl_on": "ON", "pl_off": "OFF", "dev": {"ids": ["AABBCC"], "name": "Plug"}}`},
+		// esphome with a raw value
+		{"homeassistant/sensor/garage/energy/config", `{"name": "Energy", "state_topic": "garage/sensor/energy/state", "unit_of_measurement": "kWh", "state_class": "total_increasing", "device": {"name": "garage"}}`},
+	}
+	for _, m := range discoveries {
+		if err := d.discover(m.topic, []byte(m.payload)); err != nil {
+			t.Fatalf("discover(%s) error = %v", m.topic, err)
+		}
+	}
+	var subscribed []string
+	for i := 0; i < 4; i++ {
+		subscribed = append(subscribed, <-subscriber.changes)
+	}
+	sort.Strings(subscribed)
+	if want := []string{"+garage/sensor/energy/state", "+stat/plug/POWER", "+tele/plug/SENSOR", "+zigbee2mqtt/living_room"}; !reflect.DeepEqual(subscribed, want) {
+		t.Errorf("subscribed to %v, want %v", subscribed, want)
+	}
+
+	for _, m := range []mqttclient.Message{
+		{Topic: "zigbee2mqtt/living_room", Payload: []byte(`{"temperature": 21.5, "occupancy": true, "action": "single"}`)},
+		{Topic: "tele/plug/SENSOR", Payload: []byte(`{"DHT11": {"Humidity": 40}}`)},
+		{Topic: "stat/plug/POWER", Payload: []byte(`OFF`)},
+		{Topic: "garage/sensor/energy/state", Payload: []byte(`1234.5`)},
+	} {
+		if err := d.store(m.Topic, m); err != nil {
+			t.Fatalf("store(%s) error = %v", m.Topic, err)
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(c)
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, family := range families {
+		if family.GetName() == "mqtt2prometheus_series_dropped_total" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			var labels []string
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetName()+"="+l.GetValue())
+			}
+			value := m.GetGauge().GetValue() + m.GetCounter().GetValue()
+			got = append(got, fmt.Sprintf("%s{%s} %v %s", family.GetName(), strings.Join(labels, ","), value, family.GetHelp()))
+		}
+	}
+	want := []string{
+		// without device class, the object ID is the name
+		"binary_sensor_AABBCC_relay{entity=binary_sensor.AABBCC_relay,friendly_name=Plug Relay,sensor=AABBCC,topic=stat/plug/POWER} 0 Home Assistant binary sensor AABBCC relay",
+		"binary_sensor_occupancy{entity=binary_sensor.occupancy,friendly_name=living_room Occupancy,sensor=0x00158d0001,topic=zigbee2mqtt/living_room} 1 Home Assistant binary sensor occupancy",
+		"sensor_energy_kilowatt_hours_total{entity=sensor.energy,friendly_name=garage Energy,sensor=garage,topic=garage/sensor/energy/state} 1234.5 Home Assistant sensor energy kilowatt hours total",
+		"sensor_humidity_percent{entity=sensor.AABBCC_DHT11_Humidity,friendly_name=Plug Humidity,sensor=AABBCC,topic=tele/plug/SENSOR} 40 Home Assistant sensor humidity percent",
+		"sensor_temperature_celsius{entity=sensor.temperature,friendly_name=living_room Temperature,sensor=0x00158d0001,topic=zigbee2mqtt/living_room} 21.5 Home Assistant sensor temperature celsius",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	for _, raw := range c.(*MemoryCachedCollector).cache.Items() {
+		item := raw.Object.(CacheItem)
+		wantExpiry := time.Duration(0)
+		if strings.Contains(item.Metric.Description.String(), "sensor_temperature_celsius") {
+			wantExpiry = 10 * time.Minute
+		}
+		if item.Metric.Expiry != wantExpiry {
+			t.Errorf("%s: expiry = %v, want %v", item.Metric.Description, item.Metric.Expiry, wantExpiry)
+		}
+	}
+
+	// removing the last entity of a state topic unsubscribes from it
+	if err := d.discover("homeassistant/binary_sensor/AABBCC_relay/config", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.discover("homeassistant/sensor/0x00158d0001/temperature/config", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-subscriber.changes; got != "-stat/plug/POWER" {
+		t.Errorf("expected to unsubscribe from the relay state topic, got %q", got)
+	}
+	select {
+	case change := <-subscriber.changes:
+		t.Errorf("unexpected subscription change %q", change)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
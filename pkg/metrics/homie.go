@@ -0,0 +1,281 @@
+package metrics
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// homieStates are the states of a Homie device.
+var homieStates = []string{"init", "ready", "disconnected", "sleeping", "lost", "alert"}
+
+// HomieDevices keeps the attributes of Homie devices. It is passed from one Homie extractor to the next during a
+// config reload, since the retained attributes are not sent again.
+type HomieDevices struct {
+	lock sync.Mutex
+	// collector deletes the series of properties which are renamed by their attributes, it may be nil
+	collector Collector
+	devices   map[string]*homieDevice
+}
+
+type homieDevice struct {
+	name string
+	// nodes is nil until the device published $nodes
+	nodes map[string]*homieNode
+	// properties are keyed by <node>/<property>
+	properties map[string]*homieProperty
+}
+
+type homieNode struct {
+	// properties is nil until the node published $properties
+	properties map[string]bool
+}
+
+type homieProperty struct {
+	name     string
+	datatype string
+	unit     string
+	format   string
+	// value is the last value of the property, it is nil until the first value arrived
+	value *string
+	// exported is the description of the last exported metric, it is nil until the property was exported
+	exported *prometheus.Desc
+}
+
+// NewHomieDevices creates the state of the Homie extractors. If collector is not nil, the series of a property is
+// deleted when a later attribute changes its name or type.
+func NewHomieDevices(collector Collector) *HomieDevices {
+	return &HomieDevices{
+		collector: collector,
+		devices:   make(map[string]*homieDevice),
+	}
+}
+
+func (h *HomieDevices) device(id string) *homieDevice {
+	device, ok := h.devices[id]
+	if !ok {
+		device = &homieDevice{properties: make(map[string]*homieProperty)}
+		h.devices[id] = device
+	}
+	return device
+}
+
+// listed returns true if the property is announced by the $nodes and $properties attributes. Properties of devices
+// and nodes which did not publish these attributes yet are accepted.
+func (d *homieDevice) listed(node, property string) bool {
+	if d.nodes == nil {
+		return true
+	}
+	// the instances of Homie 3 array nodes are named <node>_<index>
+	if i := strings.LastIndex(node, "_"); i > 0 {
+		node = node[:i]
+	}
+	n, ok := d.nodes[node]
+	if !ok {
+		return false
+	}
+	return n.properties == nil || n.properties[property]
+}
+
+// NewHomieExtractor extracts the $state of Homie devices and the values of their properties with the datatypes
+// integer, float, boolean and enum. The attributes of the devices are kept in devices.
+func NewHomieExtractor(p Parser, cfg *config.HomieConfig, devices *HomieDevices) Extractor {
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
+		devices.lock.Lock()
+		defer devices.lock.Unlock()
+		rest := strings.TrimPrefix(topic, cfg.BaseTopic+"/")
+		if rest == topic {
+			return nil, fmt.Errorf("topic is not below the Homie base topic %q", cfg.BaseTopic)
+		}
+		segments := strings.Split(rest, "/")
+		device := devices.device(segments[0])
+		value := string(payload)
+		switch {
+		case len(segments) < 2:
+			return nil, nil
+		case strings.HasPrefix(segments[1], "$"):
+			// device attributes, nested attributes like $stats/uptime are ignored
+			if len(segments) == 2 {
+				return homieDeviceAttribute(p, cfg, topic, deviceID, device, segments[1], value, props)
+			}
+		case len(segments) == 3 && strings.HasPrefix(segments[2], "$"):
+			homieNodeAttribute(device, segments[1], segments[2], value)
+		case len(segments) == 3:
+			property := device.property(segments[1], segments[2])
+			property.value = &value
+			return devices.metric(p, cfg, topic, deviceID, device, segments[1], segments[2], props)
+		case len(segments) == 4 && strings.HasPrefix(segments[3], "$"):
+			if !homiePropertyAttribute(device.property(segments[1], segments[2]), segments[3], value) {
+				return nil, nil
+			}
+			// a value which arrived before the attributes is exported now
+			valueTopic := strings.Join(append([]string{cfg.BaseTopic}, segments[:3]...), "/")
+			return devices.metric(p, cfg, valueTopic, deviceID, device, segments[1], segments[2], props)
+		}
+		// other topics like <property>/set are ignored
+		return nil, nil
+	}
+}
+
+func (d *homieDevice) property(node, property string) *homieProperty {
+	key := node + "/" + property
+	p, ok := d.properties[key]
+	if !ok {
+		p = &homieProperty{}
+		d.properties[key] = p
+	}
+	return p
+}
+
+// homieDeviceAttribute stores the device attributes and returns the state metric for $state.
+func homieDeviceAttribute(p Parser, cfg *config.HomieConfig, topic, deviceID string, device *homieDevice, attribute, value string, props MessageProperties) (MetricCollection, error) {
+	switch attribute {
+	case "$name":
+		device.name = value
+	case "$nodes":
+		nodes := make(map[string]*homieNode)
+		for _, id := range homieList(value) {
+			// Homie 3 marks array nodes with []
+			id = strings.TrimSuffix(id, "[]")
+			if n, ok := device.nodes[id]; ok {
+				nodes[id] = n
+			} else {
+				nodes[id] = &homieNode{}
+			}
+		}
+		device.nodes = nodes
+	case "$state":
+		metricCfg := &config.MetricConfig{
+			PrometheusName: cfg.StateMetricName(),
+			MQTTName:       attribute,
+			Help:           "State of the Homie device",
+			ValueType:      config.StateSetValueType,
+			States:         homieStates,
+			TopicLabels:    cfg.TopicLabels,
+		}
+		m, err := p.parseMetric(metricCfg, metricID(topic, attribute, deviceID, metricCfg.PrometheusName), value, props)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse the device state: %w", err)
+		}
+		m.Topic = topic
+		m.Discovered = metricCfg
+		return MetricCollection{m}, nil
+	}
+	return nil, nil
+}
+
+// homieNodeAttribute stores the $properties of a node. Other node attributes are ignored.
+func homieNodeAttribute(device *homieDevice, node, attribute, value string) {
+	if attribute != "$properties" {
+		return
+	}
+	properties := make(map[string]bool)
+	for _, id := range homieList(value) {
+		properties[id] = true
+	}
+	if device.nodes == nil {
+		device.nodes = make(map[string]*homieNode)
+	}
+	n, ok := device.nodes[node]
+	if !ok {
+		n = &homieNode{}
+		device.nodes[node] = n
+	}
+	n.properties = properties
+}
+
+// homiePropertyAttribute stores the attribute of a property. It returns true if the metric of the property changed.
+func homiePropertyAttribute(property *homieProperty, attribute, value string) bool {
+	var field *string
+	switch attribute {
+	case "$name":
+		field = &property.name
+	case "$datatype":
+		field = &property.datatype
+	case "$unit":
+		field = &property.unit
+	case "$format":
+		field = &property.format
+	default:
+		return false
+	}
+	if *field == value {
+		return false
+	}
+	*field = value
+	return true
+}
+
+// metric returns the metric of the property like homieMetric. The series exported before is deleted if the attributes
+// of the property changed its name or type, otherwise it would stay in the cache until the cache timeout.
+func (h *HomieDevices) metric(p Parser, cfg *config.HomieConfig, topic, deviceID string, device *homieDevice, node, propertyID string, props MessageProperties) (MetricCollection, error) {
+	property := device.property(node, propertyID)
+	mc, err := homieMetric(p, cfg, topic, deviceID, device, node, propertyID, props)
+	if err != nil {
+		return nil, err
+	}
+	var exported *prometheus.Desc
+	if len(mc) > 0 {
+		exported = mc[0].Description
+	}
+	if property.exported != nil && (exported == nil || exported.String() != property.exported.String()) && h.collector != nil {
+		h.collector.DeleteMetric(deviceID, property.exported)
+	}
+	property.exported = exported
+	return mc, nil
+}
+
+// homieMetric returns the metric of the property. It is empty if the value or datatype is not known yet or if the
+// datatype is not exported.
+func homieMetric(p Parser, cfg *config.HomieConfig, topic, deviceID string, device *homieDevice, node, propertyID string, props MessageProperties) (MetricCollection, error) {
+	property := device.property(node, propertyID)
+	if property.value == nil || !device.listed(node, propertyID) {
+		return nil, nil
+	}
+	metricCfg := &config.MetricConfig{
+		PrometheusName: cfg.MetricName(node, propertyID, property.unit),
+		MQTTName:       node + "/" + propertyID,
+		Help:           fmt.Sprintf("Homie property %s/%s", node, propertyID),
+		ValueType:      config.GaugeValueType,
+		ConstantLabels: map[string]string{
+			"friendly_name": strings.TrimSpace(device.name + " " + property.name),
+		},
+		TopicLabels: cfg.TopicLabels,
+	}
+	if property.unit != "" {
+		metricCfg.Help += " in " + property.unit
+	}
+	switch property.datatype {
+	case "integer", "float":
+	case "boolean":
+		metricCfg.StringValueMapping = &config.StringValueMappingConfig{Map: map[string]float64{"true": 1, "false": 0}}
+	case "enum":
+		metricCfg.PrometheusName = cfg.MetricName(node, propertyID, "")
+		metricCfg.ValueType = config.StateSetValueType
+		metricCfg.States = homieList(property.format)
+	default:
+		// string, color, datetime, duration and unknown datatypes
+		return nil, nil
+	}
+	m, err := p.parseMetric(metricCfg, metricID(topic, metricCfg.MQTTName, deviceID, metricCfg.PrometheusName), *property.value, props)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse valid value from '%v' for property %q: %w", *property.value, metricCfg.MQTTName, err)
+	}
+	m.Topic = topic
+	m.Discovered = metricCfg
+	return MetricCollection{m}, nil
+}
+
+// homieList splits a comma separated attribute.
+func homieList(value string) []string {
+	var list []string
+	for _, v := range strings.Split(value, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
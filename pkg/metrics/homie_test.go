@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func TestNewHomieExtractor(t *testing.T) {
+	config.SetProcessContext(zap.NewNop())
+	attributes := []mqttclient.Message{
+		{Topic: "homie/sensor-1/$name", Payload: []byte("Kitchen")},
+		{Topic: "homie/sensor-1/$nodes", Payload: []byte("climate,light")},
+		{Topic: "homie/sensor-1/climate/$properties", Payload: []byte("temperature,mode,heating")},
+		{Topic: "homie/sensor-1/climate/temperature/$name", Payload: []byte("Temperature")},
+		{Topic: "homie/sensor-1/climate/temperature/$datatype", Payload: []byte("float")},
+		{Topic: "homie/sensor-1/climate/temperature/$unit", Payload: []byte("°C")},
+		{Topic: "homie/sensor-1/climate/mode/$datatype", Payload: []byte("enum")},
+		{Topic: "homie/sensor-1/climate/mode/$format", Payload: []byte("off,auto")},
+		{Topic: "homie/sensor-1/climate/heating/$datatype", Payload: []byte("boolean")},
+		{Topic: "homie/sensor-1/light/$properties", Payload: []byte("label")},
+		{Topic: "homie/sensor-1/light/label/$datatype", Payload: []byte("string")},
+	}
+	tests := []struct {
+		name     string
+		messages []mqttclient.Message
+		want     []string
+		wantErr  bool
+	}{
+		{
+			name: "properties and state",
+			messages: append(attributes,
+				mqttclient.Message{Topic: "homie/sensor-1/$state", Payload: []byte("ready")},
+				mqttclient.Message{Topic: "homie/sensor-1/climate/temperature", Payload: []byte("21.5")},
+				mqttclient.Message{Topic: "homie/sensor-1/climate/mode", Payload: []byte("auto")},
+				mqttclient.Message{Topic: "homie/sensor-1/climate/heating", Payload: []byte("true")},
+				mqttclient.Message{Topic: "homie/sensor-1/light/label", Payload: []byte("on")},
+				mqttclient.Message{Topic: "homie/sensor-1/climate/heating/set", Payload: []byte("false")},
+			),
+			want: []string{
+				"climate_heating{friendly_name=Kitchen,sensor=sensor-1,topic=homie/sensor-1/climate/heating} 1 Homie property climate/heating",
+				"climate_mode{climate_mode=auto,friendly_name=Kitchen,sensor=sensor-1,topic=homie/sensor-1/climate/mode} 1 Homie property climate/mode",
+				"climate_mode{climate_mode=off,friendly_name=Kitchen,sensor=sensor-1,topic=homie/sensor-1/climate/mode} 0 Homie property climate/mode",
+				"climate_temperature_celsius{friendly_name=Kitchen Temperature,sensor=sensor-1,topic=homie/sensor-1/climate/temperature} 21.5 Homie property climate/temperature in °C",
+				"homie_device_state{homie_device_state=alert,sensor=sensor-1,topic=homie/sensor-1/$state} 0 State of the Homie device",
+				"homie_device_state{homie_device_state=disconnected,sensor=sensor-1,topic=homie/sensor-1/$state} 0 State of the Homie device",
+				"homie_device_state{homie_device_state=init,sensor=sensor-1,topic=homie/sensor-1/$state} 0 State of the Homie device",
+				"homie_device_state{homie_device_state=lost,sensor=sensor-1,topic=homie/sensor-1/$state} 0 State of the Homie device",
+				"homie_device_state{homie_device_state=ready,sensor=sensor-1,topic=homie/sensor-1/$state} 1 State of the Homie device",
+				"homie_device_state{homie_device_state=sleeping,sensor=sensor-1,topic=homie/sensor-1/$state} 0 State of the Homie device",
+			},
+		},
+		{
+			name: "value before the attributes",
+			messages: []mqttclient.Message{
+				{Topic: "homie/sensor-2/power/watts", Payload: []byte("12")},
+				{Topic: "homie/sensor-2/power/watts/$unit", Payload: []byte("W")},
+				{Topic: "homie/sensor-2/power/watts/$datatype", Payload: []byte("integer")},
+			},
+			want: []string{
+				"power_watts{friendly_name=,sensor=sensor-2,topic=homie/sensor-2/power/watts} 12 Homie property power/watts in W",
+			},
+		},
+		{
+			name: "unit after the value",
+			messages: []mqttclient.Message{
+				{Topic: "homie/sensor-3/climate/temperature/$datatype", Payload: []byte("float")},
+				{Topic: "homie/sensor-3/climate/temperature", Payload: []byte("21.5")},
+				{Topic: "homie/sensor-3/climate/temperature/$unit", Payload: []byte("°C")},
+			},
+			want: []string{
+				"climate_temperature_celsius{friendly_name=,sensor=sensor-3,topic=homie/sensor-3/climate/temperature} 21.5 Homie property climate/temperature in °C",
+			},
+		},
+		{
+			name: "datatype which is not exported anymore",
+			messages: []mqttclient.Message{
+				{Topic: "homie/sensor-3/climate/temperature/$datatype", Payload: []byte("float")},
+				{Topic: "homie/sensor-3/climate/temperature", Payload: []byte("21.5")},
+				{Topic: "homie/sensor-3/climate/temperature/$datatype", Payload: []byte("string")},
+			},
+		},
+		{
+			name: "property which is not announced",
+			messages: append(attributes,
+				mqttclient.Message{Topic: "homie/sensor-1/climate/humidity/$datatype", Payload: []byte("float")},
+				mqttclient.Message{Topic: "homie/sensor-1/climate/humidity", Payload: []byte("40")},
+				mqttclient.Message{Topic: "homie/sensor-1/battery/level/$datatype", Payload: []byte("integer")},
+				mqttclient.Message{Topic: "homie/sensor-1/battery/level", Payload: []byte("99")},
+			),
+		},
+		{
+			name: "unknown enum value",
+			messages: append(attributes,
+				mqttclient.Message{Topic: "homie/sensor-1/climate/mode", Payload: []byte("manual")},
+			),
+			wantErr: true,
+		},
+		{
+			name: "unknown state",
+			messages: []mqttclient.Message{
+				{Topic: "homie/sensor-1/$state", Payload: []byte("broken")},
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &config.HomieConfig{BaseTopic: "homie"}
+			c := NewCollector(time.Hour, nil, zap.NewNop())
+			extractor := NewHomieExtractor(NewParser(nil, ".", ""), cfg, NewHomieDevices(c))
+			ingest := NewIngest(c, nil, extractor, config.MustNewRegexp("^homie/(?P<deviceid>[^/]+)(/|$)"), nil)
+			var err error
+			for _, m := range tt.messages {
+				if storeErr := ingest.store(m); storeErr != nil {
+					err = storeErr
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("store() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+
+			reg := prometheus.NewRegistry()
+			reg.MustRegister(c)
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, family := range families {
+				if family.GetName() == "mqtt2prometheus_series_dropped_total" {
+					continue
+				}
+				for _, m := range family.GetMetric() {
+					var labels []string
+					for _, l := range m.GetLabel() {
+						labels = append(labels, l.GetName()+"="+l.GetValue())
+					}
+					got = append(got, fmt.Sprintf("%s{%s} %v %s", family.GetName(), strings.Join(labels, ","), m.GetGauge().GetValue(), family.GetHelp()))
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
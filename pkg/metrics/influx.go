@@ -0,0 +1,200 @@
+package metrics
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxLine is a single line of the InfluxDB line protocol:
+// <measurement>[,<tag>=<value>...] <field>=<value>[,<field>=<value>...] [<timestamp>]
+type influxLine struct {
+	measurement string
+	tags        map[string]string
+	fields      []influxField
+	// timestamp is zero if the line has no timestamp
+	timestamp time.Time
+}
+
+type influxField struct {
+	key   string
+	value interface{}
+}
+
+// NewInfluxLineExtractor extracts the configured metrics from InfluxDB line protocol payloads. The field keys, or
+// <measurement><separator><field key>, are matched against the mqtt_name of the metrics. Every line is a separate
+// series, the configured tags become labels.
+func NewInfluxLineExtractor(p Parser) Extractor {
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
+		lines, err := parseInfluxLines(string(payload))
+		if err != nil {
+			return nil, err
+		}
+		var mc MetricCollection
+		for _, line := range lines {
+			for _, field := range line.fields {
+				configs := p.findMetricConfigs(line.measurement+p.separator+field.key, deviceID)
+				if len(configs) == 0 {
+					configs = p.findMetricConfigs(field.key, deviceID)
+				}
+				for _, cfg := range configs {
+					series := line.seriesKey(cfg.TagLabels)
+					m, err := p.parseMetric(cfg, metricID(topic, series+" "+field.key, deviceID, cfg.PrometheusName), field.value, props)
+					if err != nil {
+						return nil, fmt.Errorf("failed to parse valid value from '%v' for metric %q: %w", field.value, cfg.PrometheusName, err)
+					}
+					if len(cfg.TagLabels) > 0 {
+						labels := make(map[string]string, len(m.Labels)+len(cfg.TagLabels))
+						for k, v := range m.Labels {
+							labels[k] = v
+						}
+						for _, tag := range cfg.TagLabels {
+							labels[tag] = line.tags[tag]
+						}
+						m.Labels = labels
+					}
+					if !line.timestamp.IsZero() && !m.IngestTime.IsZero() {
+						m.IngestTime = line.timestamp
+					}
+					m.Topic = topic
+					m.Path = series
+					mc = append(mc, m)
+				}
+			}
+		}
+		return mc, nil
+	}
+}
+
+// seriesKey identifies the series of the line by the measurement and the given tags.
+func (l influxLine) seriesKey(tags []string) string {
+	sorted := append([]string(nil), tags...)
+	sort.Strings(sorted)
+	key := l.measurement
+	for _, tag := range sorted {
+		key += "," + tag + "=" + l.tags[tag]
+	}
+	return key
+}
+
+// parseInfluxLines parses all lines of the payload. Empty lines and comments are skipped.
+func parseInfluxLines(payload string) ([]influxLine, error) {
+	var lines []influxLine
+	for i, raw := range strings.Split(payload, "\n") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" || strings.HasPrefix(raw, "#") {
+			continue
+		}
+		line, err := parseInfluxLine(raw)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) == 0 {
+		return nil, fmt.Errorf("payload contains no lines")
+	}
+	return lines, nil
+}
+
+func parseInfluxLine(raw string) (influxLine, error) {
+	sections := splitInflux(raw, ' ')
+	if len(sections) < 2 || len(sections) > 3 {
+		return influxLine{}, fmt.Errorf("expected measurement, fields and an optional timestamp, got %d sections", len(sections))
+	}
+	series := splitInflux(sections[0], ',')
+	line := influxLine{
+		measurement: unescapeInflux(series[0]),
+		tags:        make(map[string]string, len(series)-1),
+	}
+	if line.measurement == "" {
+		return influxLine{}, fmt.Errorf("empty measurement")
+	}
+	for _, tag := range series[1:] {
+		key, value, ok := cutInflux(tag)
+		if !ok {
+			return influxLine{}, fmt.Errorf("invalid tag %q", tag)
+		}
+		line.tags[key] = unescapeInflux(value)
+	}
+	for _, field := range splitInflux(sections[1], ',') {
+		key, raw, ok := cutInflux(field)
+		if !ok {
+			return influxLine{}, fmt.Errorf("invalid field %q", field)
+		}
+		value, err := parseInfluxValue(raw)
+		if err != nil {
+			return influxLine{}, fmt.Errorf("field %q: %w", key, err)
+		}
+		line.fields = append(line.fields, influxField{key: key, value: value})
+	}
+	if len(sections) == 3 {
+		ns, err := strconv.ParseInt(sections[2], 10, 64)
+		if err != nil {
+			return influxLine{}, fmt.Errorf("invalid timestamp %q", sections[2])
+		}
+		line.timestamp = time.Unix(0, ns)
+	}
+	return line, nil
+}
+
+// parseInfluxValue converts a field value to a float64, bool or string.
+func parseInfluxValue(raw string) (interface{}, error) {
+	switch {
+	case len(raw) >= 2 && raw[0] == '"' && raw[len(raw)-1] == '"':
+		return strings.NewReplacer(`\"`, `"`, `\\`, `\`).Replace(raw[1 : len(raw)-1]), nil
+	case strings.HasSuffix(raw, "i"):
+		i, err := strconv.ParseInt(strings.TrimSuffix(raw, "i"), 10, 64)
+		return float64(i), err
+	case strings.HasSuffix(raw, "u"):
+		u, err := strconv.ParseUint(strings.TrimSuffix(raw, "u"), 10, 64)
+		return float64(u), err
+	}
+	switch raw {
+	case "t", "T", "true", "True", "TRUE":
+		return true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return false, nil
+	}
+	return strconv.ParseFloat(raw, 64)
+}
+
+// splitInflux splits s at every unescaped separator outside of double quotes.
+func splitInflux(s string, sep byte) []string {
+	var parts []string
+	var quoted bool
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// cutInflux splits a tag or field at the first unescaped equal sign. The key is unescaped, the value is not.
+func cutInflux(s string) (key, value string, ok bool) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '=':
+			key = unescapeInflux(s[:i])
+			return key, s[i+1:], key != "" && i+1 < len(s)
+		}
+	}
+	return "", "", false
+}
+
+// unescapeInflux removes the backslashes of escaped commas, equal signs and spaces.
+func unescapeInflux(s string) string {
+	return strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ").Replace(s)
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestNewInfluxLineExtractor(t *testing.T) {
+	now = testNow
+	defer func() { now = time.Now }()
+	metricConfigs := []config.MetricConfig{
+		{PrometheusName: "temperature", MQTTName: "weather.temp", ValueType: config.GaugeValueType, TagLabels: []string{"station"}},
+		{PrometheusName: "humidity", MQTTName: "hum", ValueType: config.GaugeValueType, TagLabels: []string{"station"}},
+		{PrometheusName: "count", MQTTName: "count", ValueType: config.CounterValueType},
+		{PrometheusName: "open", MQTTName: "open", ValueType: config.GaugeValueType},
+		{PrometheusName: "state", MQTTName: "state", ValueType: config.GaugeValueType, StringValueMapping: &config.StringValueMappingConfig{Map: map[string]float64{"on": 1, "off": 0}}},
+	}
+	extractor := NewInfluxLineExtractor(NewParser(metricConfigs, ".", ""))
+	// weather returns a metric with the station tag as label
+	weather := func(name string, value float64, ingestTime time.Time, station string) Metric {
+		return Metric{
+			Description: prometheus.NewDesc(name, "", []string{"sensor", "topic", "station"}, nil),
+			Value:       value,
+			ValueType:   prometheus.GaugeValue,
+			IngestTime:  ingestTime,
+			Topic:       "sensors/weather",
+			Labels:      map[string]string{"station": station},
+			LabelsKeys:  []string{"station"},
+			Path:        "weather,station=" + station,
+		}
+	}
+	untagged := func(name string, value float64, valueType prometheus.ValueType, path string) Metric {
+		return Metric{
+			Description: prometheus.NewDesc(name, "", []string{"sensor", "topic"}, nil),
+			Value:       value,
+			ValueType:   valueType,
+			IngestTime:  testNow(),
+			Topic:       "sensors/weather",
+			Path:        path,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		payload string
+		want    MetricCollection
+		wantErr bool
+	}{
+		{
+			name:    "fields, tags and timestamp",
+			payload: "weather,station=a,unused=x temp=21.5,hum=40i 1600000000000000000",
+			want: MetricCollection{
+				weather("temperature", 21.5, time.Unix(1600000000, 0), "a"),
+				weather("humidity", 40, time.Unix(1600000000, 0), "a"),
+			},
+		},
+		{
+			name:    "multiple lines",
+			payload: "# comment\nweather,station=a temp=21.5\n\nweather,station=b temp=19 1600000001000000000\n",
+			want: MetricCollection{
+				weather("temperature", 21.5, testNow(), "a"),
+				weather("temperature", 19, time.Unix(1600000001, 0), "b"),
+			},
+		},
+		{
+			name:    "measurement does not match",
+			payload: "indoor temp=22,count=3u",
+			want: MetricCollection{
+				untagged("count", 3, prometheus.CounterValue, "indoor"),
+			},
+		},
+		{
+			name:    "booleans and strings",
+			payload: `door open=t,state="on",ignored="a b"`,
+			want: MetricCollection{
+				untagged("open", 1, prometheus.GaugeValue, "door"),
+				untagged("state", 1, prometheus.GaugeValue, "door"),
+			},
+		},
+		{
+			name:    "escaped tags",
+			payload: `weather,station=north\ side\,1 temp=20`,
+			want: MetricCollection{
+				weather("temperature", 20, testNow(), "north side,1"),
+			},
+		},
+		{
+			name:    "missing tag",
+			payload: "weather temp=20",
+			want: MetricCollection{
+				weather("temperature", 20, testNow(), ""),
+			},
+		},
+		{
+			name:    "missing fields",
+			payload: "weather,station=a",
+			wantErr: true,
+		},
+		{
+			name:    "invalid field value",
+			payload: "weather temp=warm",
+			wantErr: true,
+		},
+		{
+			name:    "invalid timestamp",
+			payload: "weather temp=20 yesterday",
+			wantErr: true,
+		},
+		{
+			name:    "unmapped string",
+			payload: `door state="unknown"`,
+			wantErr: true,
+		},
+		{
+			name:    "empty payload",
+			payload: "\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc, err := extractor("sensors/weather", []byte(tt.payload), "weather", MessageProperties{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractor() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(mc, tt.want) {
+				t.Errorf("got\n%+v\nwant\n%+v", mc, tt.want)
+			}
+		})
+	}
+}
@@ -2,54 +2,111 @@ package metrics
 
 import (
 	"fmt"
+	"hash/fnv"
+	"sync"
+
 	"go.uber.org/zap"
 
-	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
 )
 
 type Ingest struct {
 	instrumentation
+	lock          sync.Mutex
+	inFlight      sync.WaitGroup
 	extractor     Extractor
 	deviceIDRegex *config.Regexp
+	sharding      *config.ShardingConfig
 	collector     Collector
+	devices       *DeviceTracker
 	logger        *zap.Logger
 }
 
-func NewIngest(collector Collector, extractor Extractor, deviceIDRegex *config.Regexp) *Ingest {
+// NewIngest creates an ingest which stores the metrics of all devices. If sharding is not nil, only the devices of the
+// configured shard are stored. The messages of the stored devices are recorded by the device tracker.
+func NewIngest(collector Collector, devices *DeviceTracker, extractor Extractor, deviceIDRegex *config.Regexp, sharding *config.ShardingConfig) *Ingest {
 
 	return &Ingest{
 		instrumentation: defaultInstrumentation,
 		extractor:       extractor,
 		deviceIDRegex:   deviceIDRegex,
+		sharding:        sharding,
 		collector:       collector,
+		devices:         devices,
 		logger:          config.ProcessContext.Logger(),
 	}
 }
 
-func (i *Ingest) store(topic string, payload []byte) error {
-	deviceID := i.deviceID(topic)
-	mc, err := i.extractor(topic, payload, deviceID)
+// Update replaces the extractor and the device ID regex. Messages which are processed during the update are finished
+// with the previous settings.
+func (i *Ingest) Update(extractor Extractor, deviceIDRegex *config.Regexp) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.extractor = extractor
+	i.deviceIDRegex = deviceIDRegex
+}
+
+func (i *Ingest) store(m mqttclient.Message) error {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	deviceID := i.deviceID(m.Topic)
+	if !i.ownsDevice(deviceID) {
+		i.CountOtherShard(m.Topic)
+		return nil
+	}
+	mc, err := i.extractor(m.Topic, m.Payload, deviceID, MessageProperties{
+		ContentType:    m.ContentType,
+		UserProperties: m.UserProperties,
+	})
+	if i.devices != nil && deviceID != "" {
+		i.devices.Seen(deviceID, err != nil)
+	}
 	if err != nil {
 		return fmt.Errorf("failed to extract metric values from topic: %w", err)
 	}
+	if m.Expiry > 0 {
+		for j := range mc {
+			mc[j].Expiry = m.Expiry
+		}
+	}
 	i.collector.Observe(deviceID, mc)
+	i.CountSuccess(m.Topic)
 	return nil
 }
 
-func (i *Ingest) SetupSubscriptionHandler(errChan chan<- error) mqtt.MessageHandler {
-	return func(c mqtt.Client, m mqtt.Message) {
-		i.logger.Debug("Got message", zap.String("topic", m.Topic()), zap.String("payload", string(m.Payload())))
-		err := i.store(m.Topic(), m.Payload())
+func (i *Ingest) SetupSubscriptionHandler(errChan chan<- error) mqttclient.MessageHandler {
+	return func(m mqttclient.Message) {
+		i.inFlight.Add(1)
+		defer i.inFlight.Done()
+		i.logger.Debug("Got message", zap.String("topic", m.Topic), zap.String("payload", string(m.Payload)))
+		err := i.store(m)
 		if err != nil {
-			errChan <- fmt.Errorf("could not store metrics '%s' on topic %s: %s", string(m.Payload()), m.Topic(), err.Error())
-			i.CountStoreError(m.Topic())
-			return
+			errChan <- fmt.Errorf("could not store metrics '%s' on topic %s: %s", string(m.Payload), m.Topic, err.Error())
+			i.CountStoreError(m.Topic)
 		}
-		i.CountSuccess(m.Topic())
 	}
 }
 
+// Drain blocks until all messages which are currently processed are stored.
+func (i *Ingest) Drain() {
+	i.inFlight.Wait()
+}
+
+// ownsDevice reports whether the device belongs to the configured shard.
+func (i *Ingest) ownsDevice(deviceID string) bool {
+	return ownsDevice(i.sharding, deviceID)
+}
+
+func ownsDevice(sharding *config.ShardingConfig, deviceID string) bool {
+	if sharding == nil {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(deviceID)) //nolint:errcheck
+	return uint(h.Sum32())%sharding.Shards == sharding.Index
+}
+
 // deviceID uses the configured DeviceIDRegex to extract the device ID from the given mqtt topic path.
 func (i *Ingest) deviceID(topic string) string {
 	return i.deviceIDRegex.GroupValue(topic, config.DeviceIDRegexGroup)
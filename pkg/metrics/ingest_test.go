@@ -0,0 +1,36 @@
+package metrics
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+func TestIngest_ownsDevice(t *testing.T) {
+	const shards = 3
+	owned := make([]int, shards)
+	for d := 0; d < 300; d++ {
+		deviceID := fmt.Sprintf("device-%d", d)
+		owners := 0
+		for index := uint(0); index < shards; index++ {
+			i := Ingest{sharding: &config.ShardingConfig{Shards: shards, Index: index}}
+			if i.ownsDevice(deviceID) {
+				owners++
+				owned[index]++
+			}
+		}
+		if owners != 1 {
+			t.Errorf("device %q is owned by %d shards, want exactly one", deviceID, owners)
+		}
+	}
+	for index, n := range owned {
+		if n == 0 {
+			t.Errorf("shard %d owns no device", index)
+		}
+	}
+
+	if i := (Ingest{}); !i.ownsDevice("device-0") {
+		t.Errorf("ingest without sharding must own every device")
+	}
+}
@@ -1,13 +1,16 @@
 package metrics
 
 import (
-	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"strconv"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
 	"github.com/prometheus/client_golang/prometheus"
 )
 
 const (
 	storeError = "storeError"
 	success    = "success"
+	otherShard = "otherShard"
 )
 
 var defaultInstrumentation = instrumentation{
@@ -51,10 +54,34 @@ func (i *instrumentation) CountStoreError(topic string) {
 	i.messageMetric.WithLabelValues(storeError, topic).Inc()
 }
 
-func (i *instrumentation) ConnectionLostHandler(client mqtt.Client, err error) {
+func (i *instrumentation) CountOtherShard(topic string) {
+	i.messageMetric.WithLabelValues(otherShard, topic).Inc()
+}
+
+func (i *instrumentation) ConnectionLostHandler(err error) {
 	i.connectedMetric.Set(0)
 }
 
-func (i *instrumentation) OnConnectHandler(client mqtt.Client) {
+func (i *instrumentation) OnConnectHandler() {
 	i.connectedMetric.Set(1)
 }
+
+// NewShardInfo returns a collector which exposes the shard of this exporter instance.
+func NewShardInfo(sharding *config.ShardingConfig, sharedGroup string) prometheus.Collector {
+	labels := prometheus.Labels{
+		"shard":                     "0",
+		"shards":                    "1",
+		"shared_subscription_group": sharedGroup,
+	}
+	if sharding != nil {
+		labels["shard"] = strconv.FormatUint(uint64(sharding.Index), 10)
+		labels["shards"] = strconv.FormatUint(uint64(sharding.Shards), 10)
+	}
+	info := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name:        "mqtt2prometheus_shard_info",
+		Help:        "The shard of the devices handled by this exporter instance",
+		ConstLabels: labels,
+	})
+	info.Set(1)
+	return info
+}
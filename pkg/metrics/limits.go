@@ -0,0 +1,196 @@
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// limitLogInterval is the minimum time between two log messages about the same limit
+const limitLogInterval = time.Minute
+
+const (
+	globalLimit = "global"
+	metricLimit = "metric"
+	deviceLimit = "device"
+)
+
+// seriesLimiter tracks the cached series to enforce the series limits.
+type seriesLimiter struct {
+	lock sync.Mutex
+	cfg  config.SeriesLimitConfig
+	// metrics are the names and limits of the possible metrics by description
+	metrics   map[string]limitedMetric
+	series    map[string]*trackedSeries
+	perMetric map[string]int
+	perDevice map[string]int
+	// lastLogged and suppressed rate limit the log messages per limit
+	lastLogged    map[string]time.Time
+	suppressed    map[string]int
+	droppedMetric *prometheus.CounterVec
+	logger        *zap.Logger
+}
+
+type limitedMetric struct {
+	name      string
+	maxSeries int
+}
+
+type trackedSeries struct {
+	device     string
+	metric     string
+	lastUpdate time.Time
+	// expires is zero if the series never expires
+	expires time.Time
+}
+
+func newSeriesLimiter(cfg *config.SeriesLimitConfig, possibleMetrics []config.MetricConfig, logger *zap.Logger) *seriesLimiter {
+	l := &seriesLimiter{
+		cfg:        config.SeriesLimitConfig{Policy: config.DropNewSeriesPolicy},
+		series:     make(map[string]*trackedSeries),
+		perMetric:  make(map[string]int),
+		perDevice:  make(map[string]int),
+		lastLogged: make(map[string]time.Time),
+		suppressed: make(map[string]int),
+		droppedMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt2prometheus_series_dropped_total",
+			Help: "Total number of series dropped or evicted because a series limit was reached",
+		}, []string{"limit"}),
+		logger: logger,
+	}
+	if cfg != nil {
+		l.cfg = *cfg
+	}
+	l.update(possibleMetrics)
+	return l
+}
+
+// update replaces the per metric limits.
+func (l *seriesLimiter) update(possibleMetrics []config.MetricConfig) {
+	metrics := make(map[string]limitedMetric, len(possibleMetrics))
+	for _, m := range possibleMetrics {
+		max := l.cfg.MaxSeriesPerMetric
+		if m.MaxSeries > 0 {
+			max = m.MaxSeries
+		}
+		metrics[m.PrometheusDescription().String()] = limitedMetric{name: m.PrometheusName, maxSeries: max}
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.metrics = metrics
+}
+
+// admit reports whether the series with the given cache key may be cached. New series are only admitted if they do not
+// exceed a limit. With the evict_oldest policy, the least recently updated series are evicted to make room; their
+// keys are returned and must be deleted from the cache.
+func (l *seriesLimiter) admit(key, device, metric string, expires time.Time) ([]string, bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := now()
+	if s, ok := l.series[key]; ok {
+		s.lastUpdate = now
+		s.expires = expires
+		return nil, true
+	}
+
+	limit := l.exceeded(device, metric)
+	if limit != "" {
+		l.removeExpired(now)
+		limit = l.exceeded(device, metric)
+	}
+	var evicted []string
+	for limit != "" {
+		l.droppedMetric.WithLabelValues(limit).Inc()
+		l.logLimit(limit, device, metric, now)
+		if l.cfg.Policy != config.EvictOldestSeriesPolicy {
+			return nil, false
+		}
+		oldest := l.oldest(limit, device, metric)
+		l.removeLocked(oldest)
+		evicted = append(evicted, oldest)
+		limit = l.exceeded(device, metric)
+	}
+
+	l.series[key] = &trackedSeries{device: device, metric: metric, lastUpdate: now, expires: expires}
+	l.perMetric[metric]++
+	l.perDevice[device]++
+	return evicted, true
+}
+
+// exceeded returns the first limit which a new series of the device and metric would exceed.
+func (l *seriesLimiter) exceeded(device, metric string) string {
+	if l.cfg.MaxSeries > 0 && len(l.series) >= l.cfg.MaxSeries {
+		return globalLimit
+	}
+	if max := l.metrics[metric].maxSeries; max > 0 && l.perMetric[metric] >= max {
+		return metricLimit
+	}
+	if l.cfg.MaxSeriesPerDevice > 0 && l.perDevice[device] >= l.cfg.MaxSeriesPerDevice {
+		return deviceLimit
+	}
+	return ""
+}
+
+// oldest returns the key of the least recently updated series counting towards the given limit.
+func (l *seriesLimiter) oldest(limit, device, metric string) string {
+	var oldest string
+	var oldestUpdate time.Time
+	for key, s := range l.series {
+		if (limit == metricLimit && s.metric != metric) || (limit == deviceLimit && s.device != device) {
+			continue
+		}
+		if oldest == "" || s.lastUpdate.Before(oldestUpdate) {
+			oldest, oldestUpdate = key, s.lastUpdate
+		}
+	}
+	return oldest
+}
+
+// removeExpired forgets the series which expired in the cache, but were not cleaned up yet.
+func (l *seriesLimiter) removeExpired(now time.Time) {
+	for key, s := range l.series {
+		if !s.expires.IsZero() && s.expires.Before(now) {
+			l.removeLocked(key)
+		}
+	}
+}
+
+func (l *seriesLimiter) logLimit(limit, device, metric string, now time.Time) {
+	if now.Sub(l.lastLogged[limit]) < limitLogInterval {
+		l.suppressed[limit]++
+		return
+	}
+	l.logger.Warn("series limit reached",
+		zap.String("limit", limit),
+		zap.String("policy", l.cfg.Policy),
+		zap.String("device", device),
+		zap.String("metric", l.metrics[metric].name),
+		zap.Int("suppressed_messages", l.suppressed[limit]),
+	)
+	l.lastLogged[limit] = now
+	l.suppressed[limit] = 0
+}
+
+// remove forgets the series after it was deleted from the cache.
+func (l *seriesLimiter) remove(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.removeLocked(key)
+}
+
+func (l *seriesLimiter) removeLocked(key string) {
+	s, ok := l.series[key]
+	if !ok {
+		return
+	}
+	delete(l.series, key)
+	if l.perMetric[s.metric]--; l.perMetric[s.metric] == 0 {
+		delete(l.perMetric, s.metric)
+	}
+	if l.perDevice[s.device]--; l.perDevice[s.device] == 0 {
+		delete(l.perDevice, s.device)
+	}
+}
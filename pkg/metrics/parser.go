@@ -7,6 +7,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/expr-lang/expr"
@@ -40,6 +41,8 @@ type metricState struct {
 	lastWritten time.Time
 	// Compiled evaluation expression
 	program *vm.Program
+	// Source code of the compiled expression
+	code string
 	// Environment in which the expression is evaluated
 	env map[string]interface{}
 }
@@ -53,6 +56,8 @@ type Parser struct {
 	stateDir string
 	// Per-metric state
 	states map[string]*metricState
+	// Guards states, shared by all copies of the parser
+	stateLock *sync.Mutex
 }
 
 // Identifiers within the expression evaluation environment.
@@ -62,6 +67,8 @@ const (
 	env_last_value     = "last_value"
 	env_last_raw_value = "last_raw_value"
 	env_last_result    = "last_result"
+	env_content_type   = "content_type"
+	env_user_props     = "user_properties"
 	env_elapsed        = "elapsed"
 	env_now            = "now"
 	env_int            = "int"
@@ -159,9 +166,33 @@ func NewParser(metrics []config.MetricConfig, separator, stateDir string) Parser
 		metricConfigs: cfgs,
 		stateDir:      strings.TrimRight(stateDir, "/"),
 		states:        make(map[string]*metricState),
+		stateLock:     &sync.Mutex{},
 	}
 }
 
+// InheritState makes the parser share the per-metric state of the given parser. This keeps the state of expressions
+// and monotonic metrics in memory when the parser is rebuilt during a config reload.
+func (p *Parser) InheritState(previous Parser) {
+	if p.stateDir != previous.stateDir || previous.stateLock == nil {
+		return
+	}
+	p.states = previous.states
+	p.stateLock = previous.stateLock
+}
+
+// WriteState writes the state of all metrics back to the state directory.
+func (p *Parser) WriteState() error {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
+	for metricID, state := range p.states {
+		if err := p.writeMetricState(metricID, state); err != nil {
+			return err
+		}
+		state.lastWritten = now()
+	}
+	return nil
+}
+
 // Config returns the underlying metrics config
 func (p *Parser) config() map[string][]*config.MetricConfig {
 	return p.metricConfigs
@@ -180,11 +211,17 @@ func (p *Parser) findMetricConfigs(metric string, deviceID string) []*config.Met
 
 // parseMetric parses the given value according to the given deviceID and metricPath. The config allows to
 // parse a metric value according to the device ID.
-func (p *Parser) parseMetric(cfg *config.MetricConfig, metricID string, value interface{}) (Metric, error) {
+func (p *Parser) parseMetric(cfg *config.MetricConfig, metricID string, value interface{}, props MessageProperties) (Metric, error) {
 	var metricValue float64
+	var stateValue string
 	var err error
 
-	if cfg.RawExpression != "" {
+	if cfg.StringValued() {
+		if stateValue, err = parseState(cfg, value); err != nil {
+			return Metric{}, err
+		}
+		metricValue = 1
+	} else if cfg.RawExpression != "" {
 		if metricValue, err = p.evalExpressionValue(metricID, cfg.RawExpression, value, metricValue); err != nil {
 			if cfg.ErrorValue != nil {
 				metricValue = *cfg.ErrorValue
@@ -202,8 +239,12 @@ func (p *Parser) parseMetric(cfg *config.MetricConfig, metricID string, value in
 			}
 		} else if strValue, ok := value.(string); ok {
 
+			// NaN and infinite values of binary payloads are passed as strings, they are not mapped
+			if strValue == "NaN" || strValue == "+Inf" || strValue == "-Inf" {
+				metricValue, _ = strconv.ParseFloat(strValue, 64)
+
 			// If string value mapping is defined, use that
-			if cfg.StringValueMapping != nil {
+			} else if cfg.StringValueMapping != nil {
 
 				floatValue, ok := cfg.StringValueMapping.Map[strValue]
 				if ok {
@@ -277,13 +318,19 @@ func (p *Parser) parseMetric(cfg *config.MetricConfig, metricID string, value in
 	if len(cfg.DynamicLabels) > 0 {
 		labels = make(map[string]string, len(cfg.DynamicLabels))
 		for k, v := range cfg.DynamicLabels {
-			value, err := p.evalExpressionLabel(metricID, k, v, value, metricValue)
+			value, err := p.evalExpressionLabel(metricID, k, v, value, metricValue, props)
 			if err != nil {
 				return Metric{}, err
 			}
 			labels[k] = value
 		}
 	}
+	if stateLabel := cfg.StateLabel(); stateLabel != "" {
+		if labels == nil {
+			labels = make(map[string]string, 1)
+		}
+		labels[stateLabel] = stateValue
+	}
 
 	return Metric{
 		Description: cfg.PrometheusDescription(),
@@ -291,10 +338,35 @@ func (p *Parser) parseMetric(cfg *config.MetricConfig, metricID string, value in
 		ValueType:   cfg.PrometheusValueType(),
 		IngestTime:  ingestTime,
 		Labels:      labels,
-		LabelsKeys:  cfg.DynamicLabelsKeys(),
+		LabelsKeys:  cfg.LabelsKeys(),
+		States:      cfg.States,
 	}, nil
 }
 
+// parseState converts the value of an info or stateset metric to a string.
+func parseState(cfg *config.MetricConfig, value interface{}) (string, error) {
+	var state string
+	switch v := value.(type) {
+	case string:
+		state = v
+	case bool:
+		state = strconv.FormatBool(v)
+	case float64:
+		state = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return "", fmt.Errorf("got data with unexpectd type: %T ('%v')", value, value)
+	}
+	if cfg.ValueType != config.StateSetValueType {
+		return state, nil
+	}
+	for _, s := range cfg.States {
+		if s == state {
+			return state, nil
+		}
+	}
+	return "", fmt.Errorf("got unexpected state '%s'", state)
+}
+
 func (p *Parser) stateFileName(metricID string) string {
 	return fmt.Sprintf("%s/%s.yaml", p.stateDir, metricID)
 }
@@ -366,6 +438,8 @@ func (p *Parser) getMetricState(metricID string) (*metricState, error) {
 // enforceMonotonicy makes sure the given values never decrease from one call to the next.
 // If the current value is smaller than the last one, a consistent offset is added.
 func (p *Parser) enforceMonotonicy(metricID string, value float64) (float64, error) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
 	ms, err := p.getMetricState(metricID)
 	if err != nil {
 		return value, err
@@ -384,16 +458,19 @@ func (p *Parser) enforceMonotonicy(metricID string, value float64) (float64, err
 // evalExpressionValue runs the given code in the metric's environment and returns the result.
 // In case of an error, the original value is returned.
 func (p *Parser) evalExpressionValue(metricID, code string, raw_value interface{}, value float64) (float64, error) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
 	ms, err := p.getMetricState(metricID)
 	if err != nil {
 		return value, err
 	}
-	if ms.program == nil {
+	if ms.program == nil || ms.code != code {
 		ms.env = defaultExprEnv()
 		ms.program, err = expr.Compile(code, expr.Env(ms.env), expr.AsFloat64())
 		if err != nil {
 			return value, fmt.Errorf("failed to compile expression %q: %w", code, err)
 		}
+		ms.code = code
 		// Trigger flushing the new state to disk.
 		ms.lastWritten = time.Time{}
 	}
@@ -428,17 +505,22 @@ func (p *Parser) evalExpressionValue(metricID, code string, raw_value interface{
 
 // evalExpressionLabel runs the given code in the metric's environment and returns the result.
 // In case of an error, the original value is returned.
-func (p *Parser) evalExpressionLabel(metricID, label, code string, rawValue interface{}, value float64) (string, error) {
+func (p *Parser) evalExpressionLabel(metricID, label, code string, rawValue interface{}, value float64, props MessageProperties) (string, error) {
+	p.stateLock.Lock()
+	defer p.stateLock.Unlock()
 	ms, err := p.getMetricState(label + "@" + metricID)
 	if err != nil {
 		return "", err
 	}
-	if ms.program == nil {
+	if ms.program == nil || ms.code != code {
 		ms.env = defaultExprEnv()
+		ms.env[env_content_type] = ""
+		ms.env[env_user_props] = map[string]string{}
 		ms.program, err = expr.Compile(code, expr.Env(ms.env))
 		if err != nil {
 			return "", fmt.Errorf("failed to compile dynamic label expression %q: %w", code, err)
 		}
+		ms.code = code
 		// Trigger flushing the new state to disk.
 		ms.lastWritten = time.Time{}
 	}
@@ -449,6 +531,12 @@ func (p *Parser) evalExpressionLabel(metricID, label, code string, rawValue inte
 	ms.env[env_last_value] = ms.dynamic.LastExprValue
 	ms.env[env_last_raw_value] = ms.dynamic.LastExprRawValue
 	ms.env[env_last_result] = ms.dynamic.LastExprResultString
+	ms.env[env_content_type] = props.ContentType
+	if props.UserProperties != nil {
+		ms.env[env_user_props] = props.UserProperties
+	} else {
+		ms.env[env_user_props] = map[string]string{}
+	}
 	if ms.dynamic.LastExprTimestamp.IsZero() {
 		ms.env[env_elapsed] = time.Duration(0)
 	} else {
@@ -741,7 +741,7 @@ func TestParser_parseMetric(t *testing.T) {
 			config := configs[0]
 
 			id := metricID("", tt.args.metricPath, tt.args.deviceID, config.PrometheusName)
-			got, err := p.parseMetric(config, id, tt.args.value)
+			got, err := p.parseMetric(config, id, tt.args.value, MessageProperties{})
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -865,3 +865,141 @@ func TestParser_evalExpression(t *testing.T) {
 		})
 	}
 }
+
+func TestParser_WriteState(t *testing.T) {
+	now = testNow
+	stateDir := t.TempDir()
+	cfg := config.MetricConfig{
+		PrometheusName:  "total_energy",
+		MQTTName:        "total",
+		ValueType:       "counter",
+		ForceMonotonicy: true,
+	}
+
+	p := NewParser([]config.MetricConfig{cfg}, ".", stateDir)
+	id := metricID("topic", "total", "shelly", cfg.PrometheusName)
+	for _, v := range []float64{10, 2} {
+		if _, err := p.parseMetric(&cfg, id, v, MessageProperties{}); err != nil {
+			t.Fatalf("parseMetric() error = %v", err)
+		}
+	}
+	if err := p.WriteState(); err != nil {
+		t.Fatalf("WriteState() error = %v", err)
+	}
+
+	// A new parser must continue with the flushed offset.
+	restarted := NewParser([]config.MetricConfig{cfg}, ".", stateDir)
+	got, err := restarted.parseMetric(&cfg, id, 3.0, MessageProperties{})
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	if got.Value != 13 {
+		t.Errorf("parseMetric() after restart got = %v, want %v", got.Value, 13)
+	}
+}
+
+func TestParser_parseMetricMessageProperties(t *testing.T) {
+	now = testNow
+	cfg := config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      "gauge",
+		OmitTimestamp:  true,
+		DynamicLabels: map[string]string{
+			"content_type": "content_type",
+			"room":         `"room" in user_properties ? user_properties["room"] : "unknown"`,
+		},
+	}
+	p := NewParser([]config.MetricConfig{cfg}, ".", t.TempDir())
+	id := metricID("topic", "temperature", "dht22", cfg.PrometheusName)
+
+	got, err := p.parseMetric(&cfg, id, 12.6, MessageProperties{
+		ContentType:    "application/json",
+		UserProperties: map[string]string{"room": "kitchen"},
+	})
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	want := map[string]string{"content_type": "application/json", "room": "kitchen"}
+	if !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("parseMetric() got labels = %v, want %v", got.Labels, want)
+	}
+
+	// MQTT 3 messages have no properties.
+	got, err = p.parseMetric(&cfg, id, 12.6, MessageProperties{})
+	if err != nil {
+		t.Fatalf("parseMetric() error = %v", err)
+	}
+	want = map[string]string{"content_type": "", "room": "unknown"}
+	if !reflect.DeepEqual(got.Labels, want) {
+		t.Errorf("parseMetric() got labels = %v, want %v", got.Labels, want)
+	}
+}
+
+func TestParser_parseMetricStringValued(t *testing.T) {
+	now = testNow
+	firmware := config.MetricConfig{PrometheusName: "firmware_info", ValueType: config.InfoValueType, InfoLabel: "version", OmitTimestamp: true}
+	power := config.MetricConfig{PrometheusName: "power", ValueType: config.StateSetValueType, States: []string{"on", "off"}, OmitTimestamp: true}
+	tests := []struct {
+		name    string
+		cfg     config.MetricConfig
+		value   interface{}
+		want    Metric
+		wantErr bool
+	}{
+		{
+			name:  "info",
+			cfg:   firmware,
+			value: "1.2.3",
+			want: Metric{
+				Description: firmware.PrometheusDescription(),
+				Value:       1,
+				ValueType:   prometheus.GaugeValue,
+				Labels:      map[string]string{"version": "1.2.3"},
+				LabelsKeys:  []string{"version"},
+			},
+		},
+		{
+			name:  "info from number",
+			cfg:   firmware,
+			value: 12.5,
+			want: Metric{
+				Description: firmware.PrometheusDescription(),
+				Value:       1,
+				ValueType:   prometheus.GaugeValue,
+				Labels:      map[string]string{"version": "12.5"},
+				LabelsKeys:  []string{"version"},
+			},
+		},
+		{
+			name:  "stateset",
+			cfg:   power,
+			value: "off",
+			want: Metric{
+				Description: power.PrometheusDescription(),
+				Value:       1,
+				ValueType:   prometheus.GaugeValue,
+				Labels:      map[string]string{"power": "off"},
+				LabelsKeys:  []string{"power"},
+				States:      []string{"on", "off"},
+			},
+		},
+		{
+			name:    "unknown state",
+			cfg:     power,
+			value:   "standby",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewParser([]config.MetricConfig{tt.cfg}, ".", t.TempDir())
+			got, err := p.parseMetric(&tt.cfg, metricID("topic", "metric", "device", tt.cfg.PrometheusName), tt.value, MessageProperties{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMetric() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseMetric() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+// pathMatch is a value found for a mqtt_name path with wildcard segments.
+type pathMatch struct {
+	// path is the mqtt_name path with the wildcards replaced by the matched keys and indices.
+	path   string
+	value  interface{}
+	labels map[string]string
+}
+
+// expandPath returns all values of the decoded JSON document matching the given path. Every wildcard segment matches
+// all keys of an object or all elements of an array. Each match is labeled by the corresponding wildcard label.
+func expandPath(doc interface{}, path, separator string, wildcardLabels []config.WildcardLabelConfig) []pathMatch {
+	var matches []pathMatch
+	var walk func(node interface{}, segments []string, matched []string, labels map[string]string)
+	walk = func(node interface{}, segments []string, matched []string, labels map[string]string) {
+		if len(segments) == 0 {
+			if node != nil {
+				matches = append(matches, pathMatch{path: strings.Join(matched, separator), value: node, labels: labels})
+			}
+			return
+		}
+		segment := segments[0]
+		if segment != config.WildcardPathSegment {
+			if child, ok := childNode(node, segment); ok {
+				walk(child, segments[1:], append(matched, segment), labels)
+			}
+			return
+		}
+
+		label := wildcardLabels[len(labels)]
+		for _, key := range childKeys(node) {
+			child, _ := childNode(node, key)
+			value := key
+			if label.Field != "" {
+				field, ok := lookupPath(child, label.Field, separator)
+				if !ok {
+					// without the label value, the series could not be distinguished
+					continue
+				}
+				value = labelValue(field)
+			}
+			childLabels := make(map[string]string, len(labels)+1)
+			for k, v := range labels {
+				childLabels[k] = v
+			}
+			childLabels[label.Name] = value
+			walk(child, segments[1:], append(matched[:len(matched):len(matched)], key), childLabels)
+		}
+	}
+	walk(doc, strings.Split(path, separator), nil, map[string]string{})
+	return matches
+}
+
+// walkLeaves calls fn for every numeric or boolean leaf of the decoded JSON document with its path.
+func walkLeaves(node interface{}, path []string, separator string, fn func(path string, value interface{})) {
+	switch node.(type) {
+	case float64, bool:
+		if len(path) > 0 {
+			fn(strings.Join(path, separator), node)
+		}
+	case map[string]interface{}, []interface{}:
+		for _, key := range childKeys(node) {
+			child, _ := childNode(node, key)
+			walkLeaves(child, append(path[:len(path):len(path)], key), separator, fn)
+		}
+	}
+}
+
+// lookupPath returns the value at the given path without wildcards.
+func lookupPath(node interface{}, path, separator string) (interface{}, bool) {
+	for _, segment := range strings.Split(path, separator) {
+		var ok bool
+		if node, ok = childNode(node, segment); !ok {
+			return nil, false
+		}
+	}
+	return node, node != nil
+}
+
+// childNode returns the value of the given key in an object or the given index in an array. Array indices may be
+// written as "0" or "[0]".
+func childNode(node interface{}, key string) (interface{}, bool) {
+	switch n := node.(type) {
+	case map[string]interface{}:
+		child, ok := n[key]
+		return child, ok
+	case []interface{}:
+		i, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(key, "["), "]"))
+		if err != nil || i < 0 || i >= len(n) {
+			return nil, false
+		}
+		return n[i], true
+	default:
+		return nil, false
+	}
+}
+
+// childKeys returns the sorted keys of an object or the indices of an array.
+func childKeys(node interface{}) []string {
+	var keys []string
+	switch n := node.(type) {
+	case map[string]interface{}:
+		for k := range n {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+	case []interface{}:
+		for i := range n {
+			keys = append(keys, strconv.Itoa(i))
+		}
+	}
+	return keys
+}
+
+func labelValue(v interface{}) string {
+	switch value := v.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return ""
+	}
+}
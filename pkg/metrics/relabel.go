@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+// relabel applies the relabel configs to the labels with the semantics of prometheus relabel_configs. It returns false
+// if the metric was dropped. Labels with an empty value or a name starting with "__" are removed afterwards.
+func relabel(labels map[string]string, configs []config.RelabelConfig) (map[string]string, bool) {
+	result := make(map[string]string, len(labels))
+	for k, v := range labels {
+		result[k] = v
+	}
+	for i := range configs {
+		if !relabelStep(result, &configs[i]) {
+			return nil, false
+		}
+	}
+	for k, v := range result {
+		if v == "" || strings.HasPrefix(k, "__") {
+			delete(result, k)
+		}
+	}
+	return result, true
+}
+
+func relabelStep(labels map[string]string, cfg *config.RelabelConfig) bool {
+	values := make([]string, 0, len(cfg.SourceLabels))
+	for _, l := range cfg.SourceLabels {
+		values = append(values, labels[l])
+	}
+	value := strings.Join(values, cfg.Separator)
+	regex := cfg.Regexp()
+
+	switch cfg.Action {
+	case config.RelabelKeep:
+		return regex.MatchString(value)
+	case config.RelabelDrop:
+		return !regex.MatchString(value)
+	case config.RelabelReplace:
+		indexes := regex.FindStringSubmatchIndex(value)
+		if indexes == nil {
+			return true
+		}
+		target := string(regex.ExpandString(nil, cfg.TargetLabel, value, indexes))
+		if !config.IsValidLabelName(target) {
+			return true
+		}
+		replacement := string(regex.ExpandString(nil, cfg.Replacement, value, indexes))
+		if replacement == "" {
+			delete(labels, target)
+		} else {
+			labels[target] = replacement
+		}
+	case config.RelabelHashMod:
+		hash := md5.Sum([]byte(value))
+		labels[cfg.TargetLabel] = fmt.Sprint(binary.BigEndian.Uint64(hash[8:]) % cfg.Modulus)
+	case config.RelabelLabelMap:
+		for _, name := range sortedKeys(labels) {
+			if regex.MatchString(name) {
+				labels[regex.ReplaceAllString(name, cfg.Replacement)] = labels[name]
+			}
+		}
+	case config.RelabelLabelDrop, config.RelabelLabelKeep:
+		for name := range labels {
+			if regex.MatchString(name) == (cfg.Action == config.RelabelLabelDrop) {
+				delete(labels, name)
+			}
+		}
+	}
+	return true
+}
+
+func sortedKeys(labels map[string]string) []string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
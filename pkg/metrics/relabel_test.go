@@ -0,0 +1,146 @@
+package metrics
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+func relabelConfig(action string, modify func(rc *config.RelabelConfig)) config.RelabelConfig {
+	rc := config.RelabelConfigDefaults
+	rc.Action = action
+	modify(&rc)
+	return config.MustNewRelabelConfig(rc)
+}
+
+func TestRelabel(t *testing.T) {
+	labels := map[string]string{"__name__": "temperature", "sensor": "test-kitchen", "topic": "home/kitchen/sensor", "sensor_type": "dht22"}
+	tests := []struct {
+		name     string
+		configs  []config.RelabelConfig
+		want     map[string]string
+		wantKeep bool
+	}{
+		{
+			name: "replace strips a prefix",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelReplace, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"sensor"}
+				rc.Regex = "test-(.*)"
+				rc.TargetLabel = "sensor"
+			})},
+			want:     map[string]string{"sensor": "kitchen", "topic": "home/kitchen/sensor", "sensor_type": "dht22"},
+			wantKeep: true,
+		},
+		{
+			name: "replace derives a label from multiple source labels",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelReplace, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"topic", "sensor_type"}
+				rc.Regex = "home/([^/]+)/.*;(.*)"
+				rc.TargetLabel = "room"
+				rc.Replacement = "$1-$2"
+			})},
+			want:     map[string]string{"sensor": "test-kitchen", "topic": "home/kitchen/sensor", "sensor_type": "dht22", "room": "kitchen-dht22"},
+			wantKeep: true,
+		},
+		{
+			name: "replace without a match keeps the labels",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelReplace, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"sensor"}
+				rc.Regex = "prod-(.*)"
+				rc.TargetLabel = "sensor"
+			})},
+			want:     map[string]string{"sensor": "test-kitchen", "topic": "home/kitchen/sensor", "sensor_type": "dht22"},
+			wantKeep: true,
+		},
+		{
+			name: "replace uses the metric name",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelReplace, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"__name__", "sensor_type"}
+				rc.Regex = "(.*);(.*)"
+				rc.TargetLabel = "series"
+				rc.Replacement = "${2}_$1"
+			})},
+			want:     map[string]string{"sensor": "test-kitchen", "topic": "home/kitchen/sensor", "sensor_type": "dht22", "series": "dht22_temperature"},
+			wantKeep: true,
+		},
+		{
+			name: "drop by metric name",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelDrop, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"__name__"}
+				rc.Regex = "temp.*"
+			})},
+		},
+		{
+			name: "replace with an empty value removes the label",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelReplace, func(rc *config.RelabelConfig) {
+				rc.TargetLabel = "sensor_type"
+				rc.Replacement = ""
+			})},
+			want:     map[string]string{"sensor": "test-kitchen", "topic": "home/kitchen/sensor"},
+			wantKeep: true,
+		},
+		{
+			name: "drop",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelDrop, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"sensor"}
+				rc.Regex = "test-.*"
+			})},
+		},
+		{
+			name: "keep",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelKeep, func(rc *config.RelabelConfig) {
+				rc.SourceLabels = []string{"sensor"}
+				rc.Regex = "prod-.*"
+			})},
+		},
+		{
+			name: "labelmap and labeldrop",
+			configs: []config.RelabelConfig{
+				relabelConfig(config.RelabelLabelMap, func(rc *config.RelabelConfig) {
+					rc.Regex = "sensor_(.*)"
+				}),
+				relabelConfig(config.RelabelLabelDrop, func(rc *config.RelabelConfig) {
+					rc.Regex = "sensor_.*|topic"
+				}),
+			},
+			want:     map[string]string{"sensor": "test-kitchen", "type": "dht22"},
+			wantKeep: true,
+		},
+		{
+			name: "labelkeep",
+			configs: []config.RelabelConfig{relabelConfig(config.RelabelLabelKeep, func(rc *config.RelabelConfig) {
+				rc.Regex = "sensor"
+			})},
+			want:     map[string]string{"sensor": "test-kitchen"},
+			wantKeep: true,
+		},
+		{
+			name: "hashmod into a temporary label",
+			configs: []config.RelabelConfig{
+				relabelConfig(config.RelabelHashMod, func(rc *config.RelabelConfig) {
+					rc.SourceLabels = []string{"sensor"}
+					rc.Modulus = 4
+					rc.TargetLabel = "__shard"
+				}),
+				relabelConfig(config.RelabelReplace, func(rc *config.RelabelConfig) {
+					rc.SourceLabels = []string{"__shard"}
+					rc.TargetLabel = "shard"
+				}),
+			},
+			want:     map[string]string{"sensor": "test-kitchen", "topic": "home/kitchen/sensor", "sensor_type": "dht22", "shard": "2"},
+			wantKeep: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, keep := relabel(labels, tt.configs)
+			if keep != tt.wantKeep {
+				t.Fatalf("relabel() keep = %v, want %v", keep, tt.wantKeep)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("relabel() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,201 @@
+package metrics
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const snapshotVersion = 1
+
+type snapshot struct {
+	Version int            `json:"version"`
+	Items   []snapshotItem `json:"items"`
+}
+
+// snapshotItem is a cached metric. The description is stored as string and looked up in the configured metrics while
+// restoring the snapshot. Discovered metrics are not configured, their description is rebuilt instead.
+type snapshotItem struct {
+	DeviceID    string               `json:"device_id"`
+	Description string               `json:"description"`
+	Value       snapshotValue        `json:"value"`
+	ValueType   prometheus.ValueType `json:"value_type"`
+	IngestTime  time.Time            `json:"ingest_time"`
+	Topic       string               `json:"topic"`
+	Labels      map[string]string    `json:"labels,omitempty"`
+	LabelsKeys  []string             `json:"labels_keys,omitempty"`
+	Path        string               `json:"path,omitempty"`
+	States      []string             `json:"states,omitempty"`
+	// Expiration is zero for metrics which never expire
+	Expiration time.Time `json:"expiration"`
+	// Discovered is nil for configured metrics
+	Discovered *snapshotDescription `json:"discovered,omitempty"`
+}
+
+// snapshotDescription has the parts of a discovered metric which are needed to rebuild its description.
+type snapshotDescription struct {
+	Name           string            `json:"name"`
+	Help           string            `json:"help,omitempty"`
+	ConstantLabels map[string]string `json:"const_labels,omitempty"`
+}
+
+// snapshotValue is a float which is encoded as JSON number if it is finite and as string otherwise, since JSON has no
+// representation for NaN and infinity.
+type snapshotValue float64
+
+func (v snapshotValue) MarshalJSON() ([]byte, error) {
+	f := float64(v)
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return json.Marshal(strconv.FormatFloat(f, 'g', -1, 64))
+	}
+	return json.Marshal(f)
+}
+
+func (v *snapshotValue) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err == nil {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		*v = snapshotValue(f)
+		return nil
+	}
+	var f float64
+	if err := json.Unmarshal(data, &f); err != nil {
+		return err
+	}
+	*v = snapshotValue(f)
+	return nil
+}
+
+// WriteSnapshot writes all cached metrics to the given file. Histograms and summaries are not part of the snapshot.
+// The file is replaced atomically.
+func (c *MemoryCachedCollector) WriteSnapshot(file string) error {
+	s := snapshot{Version: snapshotVersion}
+	for _, raw := range c.cache.Items() {
+		item := raw.Object.(CacheItem)
+		if item.Accumulator != nil || item.Metric.Description == nil {
+			continue
+		}
+		m := item.Metric
+		si := snapshotItem{
+			DeviceID:    item.DeviceID,
+			Description: m.Description.String(),
+			Value:       snapshotValue(m.Value),
+			ValueType:   m.ValueType,
+			IngestTime:  m.IngestTime,
+			Topic:       m.Topic,
+			Labels:      m.Labels,
+			LabelsKeys:  m.LabelsKeys,
+			Path:        m.Path,
+			States:      m.States,
+		}
+		if m.Discovered != nil {
+			si.Discovered = &snapshotDescription{
+				Name:           m.Discovered.PrometheusName,
+				Help:           m.Discovered.Help,
+				ConstantLabels: m.Discovered.ConstantLabels,
+			}
+		}
+		if !item.Expires.IsZero() {
+			si.Expiration = item.Expires
+		} else if raw.Expiration > 0 {
+			si.Expiration = now().Add(time.Until(time.Unix(0, raw.Expiration)))
+		}
+		s.Items = append(s.Items, si)
+	}
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) //nolint:errcheck
+	if _, err := f.Write(data); err != nil {
+		f.Close() //nolint:errcheck
+		return fmt.Errorf("failed to write file %q: %w", f.Name(), err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), file)
+}
+
+// RestoreSnapshot adds the metrics of the snapshot file to the cache with their remaining time to live and returns
+// their number. Metrics which expired in the meantime or are not configured anymore are skipped, discovered metrics are
+// restored until they expire. A missing file is not an error.
+func (c *MemoryCachedCollector) RestoreSnapshot(file string) (int, error) {
+	data, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return 0, fmt.Errorf("failed to decode snapshot %q: %w", file, err)
+	}
+	if s.Version != snapshotVersion {
+		return 0, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+
+	c.lock.RLock()
+	known := make(map[string]*prometheus.Desc, len(c.descriptions))
+	for _, d := range c.descriptions {
+		if _, ok := c.accumulating[d.String()]; !ok {
+			known[d.String()] = d
+		}
+	}
+	c.lock.RUnlock()
+
+	var restored int
+	for _, si := range s.Items {
+		desc, ok := known[si.Description]
+		var discovered *config.MetricConfig
+		if !ok && si.Discovered != nil {
+			discovered = &config.MetricConfig{
+				PrometheusName: si.Discovered.Name,
+				Help:           si.Discovered.Help,
+				ConstantLabels: si.Discovered.ConstantLabels,
+			}
+			desc = prometheus.NewDesc(si.Discovered.Name, si.Discovered.Help,
+				append([]string{"sensor", "topic"}, si.LabelsKeys...), si.Discovered.ConstantLabels)
+			ok = desc.String() == si.Description
+		}
+		if !ok {
+			continue
+		}
+		m := Metric{
+			Description: desc,
+			Value:       float64(si.Value),
+			ValueType:   si.ValueType,
+			IngestTime:  si.IngestTime,
+			Topic:       si.Topic,
+			Labels:      si.Labels,
+			LabelsKeys:  si.LabelsKeys,
+			Path:        si.Path,
+			States:      si.States,
+			Discovered:  discovered,
+		}
+		if !si.Expiration.IsZero() {
+			if m.Expiry = si.Expiration.Sub(now()); m.Expiry <= 0 {
+				continue
+			}
+		}
+		c.Observe(si.DeviceID, MetricCollection{m})
+		restored++
+	}
+	return restored, nil
+}
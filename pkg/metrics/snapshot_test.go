@@ -0,0 +1,135 @@
+package metrics
+
+import (
+	"math"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"go.uber.org/zap"
+)
+
+func TestMemoryCachedCollector_Snapshot(t *testing.T) {
+	defer func() { now = time.Now }()
+	now = testNow
+	temperature := config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge", DynamicLabels: map[string]string{"unit": "celsius"}}
+	humidity := config.MetricConfig{PrometheusName: "humidity", ValueType: "gauge"}
+	latency := config.MetricConfig{PrometheusName: "latency", ValueType: "histogram", Buckets: []float64{1}}
+	power := config.MetricConfig{PrometheusName: "power", Help: "discovered", ValueType: "gauge", ConstantLabels: map[string]string{"source": "auto"}}
+	possibleMetrics := []config.MetricConfig{temperature, humidity, latency}
+
+	c := NewCollector(time.Hour, possibleMetrics, zap.NewNop())
+	c.Observe("dht22", MetricCollection{
+		{Description: temperature.PrometheusDescription(), Value: 21.5, ValueType: temperature.PrometheusValueType(), IngestTime: testNow(), Topic: "home/dht22",
+			Labels: map[string]string{"unit": "C"}, LabelsKeys: temperature.LabelsKeys()},
+		{Description: humidity.PrometheusDescription(), Value: 40, ValueType: humidity.PrometheusValueType(), IngestTime: testNow(), Topic: "home/dht22", Expiry: time.Minute},
+		{Description: latency.PrometheusDescription(), Value: 0.5, ValueType: latency.PrometheusValueType(), IngestTime: testNow(), Topic: "home/dht22"},
+		{Description: power.PrometheusDescription(), Value: 3.2, ValueType: power.PrometheusValueType(), IngestTime: testNow(), Topic: "home/dht22", Discovered: &power},
+	})
+	file := filepath.Join(t.TempDir(), "cache-snapshot.json")
+	if err := c.WriteSnapshot(file); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		metrics  []config.MetricConfig
+		want     map[string]float64
+		wantTTLs map[string]time.Duration
+	}{
+		{
+			name:     "remaining ttl",
+			elapsed:  30 * time.Second,
+			metrics:  possibleMetrics,
+			want:     map[string]float64{"temperature": 21.5, "humidity": 40, "power": 3.2},
+			wantTTLs: map[string]time.Duration{"temperature": time.Hour - 30*time.Second, "humidity": 30 * time.Second, "power": time.Hour - 30*time.Second},
+		},
+		{
+			name:     "expired metrics are skipped",
+			elapsed:  2 * time.Minute,
+			metrics:  possibleMetrics,
+			want:     map[string]float64{"temperature": 21.5, "power": 3.2},
+			wantTTLs: map[string]time.Duration{"temperature": time.Hour - 2*time.Minute, "power": time.Hour - 2*time.Minute},
+		},
+		{
+			name:     "metrics which are not configured anymore are skipped",
+			elapsed:  30 * time.Second,
+			metrics:  []config.MetricConfig{humidity},
+			want:     map[string]float64{"humidity": 40, "power": 3.2},
+			wantTTLs: map[string]time.Duration{"humidity": 30 * time.Second, "power": time.Hour - 30*time.Second},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = func() time.Time { return testNow().Add(tt.elapsed) }
+			restoredCollector := NewCollector(time.Hour, tt.metrics, zap.NewNop())
+			restored, err := restoredCollector.RestoreSnapshot(file)
+			if err != nil {
+				t.Fatalf("RestoreSnapshot() error = %v", err)
+			}
+			if restored != len(tt.want) {
+				t.Errorf("RestoreSnapshot() = %d, want %d", restored, len(tt.want))
+			}
+			got := map[string]float64{}
+			for _, raw := range restoredCollector.(*MemoryCachedCollector).cache.Items() {
+				item := raw.Object.(CacheItem)
+				name := map[string]string{
+					temperature.PrometheusDescription().String(): "temperature",
+					humidity.PrometheusDescription().String():    "humidity",
+					power.PrometheusDescription().String():       "power",
+				}[item.Metric.Description.String()]
+				got[name] = item.Metric.Value
+				// the cache uses the wall clock for the expiration
+				ttl := time.Until(time.Unix(0, raw.Expiration))
+				if diff := tt.wantTTLs[name] - ttl; diff < 0 || diff > time.Second {
+					t.Errorf("%s: ttl = %v, want %v", name, ttl, tt.wantTTLs[name])
+				}
+				if name == "temperature" && !reflect.DeepEqual(item.Metric.Labels, map[string]string{"unit": "C"}) {
+					t.Errorf("expected the labels to be restored, got %v", item.Metric.Labels)
+				}
+				if (name == "power") != (item.Metric.Discovered != nil) {
+					t.Errorf("%s: unexpected discovered config %+v", name, item.Metric.Discovered)
+				}
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("restored %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMemoryCachedCollector_SnapshotNonFinite(t *testing.T) {
+	temperature := config.MetricConfig{PrometheusName: "temperature", ValueType: "gauge"}
+	humidity := config.MetricConfig{PrometheusName: "humidity", ValueType: "gauge"}
+	possibleMetrics := []config.MetricConfig{temperature, humidity}
+	c := NewCollector(time.Hour, possibleMetrics, zap.NewNop())
+	c.Observe("dht22", MetricCollection{
+		{Description: temperature.PrometheusDescription(), Value: math.Inf(-1), ValueType: temperature.PrometheusValueType(), Topic: "home/dht22"},
+		{Description: humidity.PrometheusDescription(), Value: math.NaN(), ValueType: humidity.PrometheusValueType(), Topic: "home/dht22"},
+	})
+	file := filepath.Join(t.TempDir(), "cache-snapshot.json")
+	if err := c.WriteSnapshot(file); err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+
+	restoredCollector := NewCollector(time.Hour, possibleMetrics, zap.NewNop())
+	if restored, err := restoredCollector.RestoreSnapshot(file); err != nil || restored != 2 {
+		t.Fatalf("RestoreSnapshot() = %d, %v, want 2", restored, err)
+	}
+	for _, raw := range restoredCollector.(*MemoryCachedCollector).cache.Items() {
+		m := raw.Object.(CacheItem).Metric
+		switch m.Description.String() {
+		case temperature.PrometheusDescription().String():
+			if !math.IsInf(m.Value, -1) {
+				t.Errorf("temperature = %v, want -Inf", m.Value)
+			}
+		case humidity.PrometheusDescription().String():
+			if !math.IsNaN(m.Value) {
+				t.Errorf("humidity = %v, want NaN", m.Value)
+			}
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The field numbers of the Sparkplug B protobuf messages, see
+// https://github.com/eclipse/tahu/blob/master/sparkplug_b/sparkplug_b.proto
+const (
+	sparkplugPayloadTimestamp   = 1
+	sparkplugPayloadMetrics     = 2
+	sparkplugMetricName         = 1
+	sparkplugMetricAlias        = 2
+	sparkplugMetricTimestamp    = 3
+	sparkplugMetricDatatype     = 4
+	sparkplugMetricIsNull       = 7
+	sparkplugMetricIntValue     = 10
+	sparkplugMetricLongValue    = 11
+	sparkplugMetricFloatValue   = 12
+	sparkplugMetricDoubleValue  = 13
+	sparkplugMetricBooleanValue = 14
+	sparkplugMetricStringValue  = 15
+)
+
+// The Sparkplug B datatypes of signed integers. The other datatypes are derived from the value field.
+const (
+	sparkplugInt8  = 1
+	sparkplugInt16 = 2
+	sparkplugInt32 = 3
+	sparkplugInt64 = 4
+)
+
+// The Sparkplug B message types.
+const (
+	sparkplugNodeBirth   = "NBIRTH"
+	sparkplugNodeDeath   = "NDEATH"
+	sparkplugNodeData    = "NDATA"
+	sparkplugDeviceBirth = "DBIRTH"
+	sparkplugDeviceDeath = "DDEATH"
+	sparkplugDeviceData  = "DDATA"
+)
+
+// sparkplugBdSeq is the metric of NBIRTH and NDEATH messages which identifies the session of the edge node.
+const sparkplugBdSeq = "bdSeq"
+
+// SparkplugNodes keeps the metric aliases and datatypes of the Sparkplug B edge nodes from their birth certificates.
+// It is passed from one Sparkplug B extractor to the next during a config reload, since the birth certificates are
+// only sent again on a rebirth.
+type SparkplugNodes struct {
+	lock sync.Mutex
+	// collector expires the metrics of dead nodes and devices, it may be nil
+	collector Collector
+	nodes     map[string]*sparkplugNode
+}
+
+type sparkplugNode struct {
+	// aliases are unique for all metrics of the node and its devices
+	aliases map[uint64]string
+	// datatypes are keyed by the device, which is empty for the node, and the metric name
+	datatypes map[[2]string]uint32
+	// deviceIDs are the device IDs of the messages of the node and of every device
+	deviceIDs map[string]map[string]bool
+	// bdSeq is the session of the last NBIRTH, if it had one
+	bdSeq    uint64
+	hasBdSeq bool
+}
+
+type sparkplugMetric struct {
+	name      string
+	alias     uint64
+	hasAlias  bool
+	timestamp uint64
+	datatype  uint32
+	isNull    bool
+	// valueField is the number of the value field, it is zero for unsupported values like datasets and templates
+	valueField protowire.Number
+	bits       uint64
+	text       string
+}
+
+// NewSparkplugNodes creates the state of the Sparkplug B extractors. If collector is not nil, the metrics of a node or
+// device are expired when it dies.
+func NewSparkplugNodes(collector Collector) *SparkplugNodes {
+	return &SparkplugNodes{
+		collector: collector,
+		nodes:     make(map[string]*sparkplugNode),
+	}
+}
+
+func (s *SparkplugNodes) node(group, node string) *sparkplugNode {
+	key := group + "/" + node
+	n, ok := s.nodes[key]
+	if !ok {
+		n = &sparkplugNode{
+			aliases:   make(map[uint64]string),
+			datatypes: make(map[[2]string]uint32),
+			deviceIDs: make(map[string]map[string]bool),
+		}
+		s.nodes[key] = n
+	}
+	return n
+}
+
+// NewSparkplugExtractor extracts the configured metrics from Sparkplug B payloads. The Sparkplug metric names are
+// matched against the mqtt_name of the metrics. Metrics in data messages which only carry an alias are resolved with
+// the aliases of the birth certificates.
+func NewSparkplugExtractor(p Parser, nodes *SparkplugNodes) Extractor {
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
+		t, ok := config.ParseSparkplugTopic(topic)
+		if !ok {
+			if config.IsSparkplugStateTopic(topic) {
+				// host applications publish their state in the namespace, it has no metrics
+				return nil, nil
+			}
+			return nil, fmt.Errorf("topic is not a Sparkplug B topic")
+		}
+		nodes.lock.Lock()
+		defer nodes.lock.Unlock()
+		node := nodes.node(t.Group, t.Node)
+		switch t.MessageType {
+		case sparkplugNodeDeath:
+			decoded, err := decodeSparkplugPayload(payload)
+			if err != nil {
+				return nil, fmt.Errorf("failed to decode Sparkplug B payload: %w", err)
+			}
+			// the will message of a previous session may arrive after the birth of the current one
+			if bdSeq, ok := decoded.bdSeq(); ok && node.hasBdSeq && bdSeq != node.bdSeq {
+				return nil, nil
+			}
+			for _, ids := range node.deviceIDs {
+				nodes.expire(ids)
+			}
+			delete(nodes.nodes, t.Group+"/"+t.Node)
+			return nil, nil
+		case sparkplugDeviceDeath:
+			nodes.expire(node.deviceIDs[t.Device])
+			delete(node.deviceIDs, t.Device)
+			return nil, nil
+		case sparkplugNodeBirth:
+			// a new session of the node invalidates all aliases
+			node = &sparkplugNode{
+				aliases:   make(map[uint64]string),
+				datatypes: make(map[[2]string]uint32),
+				deviceIDs: node.deviceIDs,
+			}
+			nodes.nodes[t.Group+"/"+t.Node] = node
+		case sparkplugDeviceBirth, sparkplugNodeData, sparkplugDeviceData:
+		default:
+			// commands and unknown message types
+			return nil, nil
+		}
+		if node.deviceIDs[t.Device] == nil {
+			node.deviceIDs[t.Device] = make(map[string]bool)
+		}
+		node.deviceIDs[t.Device][deviceID] = true
+
+		decoded, err := decodeSparkplugPayload(payload)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode Sparkplug B payload: %w", err)
+		}
+		birth := t.MessageType == sparkplugNodeBirth || t.MessageType == sparkplugDeviceBirth
+		// births share the series of the data messages
+		dataTopic := topic
+		if birth {
+			dataTopic = fmt.Sprintf("%s/%s/%s/%s", config.SparkplugNamespace, t.Group, sparkplugNodeData, t.Node)
+			if t.Device != "" {
+				dataTopic = fmt.Sprintf("%s/%s/%s/%s/%s", config.SparkplugNamespace, t.Group, sparkplugDeviceData, t.Node, t.Device)
+			}
+		}
+
+		if t.MessageType == sparkplugNodeBirth {
+			node.bdSeq, node.hasBdSeq = decoded.bdSeq()
+		}
+
+		var mc MetricCollection
+		for _, m := range decoded.metrics {
+			if birth {
+				if m.hasAlias {
+					node.aliases[m.alias] = m.name
+				}
+				node.datatypes[[2]string{t.Device, m.name}] = m.datatype
+			} else if m.name == "" {
+				if m.name, ok = node.aliases[m.alias]; !ok {
+					return nil, fmt.Errorf("unknown metric alias %d, the birth certificate of the node was not received", m.alias)
+				}
+			}
+			if m.isNull {
+				continue
+			}
+			if m.datatype == 0 {
+				m.datatype = node.datatypes[[2]string{t.Device, m.name}]
+			}
+			rawValue, ok := m.value()
+			if !ok {
+				continue
+			}
+			timestamp := m.timestamp
+			if timestamp == 0 {
+				timestamp = decoded.timestamp
+			}
+			for _, cfg := range p.findMetricConfigs(m.name, deviceID) {
+				id := metricID(dataTopic, m.name, deviceID, cfg.PrometheusName)
+				metric, err := p.parseMetric(cfg, id, rawValue, props)
+				if err != nil {
+					return nil, fmt.Errorf("failed to parse valid value from '%v' for metric %q: %w", rawValue, cfg.PrometheusName, err)
+				}
+				if timestamp != 0 && !metric.IngestTime.IsZero() {
+					metric.IngestTime = time.UnixMilli(int64(timestamp))
+				}
+				metric.Topic = dataTopic
+				mc = append(mc, metric)
+			}
+		}
+		return mc, nil
+	}
+}
+
+// expire expires the metrics of the given device IDs.
+func (s *SparkplugNodes) expire(deviceIDs map[string]bool) {
+	if s.collector == nil {
+		return
+	}
+	for deviceID := range deviceIDs {
+		s.collector.ExpireDevice(deviceID)
+	}
+}
+
+// value converts the value of the metric according to its datatype. It returns false for unsupported values.
+func (m sparkplugMetric) value() (interface{}, bool) {
+	switch m.valueField {
+	case sparkplugMetricIntValue:
+		switch m.datatype {
+		case sparkplugInt8:
+			return float64(int8(m.bits)), true
+		case sparkplugInt16:
+			return float64(int16(m.bits)), true
+		case sparkplugInt32:
+			return float64(int32(m.bits)), true
+		}
+		return float64(uint32(m.bits)), true
+	case sparkplugMetricLongValue:
+		if m.datatype == sparkplugInt64 {
+			return float64(int64(m.bits)), true
+		}
+		return float64(m.bits), true
+	case sparkplugMetricFloatValue:
+		return float64(math.Float32frombits(uint32(m.bits))), true
+	case sparkplugMetricDoubleValue:
+		return math.Float64frombits(m.bits), true
+	case sparkplugMetricBooleanValue:
+		return m.bits != 0, true
+	case sparkplugMetricStringValue:
+		return m.text, true
+	}
+	return nil, false
+}
+
+type sparkplugPayload struct {
+	timestamp uint64
+	metrics   []sparkplugMetric
+}
+
+// bdSeq returns the session of an NBIRTH or NDEATH message.
+func (p sparkplugPayload) bdSeq() (uint64, bool) {
+	for _, m := range p.metrics {
+		if m.name == sparkplugBdSeq && (m.valueField == sparkplugMetricIntValue || m.valueField == sparkplugMetricLongValue) {
+			return m.bits, true
+		}
+	}
+	return 0, false
+}
+
+func decodeSparkplugPayload(b []byte) (sparkplugPayload, error) {
+	var p sparkplugPayload
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == sparkplugPayloadTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			p.timestamp = v
+			return n, nil
+		case num == sparkplugPayloadMetrics && typ == protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			if n < 0 {
+				return n, nil
+			}
+			m, err := decodeSparkplugMetric(v)
+			if err != nil {
+				return 0, err
+			}
+			p.metrics = append(p.metrics, m)
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return p, err
+}
+
+func decodeSparkplugMetric(b []byte) (sparkplugMetric, error) {
+	var m sparkplugMetric
+	err := consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		switch {
+		case num == sparkplugMetricName && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			m.name = v
+			return n, nil
+		case num == sparkplugMetricAlias && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.alias, m.hasAlias = v, true
+			return n, nil
+		case num == sparkplugMetricTimestamp && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.timestamp = v
+			return n, nil
+		case num == sparkplugMetricDatatype && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.datatype = uint32(v)
+			return n, nil
+		case num == sparkplugMetricIsNull && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.isNull = v != 0
+			return n, nil
+		case (num == sparkplugMetricIntValue || num == sparkplugMetricLongValue || num == sparkplugMetricBooleanValue) && typ == protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			m.valueField, m.bits = num, v
+			return n, nil
+		case num == sparkplugMetricFloatValue && typ == protowire.Fixed32Type:
+			v, n := protowire.ConsumeFixed32(b)
+			m.valueField, m.bits = num, uint64(v)
+			return n, nil
+		case num == sparkplugMetricDoubleValue && typ == protowire.Fixed64Type:
+			v, n := protowire.ConsumeFixed64(b)
+			m.valueField, m.bits = num, v
+			return n, nil
+		case num == sparkplugMetricStringValue && typ == protowire.BytesType:
+			v, n := protowire.ConsumeString(b)
+			m.valueField, m.text = num, v
+			return n, nil
+		}
+		return protowire.ConsumeFieldValue(num, typ, b), nil
+	})
+	return m, err
+}
+
+// consumeFields calls consume for every field of the protobuf message. consume returns the length of the field value
+// or a negative protowire error code.
+func consumeFields(b []byte, consume func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+		n, err := consume(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return nil
+}
@@ -0,0 +1,290 @@
+package metrics
+
+import (
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/mqttclient"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// testSparkplugMetric is encoded as Sparkplug B metric. Empty fields are omitted.
+type testSparkplugMetric struct {
+	name      string
+	alias     uint64
+	timestamp uint64
+	datatype  uint64
+	value     interface{}
+}
+
+func encodeTestSparkplugPayload(timestamp uint64, metrics ...testSparkplugMetric) []byte {
+	var b []byte
+	if timestamp != 0 {
+		b = protowire.AppendTag(b, sparkplugPayloadTimestamp, protowire.VarintType)
+		b = protowire.AppendVarint(b, timestamp)
+	}
+	for _, m := range metrics {
+		var mb []byte
+		if m.name != "" {
+			mb = protowire.AppendTag(mb, sparkplugMetricName, protowire.BytesType)
+			mb = protowire.AppendString(mb, m.name)
+		}
+		if m.alias != 0 {
+			mb = protowire.AppendTag(mb, sparkplugMetricAlias, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, m.alias)
+		}
+		if m.timestamp != 0 {
+			mb = protowire.AppendTag(mb, sparkplugMetricTimestamp, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, m.timestamp)
+		}
+		if m.datatype != 0 {
+			mb = protowire.AppendTag(mb, sparkplugMetricDatatype, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, m.datatype)
+		}
+		switch v := m.value.(type) {
+		case uint32:
+			mb = protowire.AppendTag(mb, sparkplugMetricIntValue, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, uint64(v))
+		case uint64:
+			mb = protowire.AppendTag(mb, sparkplugMetricLongValue, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, v)
+		case float32:
+			mb = protowire.AppendTag(mb, sparkplugMetricFloatValue, protowire.Fixed32Type)
+			mb = protowire.AppendFixed32(mb, math.Float32bits(v))
+		case float64:
+			mb = protowire.AppendTag(mb, sparkplugMetricDoubleValue, protowire.Fixed64Type)
+			mb = protowire.AppendFixed64(mb, math.Float64bits(v))
+		case bool:
+			mb = protowire.AppendTag(mb, sparkplugMetricBooleanValue, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, protowire.EncodeBool(v))
+		case string:
+			mb = protowire.AppendTag(mb, sparkplugMetricStringValue, protowire.BytesType)
+			mb = protowire.AppendString(mb, v)
+		case nil:
+			mb = protowire.AppendTag(mb, sparkplugMetricIsNull, protowire.VarintType)
+			mb = protowire.AppendVarint(mb, 1)
+		}
+		b = protowire.AppendTag(b, sparkplugPayloadMetrics, protowire.BytesType)
+		b = protowire.AppendBytes(b, mb)
+	}
+	return b
+}
+
+func TestNewSparkplugExtractor(t *testing.T) {
+	now = testNow
+	defer func() { now = time.Now }()
+	sub := config.SubscriptionConfig{
+		ObjectPerTopicConfig: &config.ObjectPerTopicConfig{Encoding: config.EncodingSparkplugB},
+	}
+	metricConfigs := []config.MetricConfig{
+		{PrometheusName: "temperature", MQTTName: "Sensors/Temperature", ValueType: config.GaugeValueType},
+		{PrometheusName: "offset", MQTTName: "Sensors/Offset", ValueType: config.GaugeValueType},
+		{PrometheusName: "running", MQTTName: "Running", ValueType: config.GaugeValueType},
+		{PrometheusName: "mode", MQTTName: "Mode", ValueType: config.InfoValueType},
+		{PrometheusName: "counter", MQTTName: "Counter", ValueType: config.CounterValueType},
+	}
+	for i := range metricConfigs {
+		metricConfigs[i].TopicLabels = sub.TopicLabels()
+	}
+	extractor := WithTopicLabels(NewSparkplugExtractor(NewParser(metricConfigs, ".", ""), NewSparkplugNodes(nil)), sub.TopicLabelValues)
+
+	const (
+		nodeTopic   = "spBv1.0/plant/NDATA/gateway"
+		deviceTopic = "spBv1.0/plant/DDATA/gateway/pump-1"
+	)
+	labelsKeys := []string{"device", "group", "node"}
+	nodeLabels := map[string]string{"device": "", "group": "plant", "node": "gateway"}
+	deviceLabels := map[string]string{"device": "pump-1", "group": "plant", "node": "gateway"}
+	desc := func(name string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc(name, "", append([]string{"sensor", "topic", "device", "group", "node"}, labels...), nil)
+	}
+	gauge := func(name string, value float64, timestamp int64) Metric {
+		return Metric{Description: desc(name), Value: value, ValueType: prometheus.GaugeValue, IngestTime: time.UnixMilli(timestamp),
+			Topic: nodeTopic, Labels: nodeLabels, LabelsKeys: labelsKeys}
+	}
+	counter := func(value float64, ingestTime time.Time) Metric {
+		return Metric{Description: desc("counter"), Value: value, ValueType: prometheus.CounterValue, IngestTime: ingestTime,
+			Topic: deviceTopic, Labels: deviceLabels, LabelsKeys: labelsKeys}
+	}
+	mode := func(value string, ingestTime time.Time) Metric {
+		return Metric{Description: desc("mode", "value"), Value: 1, ValueType: prometheus.GaugeValue, IngestTime: ingestTime,
+			Topic: deviceTopic, Labels: map[string]string{"device": "pump-1", "group": "plant", "node": "gateway", "value": value},
+			LabelsKeys: append(labelsKeys, "value")}
+	}
+
+	steps := []struct {
+		topic   string
+		payload []byte
+		want    MetricCollection
+		wantErr bool
+	}{
+		{
+			topic: "spBv1.0/plant/NDATA/gateway",
+			payload: encodeTestSparkplugPayload(1600000000000,
+				testSparkplugMetric{alias: 1, value: float32(20)},
+			),
+			wantErr: true,
+		},
+		{
+			topic: "spBv1.0/plant/NBIRTH/gateway",
+			payload: encodeTestSparkplugPayload(1600000000000,
+				testSparkplugMetric{name: "Sensors/Temperature", alias: 1, datatype: 9, value: float32(20.5)},
+				testSparkplugMetric{name: "Sensors/Offset", alias: 2, datatype: 1, value: uint32(0xFFFFFFFE)},
+				testSparkplugMetric{name: "Running", alias: 3, datatype: 11, value: true},
+				testSparkplugMetric{name: "Unknown", alias: 4, datatype: 12, value: "ignored"},
+				testSparkplugMetric{name: "Node Control/Rebirth", alias: 5, datatype: 11, value: false},
+			),
+			want: MetricCollection{
+				gauge("temperature", 20.5, 1600000000000),
+				gauge("offset", -2, 1600000000000),
+				gauge("running", 1, 1600000000000),
+			},
+		},
+		{
+			topic: "spBv1.0/plant/NDATA/gateway",
+			payload: encodeTestSparkplugPayload(1600000001000,
+				testSparkplugMetric{alias: 1, value: float32(21)},
+				testSparkplugMetric{alias: 2, timestamp: 1600000000500, value: uint32(3)},
+				testSparkplugMetric{alias: 3, value: nil},
+			),
+			want: MetricCollection{
+				gauge("temperature", 21, 1600000001000),
+				gauge("offset", 3, 1600000000500),
+			},
+		},
+		{
+			topic: "spBv1.0/plant/DBIRTH/gateway/pump-1",
+			payload: encodeTestSparkplugPayload(0,
+				testSparkplugMetric{name: "Mode", alias: 10, datatype: 12, value: "auto"},
+				testSparkplugMetric{name: "Counter", alias: 11, datatype: 4, value: uint64(42)},
+			),
+			want: MetricCollection{
+				mode("auto", testNow()),
+				counter(42, testNow()),
+			},
+		},
+		{
+			topic: "spBv1.0/plant/DDATA/gateway/pump-1",
+			payload: encodeTestSparkplugPayload(1600000002000,
+				testSparkplugMetric{alias: 11, value: uint64(43)},
+				testSparkplugMetric{name: "Mode", value: "manual"},
+			),
+			want: MetricCollection{
+				counter(43, time.UnixMilli(1600000002000)),
+				mode("manual", time.UnixMilli(1600000002000)),
+			},
+		},
+		{
+			topic:   "spBv1.0/plant/DCMD/gateway/pump-1",
+			payload: encodeTestSparkplugPayload(0, testSparkplugMetric{name: "Mode", value: "off"}),
+		},
+		{
+			topic:   "spBv1.0/STATE/scada",
+			payload: []byte(`{"online":true,"timestamp":1600000002000}`),
+		},
+		{
+			topic:   "spBv1.0/plant/NDATA",
+			payload: encodeTestSparkplugPayload(0),
+			wantErr: true,
+		},
+		{
+			topic:   "spBv1.0/plant/NDATA/gateway",
+			payload: []byte{0xff},
+			wantErr: true,
+		},
+		{
+			// a new session invalidates the aliases
+			topic:   "spBv1.0/plant/NBIRTH/gateway",
+			payload: encodeTestSparkplugPayload(1600000003000),
+		},
+		{
+			topic:   "spBv1.0/plant/DDATA/gateway/pump-1",
+			payload: encodeTestSparkplugPayload(1600000003000, testSparkplugMetric{alias: 11, value: uint64(44)}),
+			wantErr: true,
+		},
+	}
+	for i, step := range steps {
+		mc, err := extractor(step.topic, step.payload, "gateway", MessageProperties{})
+		if (err != nil) != step.wantErr {
+			t.Fatalf("step %d: extractor() error = %v, wantErr %v", i, err, step.wantErr)
+		}
+		if !reflect.DeepEqual(mc, step.want) {
+			t.Errorf("step %d: got\n%+v\nwant\n%+v", i, mc, step.want)
+		}
+	}
+}
+
+func TestNewSparkplugExtractor_death(t *testing.T) {
+	config.SetProcessContext(zap.NewNop())
+	metricConfigs := []config.MetricConfig{
+		{PrometheusName: "temperature", MQTTName: "Temperature", ValueType: config.GaugeValueType},
+	}
+	c := NewCollector(time.Hour, metricConfigs, zap.NewNop())
+	extractor := NewSparkplugExtractor(NewParser(metricConfigs, ".", ""), NewSparkplugNodes(c))
+	ingest := NewIngest(c, nil, extractor, config.MustNewRegexp("^spBv1.0/[^/]+/[^/]+/(?P<deviceid>.*)$"), nil)
+
+	birth := encodeTestSparkplugPayload(0, testSparkplugMetric{name: "Temperature", datatype: 10, value: float64(20)})
+	for _, m := range []mqttclient.Message{
+		{Topic: "spBv1.0/plant/NBIRTH/gateway", Payload: birth},
+		{Topic: "spBv1.0/plant/DBIRTH/gateway/pump-1", Payload: birth},
+		{Topic: "spBv1.0/plant/DBIRTH/gateway/pump-2", Payload: birth},
+		{Topic: "spBv1.0/plant/NBIRTH/other", Payload: birth},
+	} {
+		if err := ingest.store(m); err != nil {
+			t.Fatalf("store(%s) error = %v", m.Topic, err)
+		}
+	}
+	series := func() []string {
+		var devices []string
+		for _, raw := range c.(*MemoryCachedCollector).cache.Items() {
+			devices = append(devices, raw.Object.(CacheItem).DeviceID)
+		}
+		sort.Strings(devices)
+		return devices
+	}
+	if got, want := series(), []string{"gateway", "gateway/pump-1", "gateway/pump-2", "other"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got series of %v, want %v", got, want)
+	}
+
+	if err := ingest.store(mqttclient.Message{Topic: "spBv1.0/plant/DDEATH/gateway/pump-1"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := series(), []string{"gateway", "gateway/pump-2", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after DDEATH: got series of %v, want %v", got, want)
+	}
+	if err := ingest.store(mqttclient.Message{Topic: "spBv1.0/plant/NDEATH/gateway"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := series(), []string{"other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after NDEATH: got series of %v, want %v", got, want)
+	}
+
+	// the will message of the previous session arrives after the rebirth
+	rebirth := encodeTestSparkplugPayload(0,
+		testSparkplugMetric{name: "bdSeq", datatype: 8, value: uint64(2)},
+		testSparkplugMetric{name: "Temperature", datatype: 10, value: float64(21)},
+	)
+	for _, m := range []mqttclient.Message{
+		{Topic: "spBv1.0/plant/NBIRTH/gateway", Payload: rebirth},
+		{Topic: "spBv1.0/plant/NDEATH/gateway", Payload: encodeTestSparkplugPayload(0, testSparkplugMetric{name: "bdSeq", datatype: 8, value: uint64(1)})},
+	} {
+		if err := ingest.store(m); err != nil {
+			t.Fatalf("store(%s) error = %v", m.Topic, err)
+		}
+	}
+	if got, want := series(), []string{"gateway", "other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after NDEATH of the previous session: got series of %v, want %v", got, want)
+	}
+	if err := ingest.store(mqttclient.Message{Topic: "spBv1.0/plant/NDEATH/gateway", Payload: encodeTestSparkplugPayload(0, testSparkplugMetric{name: "bdSeq", datatype: 8, value: uint64(2)})}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := series(), []string{"other"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("after NDEATH of the current session: got series of %v, want %v", got, want)
+	}
+}
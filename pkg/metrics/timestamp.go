@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	gojsonq "github.com/thedevsaddam/gojsonq/v2"
+)
+
+// WithPayloadTimestamp replaces the ingest time of the metrics with the timestamp read from the payload. Metrics which
+// omit their timestamp are not changed. If the payload has no timestamp, the ingest time is kept.
+func WithPayloadTimestamp(extractor Extractor, p Parser, cfg config.TimestampConfig) Extractor {
+	return func(topic string, payload []byte, deviceID string, props MessageProperties) (MetricCollection, error) {
+		mc, err := extractor(topic, payload, deviceID, props)
+		if err != nil || len(mc) == 0 {
+			return mc, err
+		}
+		parsed := gojsonq.New(gojsonq.SetSeparator(p.separator)).FromString(string(payload))
+		rawValue := parsed.Find(cfg.TimestampField)
+		if rawValue == nil {
+			return mc, nil
+		}
+		timestamp, err := parseTimestamp(rawValue, &cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse timestamp '%v' from field %q: %w", rawValue, cfg.TimestampField, err)
+		}
+		ingestTime := now()
+		if cfg.MaxTimestampAge > 0 && ingestTime.Sub(timestamp) > cfg.MaxTimestampAge {
+			return nil, fmt.Errorf("timestamp %s is more than %s in the past", timestamp.Format(time.RFC3339), cfg.MaxTimestampAge)
+		}
+		if cfg.MaxTimestampFuture > 0 && timestamp.Sub(ingestTime) > cfg.MaxTimestampFuture {
+			return nil, fmt.Errorf("timestamp %s is more than %s in the future", timestamp.Format(time.RFC3339), cfg.MaxTimestampFuture)
+		}
+		for i := range mc {
+			if !mc[i].IngestTime.IsZero() {
+				mc[i].IngestTime = timestamp
+			}
+		}
+		return mc, nil
+	}
+}
+
+// parseTimestamp parses the timestamp with the configured format. Unix timestamps can be numbers or numeric strings.
+func parseTimestamp(value interface{}, cfg *config.TimestampConfig) (time.Time, error) {
+	switch cfg.TimestampFormat {
+	case config.TimestampFormatUnix, config.TimestampFormatUnixMs, config.TimestampFormatUnixNs:
+		unit := time.Second
+		switch cfg.TimestampFormat {
+		case config.TimestampFormatUnixMs:
+			unit = time.Millisecond
+		case config.TimestampFormatUnixNs:
+			unit = time.Nanosecond
+		}
+		var n float64
+		switch v := value.(type) {
+		case float64:
+			n = v
+		case string:
+			// integers are parsed exactly, a float64 cannot hold a unix timestamp in nanoseconds
+			if i, err := strconv.ParseInt(v, 10, 64); err == nil {
+				return time.Unix(0, i*int64(unit)), nil
+			}
+			var err error
+			if n, err = strconv.ParseFloat(v, 64); err != nil {
+				return time.Time{}, err
+			}
+		default:
+			return time.Time{}, fmt.Errorf("unsupported type %T for a unix timestamp", value)
+		}
+		whole, frac := math.Modf(n)
+		return time.Unix(0, int64(whole)*int64(unit)+int64(math.Round(frac*float64(unit)))), nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return time.Time{}, fmt.Errorf("unsupported type %T for a timestamp with layout %q", value, cfg.TimestampFormat)
+	}
+	layout := cfg.TimestampFormat
+	if layout == config.TimestampFormatRFC3339 {
+		layout = time.RFC3339Nano
+	}
+	return time.ParseInLocation(layout, s, cfg.Location())
+}
@@ -0,0 +1,98 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+)
+
+func TestWithPayloadTimestamp(t *testing.T) {
+	now = testNow
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		format   string
+		timezone string
+		payload  string
+		want     time.Time
+		wantErr  bool
+	}{
+		{
+			name:    "rfc3339",
+			payload: `{"temperature": 21.5, "time": "2020-11-01T23:00:00.5+01:00"}`,
+			want:    time.Date(2020, 11, 1, 22, 0, 0, 5e8, time.UTC),
+		},
+		{
+			name:    "unix seconds",
+			format:  config.TimestampFormatUnix,
+			payload: `{"temperature": 21.5, "time": 1604268000.25}`,
+			want:    time.Date(2020, 11, 1, 22, 0, 0, 25e7, time.UTC),
+		},
+		{
+			name:    "unix milliseconds as string",
+			format:  config.TimestampFormatUnixMs,
+			payload: `{"temperature": 21.5, "time": "1604268000123"}`,
+			want:    time.Date(2020, 11, 1, 22, 0, 0, 123e6, time.UTC),
+		},
+		{
+			name:    "unix nanoseconds",
+			format:  config.TimestampFormatUnixNs,
+			payload: `{"temperature": 21.5, "time": 1604268000000000000}`,
+			want:    time.Date(2020, 11, 1, 22, 0, 0, 0, time.UTC),
+		},
+		{
+			name:     "custom layout with timezone",
+			format:   "2006-01-02 15:04:05",
+			timezone: "Europe/Berlin",
+			payload:  `{"temperature": 21.5, "time": "2020-11-01 23:00:00"}`,
+			want:     time.Date(2020, 11, 1, 23, 0, 0, 0, berlin),
+		},
+		{
+			name:    "missing timestamp keeps the ingest time",
+			payload: `{"temperature": 21.5}`,
+			want:    testNow(),
+		},
+		{
+			name:    "invalid timestamp",
+			payload: `{"temperature": 21.5, "time": "yesterday"}`,
+			wantErr: true,
+		},
+		{
+			name:    "too old",
+			payload: `{"temperature": 21.5, "time": "2020-11-01T20:00:00Z"}`,
+			wantErr: true,
+		},
+		{
+			name:    "too far in the future",
+			payload: `{"temperature": 21.5, "time": "2020-11-01T22:20:00Z"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.MustNewTimestampConfig(config.TimestampConfig{
+				TimestampField:    "time",
+				TimestampFormat:   tt.format,
+				TimestampTimezone: tt.timezone,
+			})
+			p := NewParser([]config.MetricConfig{{PrometheusName: "temperature", MQTTName: "temperature", ValueType: "gauge"}}, ".", t.TempDir())
+			mc, err := WithPayloadTimestamp(NewJSONObjectExtractor(p, nil), p, cfg)("topic", []byte(tt.payload), "device", MessageProperties{})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("extractor error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if len(mc) != 1 {
+				t.Fatalf("expected one metric, got %v", mc)
+			}
+			if !mc[0].IngestTime.Equal(tt.want) {
+				t.Errorf("timestamp = %v, want %v", mc[0].IngestTime, tt.want)
+			}
+		})
+	}
+}
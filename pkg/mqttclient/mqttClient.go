@@ -1,32 +1,248 @@
 package mqttclient
 
 import (
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"time"
+
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"go.uber.org/zap"
 )
 
-type SubscribeOptions struct {
+// ProtocolVersionMQTT5 selects the MQTT 5 client. All other protocol versions use the MQTT 3.1/3.1.1 client.
+const ProtocolVersionMQTT5 = 5
+
+// Message is a message received from the broker, independent of the protocol version.
+type Message struct {
+	Topic   string
+	Payload []byte
+	// ContentType is only set by MQTT 5 publishers
+	ContentType string
+	// UserProperties are only set by MQTT 5 publishers
+	UserProperties map[string]string
+	// Expiry is the remaining lifetime of the message. It is zero if the message does not expire.
+	Expiry time.Duration
+}
+
+type MessageHandler func(Message)
+
+type Subscription struct {
 	Topic             string
 	QoS               byte
-	OnMessageReceived mqtt.MessageHandler
-	Logger            *zap.Logger
-}
-
-func Subscribe(connectionOptions *mqtt.ClientOptions, subscribeOptions SubscribeOptions) error {
-	oldConnect := connectionOptions.OnConnect
-	connectionOptions.OnConnect = func(client mqtt.Client) {
-		logger := subscribeOptions.Logger
-		oldConnect(client)
-		logger.Info("Connected to MQTT Broker")
-		logger.Info("Will subscribe to topic", zap.String("topic", subscribeOptions.Topic))
-		if token := client.Subscribe(subscribeOptions.Topic, subscribeOptions.QoS, subscribeOptions.OnMessageReceived); token.Wait() && token.Error() != nil {
-			logger.Error("Could not subscribe", zap.Error(token.Error()))
+	OnMessageReceived MessageHandler
+}
+
+type SubscribeOptions struct {
+	Subscriptions []Subscription
+	// SharedSubscriptionGroup subscribes to all topics as shared subscription of the given group if set.
+	// The broker distributes the messages between all clients of a group.
+	SharedSubscriptionGroup string
+	Logger                  *zap.Logger
+}
+
+// ConnectionOptions configures the connection to the broker.
+type ConnectionOptions struct {
+	Server string
+	// ProtocolVersion is 3 for MQTT 3.1, 4 for MQTT 3.1.1 and 5 for MQTT 5. Zero negotiates MQTT 3.1.1 or 3.1.
+	ProtocolVersion  uint
+	ClientID         string
+	User             string
+	Password         string
+	TLSConfig        *tls.Config
+	OnConnect        func()
+	OnConnectionLost func(err error)
+}
+
+// connection is the protocol version specific part of the client.
+type connection interface {
+	connect(onConnect func()) error
+	subscribe(s Subscription) error
+	unsubscribe(topics ...string) error
+	disconnect(quiesce uint)
+}
+
+// Client is a connected MQTT client which renews its subscriptions on every reconnect.
+type Client struct {
+	conn          connection
+	logger        *zap.Logger
+	sharedGroup   string
+	lock          sync.Mutex
+	subscriptions []Subscription
+	// added are the subscriptions added after connecting, they are kept by Resubscribe
+	added []Subscription
+}
+
+func Subscribe(connectionOptions ConnectionOptions, subscribeOptions SubscribeOptions) (*Client, error) {
+	c := &Client{
+		logger:        subscribeOptions.Logger,
+		sharedGroup:   subscribeOptions.SharedSubscriptionGroup,
+		subscriptions: subscribeOptions.Subscriptions,
+	}
+	if connectionOptions.ProtocolVersion == ProtocolVersionMQTT5 {
+		c.conn = newMQTT5Connection(connectionOptions, subscribeOptions.Logger)
+	} else {
+		c.conn = newMQTT3Connection(connectionOptions)
+	}
+	err := c.conn.connect(func() {
+		if connectionOptions.OnConnect != nil {
+			connectionOptions.OnConnect()
+		}
+		c.logger.Info("Connected to MQTT Broker")
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		for _, s := range append(append([]Subscription(nil), c.subscriptions...), c.added...) {
+			if err := c.subscribe(s); err != nil {
+				c.logger.Error("Could not subscribe", zap.String("topic", s.Topic), zap.Error(err))
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Resubscribe replaces all current subscriptions with the given subscriptions. Subscriptions added with AddSubscription
+// are kept.
+func (c *Client) Resubscribe(subscriptions []Subscription) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var topics []string
+	for _, s := range c.subscriptions {
+		topics = append(topics, c.topicFilter(s.Topic))
+	}
+	c.logger.Info("Will unsubscribe from topics", zap.Strings("topics", topics))
+	if err := c.conn.unsubscribe(topics...); err != nil {
+		return fmt.Errorf("could not unsubscribe: %w", err)
+	}
+	c.subscriptions = subscriptions
+	for _, s := range subscriptions {
+		if err := c.subscribe(s); err != nil {
+			return fmt.Errorf("could not subscribe to topic %q: %w", s.Topic, err)
+		}
+	}
+	return nil
+}
+
+// AddSubscription subscribes to an additional topic. The subscription is renewed on every reconnect.
+func (c *Client) AddSubscription(s Subscription) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.added = append(c.added, s)
+	return c.subscribe(s)
+}
+
+// RemoveSubscription unsubscribes from a topic added with AddSubscription.
+func (c *Client) RemoveSubscription(topic string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for i, s := range c.added {
+		if s.Topic == topic {
+			c.added = append(c.added[:i], c.added[i+1:]...)
+			c.logger.Info("Will unsubscribe from topic", zap.String("topic", c.topicFilter(topic)))
+			return c.conn.unsubscribe(c.topicFilter(topic))
 		}
 	}
-	client := mqtt.NewClient(connectionOptions)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
+	return nil
+}
+
+// UnsubscribeAll unsubscribes from all topics, including the subscriptions added with AddSubscription. The client stays
+// connected, but no more messages are received.
+func (c *Client) UnsubscribeAll() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var topics []string
+	for _, s := range append(append([]Subscription(nil), c.subscriptions...), c.added...) {
+		topics = append(topics, c.topicFilter(s.Topic))
+	}
+	c.subscriptions, c.added = nil, nil
+	if len(topics) == 0 {
+		return nil
+	}
+	c.logger.Info("Will unsubscribe from topics", zap.Strings("topics", topics))
+	return c.conn.unsubscribe(topics...)
+}
+
+// Disconnect ends the connection to the broker after waiting up to quiesce milliseconds for existing work to complete.
+func (c *Client) Disconnect(quiesce uint) {
+	c.logger.Info("Disconnect from MQTT Broker")
+	c.conn.disconnect(quiesce)
+}
+
+func (c *Client) subscribe(s Subscription) error {
+	s.Topic = c.topicFilter(s.Topic)
+	c.logger.Info("Will subscribe to topic", zap.String("topic", s.Topic))
+	return c.conn.subscribe(s)
+}
+
+// topicFilter returns the topic filter to subscribe to for the given topic.
+func (c *Client) topicFilter(topic string) string {
+	if c.sharedGroup == "" {
+		return topic
+	}
+	return fmt.Sprintf("$share/%s/%s", c.sharedGroup, topic)
+}
+
+// mqtt3Connection implements MQTT 3.1 and 3.1.1 with the paho.mqtt.golang client.
+type mqtt3Connection struct {
+	options *mqtt.ClientOptions
+	client  mqtt.Client
+}
+
+func newMQTT3Connection(connectionOptions ConnectionOptions) *mqtt3Connection {
+	options := mqtt.NewClientOptions()
+	options.AddBroker(connectionOptions.Server).SetCleanSession(true)
+	options.SetAutoReconnect(true)
+	options.SetUsername(connectionOptions.User)
+	options.SetPassword(connectionOptions.Password)
+	options.SetClientID(connectionOptions.ClientID)
+	if connectionOptions.ProtocolVersion != 0 {
+		options.SetProtocolVersion(connectionOptions.ProtocolVersion)
+	}
+	if connectionOptions.TLSConfig != nil {
+		options.SetTLSConfig(connectionOptions.TLSConfig)
+	}
+	if connectionOptions.OnConnectionLost != nil {
+		options.SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+			connectionOptions.OnConnectionLost(err)
+		})
+	}
+	return &mqtt3Connection{options: options}
+}
+
+func (m *mqtt3Connection) connect(onConnect func()) error {
+	m.options.SetOnConnectHandler(func(mqtt.Client) {
+		onConnect()
+	})
+	m.client = mqtt.NewClient(m.options)
+	if token := m.client.Connect(); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	return nil
+}
+
+func (m *mqtt3Connection) subscribe(s Subscription) error {
+	handler := func(_ mqtt.Client, msg mqtt.Message) {
+		s.OnMessageReceived(Message{
+			Topic:   msg.Topic(),
+			Payload: msg.Payload(),
+		})
+	}
+	if token := m.client.Subscribe(s.Topic, s.QoS, handler); token.Wait() && token.Error() != nil {
 		return token.Error()
 	}
+	return nil
+}
 
+func (m *mqtt3Connection) unsubscribe(topics ...string) error {
+	if token := m.client.Unsubscribe(topics...); token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
 	return nil
 }
+
+func (m *mqtt3Connection) disconnect(quiesce uint) {
+	m.client.Disconnect(quiesce)
+}
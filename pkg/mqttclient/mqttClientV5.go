@@ -0,0 +1,196 @@
+package mqttclient
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+	"go.uber.org/zap"
+)
+
+// mqtt5Timeout limits the time to wait for the broker during connect, subscribe and unsubscribe.
+const mqtt5Timeout = 10 * time.Second
+
+// mqtt5Connection implements MQTT 5 with the paho.golang client.
+type mqtt5Connection struct {
+	options ConnectionOptions
+	logger  *zap.Logger
+	manager *autopaho.ConnectionManager
+	cancel  context.CancelFunc
+
+	// routes maps the subscribed topic filters to their handlers.
+	// The paho.golang client passes every message to a single callback.
+	routesLock sync.RWMutex
+	routes     map[string]MessageHandler
+}
+
+func newMQTT5Connection(connectionOptions ConnectionOptions, logger *zap.Logger) *mqtt5Connection {
+	return &mqtt5Connection{
+		options: connectionOptions,
+		logger:  logger,
+		routes:  make(map[string]MessageHandler),
+	}
+}
+
+func (m *mqtt5Connection) connect(onConnect func()) error {
+	server, err := url.Parse(m.options.Server)
+	if err != nil {
+		return fmt.Errorf("invalid server url %q: %w", m.options.Server, err)
+	}
+	// The connection may come up before NewConnection returns the connection manager required to subscribe.
+	ready := make(chan struct{})
+	cfg := autopaho.ClientConfig{
+		ServerUrls:                    []*url.URL{server},
+		TlsCfg:                        m.options.TLSConfig,
+		KeepAlive:                     30,
+		CleanStartOnInitialConnection: true,
+		ConnectTimeout:                mqtt5Timeout,
+		OnConnectionUp: func(*autopaho.ConnectionManager, *paho.Connack) {
+			<-ready
+			onConnect()
+		},
+		OnConnectError: func(err error) {
+			m.logger.Warn("could not connect to mqtt broker", zap.Error(err))
+		},
+		ClientConfig: paho.ClientConfig{
+			ClientID: m.options.ClientID,
+			OnPublishReceived: []func(paho.PublishReceived) (bool, error){
+				func(pr paho.PublishReceived) (bool, error) {
+					m.route(pr.Packet)
+					return true, nil
+				},
+			},
+			OnClientError: m.connectionLost,
+			OnServerDisconnect: func(d *paho.Disconnect) {
+				m.connectionLost(fmt.Errorf("server disconnected with reason code %d", d.ReasonCode))
+			},
+		},
+	}
+	if m.options.User != "" {
+		cfg.SetUsernamePassword(m.options.User, []byte(m.options.Password))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel = cancel
+	m.manager, err = autopaho.NewConnection(ctx, cfg)
+	if err != nil {
+		cancel()
+		return err
+	}
+	close(ready)
+	awaitCtx, awaitCancel := context.WithTimeout(ctx, mqtt5Timeout)
+	defer awaitCancel()
+	if err := m.manager.AwaitConnection(awaitCtx); err != nil {
+		cancel()
+		return fmt.Errorf("could not connect to %q: %w", m.options.Server, err)
+	}
+	return nil
+}
+
+func (m *mqtt5Connection) connectionLost(err error) {
+	if m.options.OnConnectionLost != nil {
+		m.options.OnConnectionLost(err)
+	}
+}
+
+func (m *mqtt5Connection) subscribe(s Subscription) error {
+	m.routesLock.Lock()
+	m.routes[s.Topic] = s.OnMessageReceived
+	m.routesLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+	defer cancel()
+	_, err := m.manager.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: []paho.SubscribeOptions{{Topic: s.Topic, QoS: s.QoS}},
+	})
+	return err
+}
+
+func (m *mqtt5Connection) unsubscribe(topics ...string) error {
+	m.routesLock.Lock()
+	for _, t := range topics {
+		delete(m.routes, t)
+	}
+	m.routesLock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mqtt5Timeout)
+	defer cancel()
+	_, err := m.manager.Unsubscribe(ctx, &paho.Unsubscribe{Topics: topics})
+	return err
+}
+
+func (m *mqtt5Connection) disconnect(quiesce uint) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(quiesce)*time.Millisecond)
+	defer cancel()
+	if err := m.manager.Disconnect(ctx); err != nil {
+		m.logger.Warn("could not disconnect cleanly", zap.Error(err))
+	}
+	m.cancel()
+}
+
+// route passes the message to the handlers of all matching subscriptions.
+func (m *mqtt5Connection) route(p *paho.Publish) {
+	msg := Message{
+		Topic:   p.Topic,
+		Payload: p.Payload,
+	}
+	if p.Properties != nil {
+		msg.ContentType = p.Properties.ContentType
+		if len(p.Properties.User) > 0 {
+			msg.UserProperties = make(map[string]string, len(p.Properties.User))
+			for _, u := range p.Properties.User {
+				msg.UserProperties[u.Key] = u.Value
+			}
+		}
+		if p.Properties.MessageExpiry != nil {
+			msg.Expiry = time.Duration(*p.Properties.MessageExpiry) * time.Second
+		}
+	}
+
+	var handlers []MessageHandler
+	m.routesLock.RLock()
+	for filter, h := range m.routes {
+		if MatchTopic(filter, p.Topic) {
+			handlers = append(handlers, h)
+		}
+	}
+	m.routesLock.RUnlock()
+	for _, h := range handlers {
+		h(msg)
+	}
+}
+
+// MatchTopic reports whether the topic matches the given topic filter. Shared subscription filters
+// ($share/<group>/<filter>) are matched without their prefix.
+func MatchTopic(filter, topic string) bool {
+	if strings.HasPrefix(filter, "$share/") {
+		parts := strings.SplitN(filter, "/", 3)
+		if len(parts) < 3 {
+			return false
+		}
+		filter = parts[2]
+	}
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	// Wildcards in the first level do not match topics starting with $, like $SYS.
+	if strings.HasPrefix(topic, "$") && (filterLevels[0] == "+" || filterLevels[0] == "#") {
+		return false
+	}
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) {
+			return false
+		}
+		if level != "+" && level != topicLevels[i] {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
@@ -0,0 +1,29 @@
+package mqttclient
+
+import "testing"
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		want   bool
+	}{
+		{filter: "tele/dev1/SENSOR", topic: "tele/dev1/SENSOR", want: true},
+		{filter: "tele/+/SENSOR", topic: "tele/dev1/SENSOR", want: true},
+		{filter: "tele/+/SENSOR", topic: "tele/dev1/STATE", want: false},
+		{filter: "tele/+", topic: "tele/dev1/SENSOR", want: false},
+		{filter: "tele/#", topic: "tele/dev1/SENSOR", want: true},
+		{filter: "tele/#", topic: "tele", want: true},
+		{filter: "#", topic: "$SYS/broker/uptime", want: false},
+		{filter: "$SYS/#", topic: "$SYS/broker/uptime", want: true},
+		{filter: "$share/exporters/tele/+/SENSOR", topic: "tele/dev1/SENSOR", want: true},
+		{filter: "$share/exporters", topic: "exporters", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.filter+" "+tt.topic, func(t *testing.T) {
+			if got := MatchTopic(tt.filter, tt.topic); got != tt.want {
+				t.Errorf("MatchTopic() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,260 @@
+package otlp
+
+import (
+	"math"
+	"sort"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// The field numbers of the OTLP metrics protobuf messages, see
+// https://github.com/open-telemetry/opentelemetry-proto/blob/main/opentelemetry/proto/metrics/v1/metrics.proto
+const (
+	exportRequestResourceMetrics = 1
+	resourceMetricsResource      = 1
+	resourceMetricsScopeMetrics  = 2
+	resourceAttributes           = 1
+	scopeMetricsScope            = 1
+	scopeMetricsMetrics          = 2
+	scopeName                    = 1
+	metricName                   = 1
+	metricDescription            = 2
+	metricGauge                  = 5
+	metricSum                    = 7
+	metricHistogram              = 9
+	metricSummary                = 11
+	dataPoints                   = 1
+	aggregationTemporality       = 2
+	sumIsMonotonic               = 3
+	pointStartTime               = 2
+	pointTime                    = 3
+	numberPointValue             = 4
+	numberPointAttributes        = 7
+	histogramPointCount          = 4
+	histogramPointSum            = 5
+	histogramPointBucketCounts   = 6
+	histogramPointExplicitBounds = 7
+	histogramPointAttributes     = 9
+	summaryPointCount            = 4
+	summaryPointSum              = 5
+	summaryPointQuantileValues   = 6
+	summaryPointAttributes       = 7
+	quantileValueQuantile        = 1
+	quantileValueValue           = 2
+	keyValueKey                  = 1
+	keyValueValue                = 2
+	anyValueString               = 1
+
+	temporalityCumulative = 2
+)
+
+const (
+	scope = "github.com/hikhvar/mqtt2prometheus"
+	// deviceLabel is the label holding the device ID of a metric
+	deviceLabel = "sensor"
+	// deviceAttribute is the resource attribute holding the device ID
+	deviceAttribute = "device.id"
+)
+
+// encodeExportRequest converts the metric families to an ExportMetricsServiceRequest. The metrics of every device are
+// grouped into their own resource, which has the device ID and the given attributes as resource attributes. Metrics
+// without a timestamp get the given time. Cumulative metrics start at the given start time.
+func encodeExportRequest(families []*dto.MetricFamily, attributes map[string]string, start, now time.Time) ([]byte, int) {
+	// points holds the encoded data points by device and family index
+	points := make(map[string]map[int][][]byte)
+	var n int
+	for i, family := range families {
+		for _, m := range family.GetMetric() {
+			point, ok := encodeDataPoint(family.GetType(), m, start, now)
+			if !ok {
+				continue
+			}
+			var device string
+			for _, l := range m.GetLabel() {
+				if l.GetName() == deviceLabel {
+					device = l.GetValue()
+				}
+			}
+			if points[device] == nil {
+				points[device] = make(map[int][][]byte)
+			}
+			points[device][i] = append(points[device][i], point)
+			n++
+		}
+	}
+
+	devices := make([]string, 0, len(points))
+	for device := range points {
+		devices = append(devices, device)
+	}
+	sort.Strings(devices)
+	var req []byte
+	for _, device := range devices {
+		var scopeMetrics []byte
+		scopeMetrics = protowire.AppendTag(scopeMetrics, scopeMetricsScope, protowire.BytesType)
+		scopeMetrics = protowire.AppendBytes(scopeMetrics, appendString(nil, scopeName, scope))
+		for i, family := range families {
+			if len(points[device][i]) == 0 {
+				continue
+			}
+			scopeMetrics = protowire.AppendTag(scopeMetrics, scopeMetricsMetrics, protowire.BytesType)
+			scopeMetrics = protowire.AppendBytes(scopeMetrics, encodeMetric(family, points[device][i]))
+		}
+
+		var resourceMetrics []byte
+		resourceMetrics = protowire.AppendTag(resourceMetrics, resourceMetricsResource, protowire.BytesType)
+		resourceMetrics = protowire.AppendBytes(resourceMetrics, encodeResource(device, attributes))
+		resourceMetrics = protowire.AppendTag(resourceMetrics, resourceMetricsScopeMetrics, protowire.BytesType)
+		resourceMetrics = protowire.AppendBytes(resourceMetrics, scopeMetrics)
+		req = protowire.AppendTag(req, exportRequestResourceMetrics, protowire.BytesType)
+		req = protowire.AppendBytes(req, resourceMetrics)
+	}
+	return req, n
+}
+
+func encodeResource(device string, attributes map[string]string) []byte {
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var resource []byte
+	for _, k := range keys {
+		resource = appendKeyValue(resource, resourceAttributes, k, attributes[k])
+	}
+	if device != "" {
+		resource = appendKeyValue(resource, resourceAttributes, deviceAttribute, device)
+	}
+	return resource
+}
+
+// encodeMetric wraps the data points of a metric family in a gauge, sum, histogram or summary.
+func encodeMetric(family *dto.MetricFamily, points [][]byte) []byte {
+	var data []byte
+	for _, p := range points {
+		data = protowire.AppendTag(data, dataPoints, protowire.BytesType)
+		data = protowire.AppendBytes(data, p)
+	}
+	var field protowire.Number
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		field = metricSum
+		data = protowire.AppendTag(data, aggregationTemporality, protowire.VarintType)
+		data = protowire.AppendVarint(data, temporalityCumulative)
+		data = protowire.AppendTag(data, sumIsMonotonic, protowire.VarintType)
+		data = protowire.AppendVarint(data, protowire.EncodeBool(true))
+	case dto.MetricType_HISTOGRAM:
+		field = metricHistogram
+		data = protowire.AppendTag(data, aggregationTemporality, protowire.VarintType)
+		data = protowire.AppendVarint(data, temporalityCumulative)
+	case dto.MetricType_SUMMARY:
+		field = metricSummary
+	default:
+		field = metricGauge
+	}
+
+	m := appendString(nil, metricName, family.GetName())
+	if family.GetHelp() != "" {
+		m = appendString(m, metricDescription, family.GetHelp())
+	}
+	m = protowire.AppendTag(m, field, protowire.BytesType)
+	return protowire.AppendBytes(m, data)
+}
+
+// encodeDataPoint converts a single metric to a data point. It returns false for unsupported metric types.
+func encodeDataPoint(typ dto.MetricType, m *dto.Metric, start, now time.Time) ([]byte, bool) {
+	timestamp := now
+	if m.TimestampMs != nil {
+		timestamp = time.UnixMilli(m.GetTimestampMs())
+	}
+	var p []byte
+	appendTimes := func(cumulative bool) {
+		if cumulative {
+			p = protowire.AppendTag(p, pointStartTime, protowire.Fixed64Type)
+			p = protowire.AppendFixed64(p, uint64(start.UnixNano()))
+		}
+		p = protowire.AppendTag(p, pointTime, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, uint64(timestamp.UnixNano()))
+	}
+	appendAttributes := func(field protowire.Number) {
+		for _, l := range m.GetLabel() {
+			p = appendKeyValue(p, field, l.GetName(), l.GetValue())
+		}
+	}
+
+	switch typ {
+	case dto.MetricType_COUNTER, dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+		value := m.GetGauge().GetValue()
+		if typ == dto.MetricType_COUNTER {
+			value = m.GetCounter().GetValue()
+		} else if typ == dto.MetricType_UNTYPED {
+			value = m.GetUntyped().GetValue()
+		}
+		appendTimes(typ == dto.MetricType_COUNTER)
+		p = protowire.AppendTag(p, numberPointValue, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, math.Float64bits(value))
+		appendAttributes(numberPointAttributes)
+	case dto.MetricType_HISTOGRAM:
+		h := m.GetHistogram()
+		appendTimes(true)
+		p = protowire.AppendTag(p, histogramPointCount, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, h.GetSampleCount())
+		p = protowire.AppendTag(p, histogramPointSum, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, math.Float64bits(h.GetSampleSum()))
+		// OTLP expects the count per bucket instead of the cumulative count and an implicit +Inf bucket.
+		var counts, bounds []byte
+		var previous uint64
+		for _, b := range h.GetBucket() {
+			if math.IsInf(b.GetUpperBound(), +1) {
+				continue
+			}
+			counts = protowire.AppendFixed64(counts, b.GetCumulativeCount()-previous)
+			bounds = protowire.AppendFixed64(bounds, math.Float64bits(b.GetUpperBound()))
+			previous = b.GetCumulativeCount()
+		}
+		counts = protowire.AppendFixed64(counts, h.GetSampleCount()-previous)
+		p = protowire.AppendTag(p, histogramPointBucketCounts, protowire.BytesType)
+		p = protowire.AppendBytes(p, counts)
+		if len(bounds) > 0 {
+			p = protowire.AppendTag(p, histogramPointExplicitBounds, protowire.BytesType)
+			p = protowire.AppendBytes(p, bounds)
+		}
+		appendAttributes(histogramPointAttributes)
+	case dto.MetricType_SUMMARY:
+		s := m.GetSummary()
+		appendTimes(true)
+		p = protowire.AppendTag(p, summaryPointCount, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, s.GetSampleCount())
+		p = protowire.AppendTag(p, summaryPointSum, protowire.Fixed64Type)
+		p = protowire.AppendFixed64(p, math.Float64bits(s.GetSampleSum()))
+		for _, q := range s.GetQuantile() {
+			var qv []byte
+			qv = protowire.AppendTag(qv, quantileValueQuantile, protowire.Fixed64Type)
+			qv = protowire.AppendFixed64(qv, math.Float64bits(q.GetQuantile()))
+			qv = protowire.AppendTag(qv, quantileValueValue, protowire.Fixed64Type)
+			qv = protowire.AppendFixed64(qv, math.Float64bits(q.GetValue()))
+			p = protowire.AppendTag(p, summaryPointQuantileValues, protowire.BytesType)
+			p = protowire.AppendBytes(p, qv)
+		}
+		appendAttributes(summaryPointAttributes)
+	default:
+		return nil, false
+	}
+	return p, true
+}
+
+func appendString(b []byte, field protowire.Number, value string) []byte {
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendString(b, value)
+}
+
+// appendKeyValue appends a KeyValue with a string value as the given field.
+func appendKeyValue(b []byte, field protowire.Number, key, value string) []byte {
+	kv := appendString(nil, keyValueKey, key)
+	kv = protowire.AppendTag(kv, keyValueValue, protowire.BytesType)
+	kv = protowire.AppendBytes(kv, appendString(nil, anyValueString, value))
+	b = protowire.AppendTag(b, field, protowire.BytesType)
+	return protowire.AppendBytes(b, kv)
+}
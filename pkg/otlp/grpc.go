@@ -0,0 +1,67 @@
+package otlp
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+const exportMethod = "/opentelemetry.proto.collector.metrics.v1.MetricsService/Export"
+
+// rawCodec passes the already encoded protobuf messages through. It is registered under the name of the proto codec,
+// so the collector sees a regular protobuf request.
+type rawCodec struct{}
+
+func (rawCodec) Marshal(v interface{}) ([]byte, error) {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return nil, fmt.Errorf("unexpected message type %T", v)
+	}
+	return *b, nil
+}
+
+func (rawCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("unexpected message type %T", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+func (rawCodec) Name() string {
+	return "proto"
+}
+
+// grpcTransport sends the requests via OTLP/gRPC.
+type grpcTransport struct {
+	conn    *grpc.ClientConn
+	headers metadata.MD
+}
+
+func newGRPCTransport(cfg config.OTLPConfig) (*grpcTransport, error) {
+	creds := credentials.NewTLS(&tls.Config{})
+	if cfg.Insecure {
+		creds = insecure.NewCredentials()
+	}
+	conn, err := grpc.NewClient(cfg.Endpoint, grpc.WithTransportCredentials(creds), grpc.WithDefaultCallOptions(grpc.ForceCodec(rawCodec{})))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP gRPC client: %w", err)
+	}
+	return &grpcTransport{conn: conn, headers: metadata.New(cfg.Headers)}, nil
+}
+
+func (g *grpcTransport) send(ctx context.Context, data []byte) error {
+	var resp []byte
+	return g.conn.Invoke(metadata.NewOutgoingContext(ctx, g.headers), exportMethod, &data, &resp)
+}
+
+func (g *grpcTransport) close() error {
+	return g.conn.Close()
+}
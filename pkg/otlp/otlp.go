@@ -0,0 +1,173 @@
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	success = "success"
+	failed  = "failed"
+)
+
+// transport sends an encoded ExportMetricsServiceRequest to the collector.
+type transport interface {
+	send(ctx context.Context, data []byte) error
+	close() error
+}
+
+// Exporter pushes the metrics of a gatherer to an OpenTelemetry collector. Failed pushes are not retried, the next
+// push contains the current values anyway.
+type Exporter struct {
+	cfg       config.OTLPConfig
+	gatherer  prometheus.Gatherer
+	transport transport
+	start     time.Time
+	notify    chan struct{}
+	logger    *zap.Logger
+
+	requestsMetric   *prometheus.CounterVec
+	dataPointsMetric prometheus.Counter
+}
+
+func New(cfg config.OTLPConfig, gatherer prometheus.Gatherer, logger *zap.Logger) (*Exporter, error) {
+	var t transport
+	var err error
+	switch cfg.Protocol {
+	case config.OTLPProtocolGRPC:
+		t, err = newGRPCTransport(cfg)
+	default:
+		t = &httpTransport{url: cfg.Endpoint, headers: cfg.Headers, client: &http.Client{Timeout: cfg.Timeout}}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Exporter{
+		cfg:       cfg,
+		gatherer:  gatherer,
+		transport: t,
+		start:     time.Now(),
+		notify:    make(chan struct{}, 1),
+		logger:    logger,
+		requestsMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt2prometheus_otlp_requests_total",
+			Help: "Total number of OTLP export requests per status",
+		}, []string{"status"}),
+		dataPointsMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt2prometheus_otlp_data_points_total",
+			Help: "Total number of data points exported via OTLP",
+		}),
+	}, nil
+}
+
+// Run pushes the metrics every interval and after every notification until the context is canceled.
+func (e *Exporter) Run(ctx context.Context) {
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-e.notify:
+		}
+		if err := e.Push(ctx); err != nil && ctx.Err() == nil {
+			e.logger.Warn("could not export metrics via OTLP", zap.Error(err))
+		}
+	}
+}
+
+// Notify triggers a push if push_on_ingest is set. Notifications during a running push are merged into one push.
+func (e *Exporter) Notify() {
+	if !e.cfg.PushOnIngest {
+		return
+	}
+	select {
+	case e.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Push exports the current metrics.
+func (e *Exporter) Push(ctx context.Context) error {
+	families, err := e.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	data, n := encodeExportRequest(families, e.cfg.ResourceAttributes, e.start, time.Now())
+	if n == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, e.cfg.Timeout)
+	defer cancel()
+	if err := e.transport.send(ctx, data); err != nil {
+		e.requestsMetric.WithLabelValues(failed).Inc()
+		return err
+	}
+	e.requestsMetric.WithLabelValues(success).Inc()
+	e.dataPointsMetric.Add(float64(n))
+	return nil
+}
+
+// Close releases the connection to the collector.
+func (e *Exporter) Close() error {
+	return e.transport.close()
+}
+
+// Collector returns the instrumentation of the exporter.
+func (e *Exporter) Collector() prometheus.Collector {
+	return e
+}
+
+func (e *Exporter) Describe(desc chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(e, desc)
+}
+
+func (e *Exporter) Collect(metrics chan<- prometheus.Metric) {
+	e.requestsMetric.Collect(metrics)
+	e.dataPointsMetric.Collect(metrics)
+}
+
+// httpTransport sends the requests as binary protobuf via OTLP/HTTP.
+type httpTransport struct {
+	url     string
+	headers map[string]string
+	client  *http.Client
+}
+
+func (h *httpTransport) send(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "mqtt2prometheus")
+	for k, v := range h.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body) //nolint:errcheck
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (h *httpTransport) close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,204 @@
+package otlp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/internal/prototest"
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/hikhvar/mqtt2prometheus/pkg/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var ingestTime = time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+func attributes(b []byte, num protowire.Number) string {
+	var attrs []string
+	for _, kv := range prototest.Fields(b, num) {
+		value := prototest.Fields(prototest.Fields(kv, keyValueValue)[0], anyValueString)[0]
+		attrs = append(attrs, string(prototest.Fields(kv, keyValueKey)[0])+"="+string(value))
+	}
+	return strings.Join(attrs, ",")
+}
+
+// decode flattens an export request to one line per data point of the form
+// "resource attributes|metric name|kind|point attributes|value|time".
+func decode(req []byte) []string {
+	var points []string
+	for _, rm := range prototest.Fields(req, exportRequestResourceMetrics) {
+		resource := attributes(prototest.Fields(rm, resourceMetricsResource)[0], resourceAttributes)
+		for _, sm := range prototest.Fields(rm, resourceMetricsScopeMetrics) {
+			for _, m := range prototest.Fields(sm, scopeMetricsMetrics) {
+				name := string(prototest.Fields(m, metricName)[0])
+				for kind, field := range map[string]protowire.Number{"gauge": metricGauge, "sum": metricSum, "histogram": metricHistogram} {
+					for _, data := range prototest.Fields(m, field) {
+						for _, p := range prototest.Fields(data, dataPoints) {
+							var value float64
+							var attrs string
+							if kind == "histogram" {
+								value = float64(prototest.Fixed64(p, histogramPointCount))
+								attrs = attributes(p, histogramPointAttributes)
+							} else {
+								value = math.Float64frombits(prototest.Fixed64(p, numberPointValue))
+								attrs = attributes(p, numberPointAttributes)
+							}
+							points = append(points, fmt.Sprintf("%s|%s|%s|%s|%g|%s", resource, name, kind, attrs, value,
+								time.Unix(0, int64(prototest.Fixed64(p, pointTime))).UTC().Format(time.RFC3339)))
+						}
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(points)
+	return points
+}
+
+func testGatherer() prometheus.Gatherer {
+	temperature := config.MetricConfig{
+		PrometheusName: "temperature",
+		ValueType:      config.GaugeValueType,
+		ConstantLabels: map[string]string{"room": "kitchen"},
+	}
+	energy := config.MetricConfig{PrometheusName: "energy_total", ValueType: config.CounterValueType}
+	collector := metrics.NewCollector(time.Minute, []config.MetricConfig{temperature, energy}, zap.NewNop())
+	collector.Observe("dht22", metrics.MetricCollection{{
+		Description: temperature.PrometheusDescription(),
+		Value:       21.5,
+		ValueType:   prometheus.GaugeValue,
+		IngestTime:  ingestTime,
+		Topic:       "devices/dht22",
+	}})
+	collector.Observe("plug", metrics.MetricCollection{{
+		Description: energy.PrometheusDescription(),
+		Value:       12,
+		ValueType:   prometheus.CounterValue,
+		IngestTime:  ingestTime,
+		Topic:       "devices/plug",
+	}})
+
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector, histogram)
+	return reg
+}
+
+var wantPoints = []string{
+	"service.name=mqtt2prometheus,device.id=dht22|temperature|gauge|room=kitchen,sensor=dht22,topic=devices/dht22|21.5|2024-05-01T12:00:00Z",
+	"service.name=mqtt2prometheus,device.id=plug|energy_total|sum|sensor=plug,topic=devices/plug|12|2024-05-01T12:00:00Z",
+	// metrics without a device have no device.id and get the current time without a timestamp
+	"service.name=mqtt2prometheus|latency|histogram||2|now",
+}
+
+func testConfig(endpoint string) config.OTLPConfig {
+	cfg := config.OTLPConfigDefaults
+	cfg.Endpoint = endpoint
+	cfg.Headers = map[string]string{"Authorization": "Bearer token"}
+	cfg.ResourceAttributes = map[string]string{"service.name": "mqtt2prometheus"}
+	return cfg
+}
+
+func TestExporter_PushHTTP(t *testing.T) {
+	var lock sync.Mutex
+	var body []byte
+	var header http.Header
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		body, _ = io.ReadAll(r.Body)
+		header = r.Header
+	}))
+	defer server.Close()
+
+	e, err := New(testConfig(server.URL+"/v1/metrics"), testGatherer(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Push(context.Background()); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	got := decode(body)
+	last := got[len(got)-1]
+	got[len(got)-1] = last[:strings.LastIndex(last, "|")] + "|now"
+	if !reflect.DeepEqual(got, wantPoints) {
+		t.Errorf("received data points\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(wantPoints, "\n"))
+	}
+	for name, value := range map[string]string{"Content-Type": "application/x-protobuf", "Authorization": "Bearer token"} {
+		if got := header.Get(name); got != value {
+			t.Errorf("expected header %s to be %q, got %q", name, value, got)
+		}
+	}
+}
+
+func TestExporter_PushHTTPError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	e, err := New(testConfig(server.URL), testGatherer(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Push(context.Background()); err == nil {
+		t.Error("expected Push() to fail")
+	}
+}
+
+func TestExporter_PushGRPC(t *testing.T) {
+	var body []byte
+	var md metadata.MD
+	var method string
+	server := grpc.NewServer(grpc.ForceServerCodec(rawCodec{}), grpc.UnknownServiceHandler(func(srv interface{}, stream grpc.ServerStream) error {
+		method, _ = grpc.MethodFromServerStream(stream)
+		md, _ = metadata.FromIncomingContext(stream.Context())
+		if err := stream.RecvMsg(&body); err != nil {
+			return err
+		}
+		return stream.SendMsg(&[]byte{})
+	}))
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve(listener) //nolint:errcheck
+	defer server.Stop()
+
+	cfg := testConfig(listener.Addr().String())
+	cfg.Protocol = config.OTLPProtocolGRPC
+	cfg.Insecure = true
+	e, err := New(cfg, testGatherer(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if err := e.Push(context.Background()); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if method != exportMethod {
+		t.Errorf("expected method %s, got %s", exportMethod, method)
+	}
+	if got := md.Get("authorization"); !reflect.DeepEqual(got, []string{"Bearer token"}) {
+		t.Errorf("expected authorization metadata, got %v", got)
+	}
+	if got := decode(body); len(got) != len(wantPoints) {
+		t.Errorf("expected %d data points, got %v", len(wantPoints), got)
+	}
+}
@@ -0,0 +1,142 @@
+package remotewrite
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const segmentSuffix = ".snappy"
+
+// queue keeps the encoded write requests on disk until they are sent. Each request is stored in its own segment file.
+// If the queue exceeds maxBytes, the oldest segments are dropped.
+type queue struct {
+	lock     sync.Mutex
+	dir      string
+	maxBytes int64
+	next     uint64
+	segments []segment
+	size     int64
+	// onDrop is called with the number of dropped segments
+	onDrop func(n int)
+}
+
+type segment struct {
+	seq  uint64
+	size int64
+}
+
+// openQueue loads the segments remaining in the directory from a previous run.
+func openQueue(dir string, maxBytes int64) (*queue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create queue directory %q: %w", dir, err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read queue directory %q: %w", dir, err)
+	}
+	q := &queue{dir: dir, maxBytes: maxBytes, onDrop: func(int) {}}
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, segmentSuffix) {
+			// left over from an interrupted write
+			if strings.HasSuffix(name, ".tmp") {
+				os.Remove(filepath.Join(dir, name)) //nolint:errcheck
+			}
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, segment{seq: seq, size: info.Size()})
+		q.size += info.Size()
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i].seq < q.segments[j].seq })
+	if len(q.segments) > 0 {
+		q.next = q.segments[len(q.segments)-1].seq + 1
+	}
+	return q, nil
+}
+
+func (q *queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, segmentSuffix))
+}
+
+// push appends the request to the queue.
+func (q *queue) push(data []byte) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	seq := q.next
+	tmp := q.path(seq) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write queue segment: %w", err)
+	}
+	if err := os.Rename(tmp, q.path(seq)); err != nil {
+		return fmt.Errorf("failed to write queue segment: %w", err)
+	}
+	q.next++
+	q.segments = append(q.segments, segment{seq: seq, size: int64(len(data))})
+	q.size += int64(len(data))
+
+	// The newest segment is always kept.
+	var dropped int
+	for q.size > q.maxBytes && len(q.segments) > 1 {
+		q.removeLocked(q.segments[0].seq)
+		dropped++
+	}
+	if dropped > 0 {
+		q.onDrop(dropped)
+	}
+	return nil
+}
+
+// peek returns the oldest request. It returns false if the queue is empty.
+func (q *queue) peek() (uint64, []byte, bool, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if len(q.segments) == 0 {
+		return 0, nil, false, nil
+	}
+	seq := q.segments[0].seq
+	data, err := os.ReadFile(q.path(seq))
+	if err != nil {
+		// drop unreadable segments, otherwise they block the queue forever
+		q.removeLocked(seq)
+		return 0, nil, false, fmt.Errorf("failed to read queue segment: %w", err)
+	}
+	return seq, data, true, nil
+}
+
+// remove deletes the segment after it was sent. Segments which were already dropped are ignored.
+func (q *queue) remove(seq uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.removeLocked(seq)
+}
+
+func (q *queue) removeLocked(seq uint64) {
+	for i, s := range q.segments {
+		if s.seq == seq {
+			os.Remove(q.path(seq)) //nolint:errcheck
+			q.size -= s.size
+			q.segments = append(q.segments[:i], q.segments[i+1:]...)
+			return
+		}
+	}
+}
+
+// bytes returns the size of all queued requests.
+func (q *queue) bytes() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.size
+}
@@ -0,0 +1,260 @@
+package remotewrite
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+const (
+	success  = "success"
+	failed   = "failed"
+	rejected = "rejected"
+)
+
+// Writer pushes the metrics of a gatherer to a prometheus remote_write endpoint. Each push is queued on disk until it
+// was accepted by the endpoint, so pushes survive connection problems and restarts.
+type Writer struct {
+	cfg           config.RemoteWriteConfig
+	gatherer      prometheus.Gatherer
+	client        *http.Client
+	authorization string
+	queue         *queue
+	notify        chan struct{}
+	// sendLock ensures that the queue is sent in order
+	sendLock sync.Mutex
+	logger   *zap.Logger
+
+	requestsMetric *prometheus.CounterVec
+	droppedMetric  prometheus.Counter
+	samplesMetric  prometheus.Counter
+	queueMetric    prometheus.GaugeFunc
+}
+
+// permanentError is returned for requests which will never be accepted by the endpoint
+type permanentError struct {
+	err error
+}
+
+func (p permanentError) Error() string {
+	return p.err.Error()
+}
+
+func New(cfg config.RemoteWriteConfig, gatherer prometheus.Gatherer, logger *zap.Logger) (*Writer, error) {
+	q, err := openQueue(cfg.QueueDirectory, cfg.MaxQueueBytes)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{
+		cfg:      cfg,
+		gatherer: gatherer,
+		client:   &http.Client{Timeout: cfg.Timeout},
+		queue:    q,
+		notify:   make(chan struct{}, 1),
+		logger:   logger,
+		requestsMetric: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt2prometheus_remote_write_requests_total",
+			Help: "Total number of remote write requests per status",
+		}, []string{"status"}),
+		droppedMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt2prometheus_remote_write_queue_dropped_total",
+			Help: "Total number of remote write requests dropped because the queue was full",
+		}),
+		samplesMetric: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt2prometheus_remote_write_samples_total",
+			Help: "Total number of samples queued for remote write",
+		}),
+	}
+	w.queueMetric = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "mqtt2prometheus_remote_write_queue_bytes",
+		Help: "Size of the remote write requests waiting in the queue",
+	}, func() float64 { return float64(q.bytes()) })
+	q.onDrop = func(n int) {
+		w.droppedMetric.Add(float64(n))
+		logger.Warn("remote write queue is full, dropped the oldest requests", zap.Int("dropped", n))
+	}
+	if w.authorization, err = authorization(cfg); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func authorization(cfg config.RemoteWriteConfig) (string, error) {
+	if cfg.BasicAuth != nil {
+		password := cfg.BasicAuth.Password
+		if cfg.BasicAuth.PasswordFile != "" {
+			data, err := os.ReadFile(cfg.BasicAuth.PasswordFile)
+			if err != nil {
+				return "", fmt.Errorf("failed to read remote_write.basic_auth.password_file: %w", err)
+			}
+			password = strings.TrimSpace(string(data))
+		}
+		req := http.Request{Header: http.Header{}}
+		req.SetBasicAuth(cfg.BasicAuth.Username, password)
+		return req.Header.Get("Authorization"), nil
+	}
+	token := cfg.BearerToken
+	if cfg.BearerTokenFile != "" {
+		data, err := os.ReadFile(cfg.BearerTokenFile)
+		if err != nil {
+			return "", fmt.Errorf("failed to read remote_write.bearer_token_file: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		return "Bearer " + token, nil
+	}
+	return "", nil
+}
+
+// Run pushes the metrics every interval and after every notification until the context is canceled.
+func (w *Writer) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-w.notify:
+		}
+		if err := w.Push(ctx); err != nil && ctx.Err() == nil {
+			w.logger.Warn("could not push metrics via remote write", zap.Error(err))
+		}
+	}
+}
+
+// Notify triggers a push if push_on_ingest is set. Notifications during a running push are merged into one push.
+func (w *Writer) Notify() {
+	if !w.cfg.PushOnIngest {
+		return
+	}
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Push queues the current metrics and sends all queued requests. Requests which could not be sent stay in the queue.
+func (w *Writer) Push(ctx context.Context) error {
+	families, err := w.gatherer.Gather()
+	if err != nil {
+		return fmt.Errorf("failed to gather metrics: %w", err)
+	}
+	if data, n := encodeWriteRequest(families, time.Now()); n > 0 {
+		if err := w.queue.push(data); err != nil {
+			return err
+		}
+		w.samplesMetric.Add(float64(n))
+	}
+	return w.sendQueue(ctx)
+}
+
+// sendQueue sends the queued requests, oldest first.
+func (w *Writer) sendQueue(ctx context.Context) error {
+	w.sendLock.Lock()
+	defer w.sendLock.Unlock()
+	for {
+		seq, data, ok, err := w.queue.peek()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+		err = w.sendWithRetries(ctx, data)
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			w.requestsMetric.WithLabelValues(rejected).Inc()
+			w.logger.Error("remote write endpoint rejected the request, dropping it", zap.Error(err))
+		} else if err != nil {
+			return err
+		}
+		w.queue.remove(seq)
+	}
+}
+
+func (w *Writer) sendWithRetries(ctx context.Context, data []byte) error {
+	backoff := w.cfg.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := w.send(ctx, data)
+		if err == nil {
+			w.requestsMetric.WithLabelValues(success).Inc()
+			return nil
+		}
+		var permanent permanentError
+		if errors.As(err, &permanent) {
+			return err
+		}
+		w.requestsMetric.WithLabelValues(failed).Inc()
+		if attempt >= w.cfg.MaxRetries {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > w.cfg.MaxBackoff {
+			backoff = w.cfg.MaxBackoff
+		}
+	}
+}
+
+func (w *Writer) send(ctx context.Context, data []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return permanentError{err}
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "mqtt2prometheus")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if w.authorization != "" {
+		req.Header.Set("Authorization", w.authorization)
+	}
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 == 2 {
+		io.Copy(io.Discard, resp.Body) //nolint:errcheck
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	// Client errors will fail again, except for rate limiting.
+	if resp.StatusCode/100 == 4 && resp.StatusCode != http.StatusTooManyRequests {
+		return permanentError{err}
+	}
+	return err
+}
+
+// Collector returns the instrumentation of the remote write.
+func (w *Writer) Collector() prometheus.Collector {
+	return w
+}
+
+func (w *Writer) Describe(desc chan<- *prometheus.Desc) {
+	prometheus.DescribeByCollect(w, desc)
+}
+
+func (w *Writer) Collect(metrics chan<- prometheus.Metric) {
+	w.requestsMetric.Collect(metrics)
+	w.droppedMetric.Collect(metrics)
+	w.samplesMetric.Collect(metrics)
+	w.queueMetric.Collect(metrics)
+}
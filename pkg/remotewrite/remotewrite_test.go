@@ -0,0 +1,224 @@
+package remotewrite
+
+import (
+	"context"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hikhvar/mqtt2prometheus/internal/prototest"
+	"github.com/hikhvar/mqtt2prometheus/pkg/config"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// receiver is a stand-in for a remote write endpoint. It answers with the given status codes in order and with 200
+// afterwards.
+type receiver struct {
+	lock     sync.Mutex
+	statuses []int
+	requests []*http.Request
+	series   map[string]float64
+}
+
+func (r *receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.requests = append(r.requests, req)
+	if len(r.statuses) > 0 {
+		status := r.statuses[0]
+		r.statuses = r.statuses[1:]
+		if status != http.StatusOK {
+			http.Error(w, "failed", status)
+			return
+		}
+	}
+	compressed, _ := io.ReadAll(req.Body)
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.series == nil {
+		r.series = make(map[string]float64)
+	}
+	for _, ts := range prototest.Fields(data, writeRequestTimeseries) {
+		var labels []string
+		for _, l := range prototest.Fields(ts, timeSeriesLabels) {
+			labels = append(labels, string(prototest.Fields(l, labelName)[0])+"="+string(prototest.Fields(l, labelValue)[0]))
+		}
+		sample := prototest.Fields(ts, timeSeriesSamples)[0]
+		r.series[strings.Join(labels, ",")] = math.Float64frombits(prototest.Fixed64(sample, sampleValue))
+	}
+}
+
+func testConfig(t *testing.T, url string) config.RemoteWriteConfig {
+	cfg := config.RemoteWriteConfigDefaults
+	cfg.URL = url
+	cfg.QueueDirectory = t.TempDir()
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxBackoff = time.Millisecond
+	return cfg
+}
+
+func testGatherer() prometheus.Gatherer {
+	reg := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "temperature"}, []string{"sensor"})
+	gauge.WithLabelValues("dht22").Set(21.5)
+	histogram := prometheus.NewHistogram(prometheus.HistogramOpts{Name: "latency", Buckets: []float64{1}})
+	histogram.Observe(0.5)
+	histogram.Observe(2)
+	reg.MustRegister(gauge, histogram)
+	return reg
+}
+
+func TestWriter_Push(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	defer server.Close()
+	cfg := testConfig(t, server.URL)
+	cfg.BasicAuth = &config.BasicAuthConfig{Username: "user", Password: "secret"}
+	w, err := New(cfg, testGatherer(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Push(context.Background()); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	want := map[string]float64{
+		"__name__=temperature,sensor=dht22": 21.5,
+		"__name__=latency_bucket,le=1":      1,
+		"__name__=latency_bucket,le=+Inf":   2,
+		"__name__=latency_sum":              2.5,
+		"__name__=latency_count":            2,
+	}
+	if !reflect.DeepEqual(r.series, want) {
+		t.Errorf("received series %v, want %v", r.series, want)
+	}
+	req := r.requests[0]
+	if user, password, _ := req.BasicAuth(); user != "user" || password != "secret" {
+		t.Errorf("expected basic auth user:secret, got %s:%s", user, password)
+	}
+	for header, value := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	} {
+		if got := req.Header.Get(header); got != value {
+			t.Errorf("expected header %s to be %q, got %q", header, value, got)
+		}
+	}
+	if w.queue.bytes() != 0 {
+		t.Errorf("expected an empty queue after a successful push, got %d bytes", w.queue.bytes())
+	}
+}
+
+func TestWriter_PushRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		statuses   []int
+		wantErr    bool
+		wantQueued int
+		wantSeries bool
+	}{
+		{name: "retry server errors", statuses: []int{http.StatusInternalServerError, http.StatusTooManyRequests}, wantSeries: true},
+		{name: "give up after max retries", statuses: []int{500, 500, 500, 500}, wantErr: true, wantQueued: 1},
+		{name: "drop rejected requests", statuses: []int{http.StatusBadRequest}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &receiver{statuses: tt.statuses}
+			server := httptest.NewServer(r)
+			defer server.Close()
+			cfg := testConfig(t, server.URL)
+			cfg.BearerToken = "token"
+			w, err := New(cfg, testGatherer(), zap.NewNop())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := w.Push(context.Background()); (err != nil) != tt.wantErr {
+				t.Fatalf("Push() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got := len(w.queue.segments); got != tt.wantQueued {
+				t.Errorf("expected %d queued requests, got %d", tt.wantQueued, got)
+			}
+			if got := len(r.series) > 0; got != tt.wantSeries {
+				t.Errorf("expected series to be received: %v, got %v", tt.wantSeries, r.series)
+			}
+			if got := r.requests[0].Header.Get("Authorization"); got != "Bearer token" {
+				t.Errorf("expected bearer token, got %q", got)
+			}
+		})
+	}
+}
+
+func TestWriter_PushQueuesWhileUnavailable(t *testing.T) {
+	r := &receiver{}
+	server := httptest.NewServer(r)
+	cfg := testConfig(t, server.URL)
+	cfg.MaxRetries = 1
+	server.Close()
+
+	w, err := New(cfg, testGatherer(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := w.Push(context.Background()); err == nil {
+			t.Fatal("expected Push() to fail while the endpoint is down")
+		}
+	}
+
+	// A restarted writer sends the queued requests of the previous one in order.
+	server = httptest.NewServer(r)
+	defer server.Close()
+	cfg.URL = server.URL
+	w, err = New(cfg, prometheus.NewRegistry(), zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := len(w.queue.segments); got != 3 {
+		t.Fatalf("expected 3 queued requests after restart, got %d", got)
+	}
+	if err := w.Push(context.Background()); err != nil {
+		t.Fatalf("Push() error = %v", err)
+	}
+	if got := len(r.requests); got != 3 {
+		t.Errorf("expected the 3 queued requests to be sent, got %d", got)
+	}
+}
+
+func TestQueue_push(t *testing.T) {
+	q, err := openQueue(t.TempDir(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var dropped int
+	q.onDrop = func(n int) { dropped += n }
+	for _, data := range []string{"aaaa", "bbbb", "cccc", "dddddddddddd"} {
+		if err := q.push([]byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var seqs []int
+	for _, s := range q.segments {
+		seqs = append(seqs, int(s.seq))
+	}
+	sort.Ints(seqs)
+	if !reflect.DeepEqual(seqs, []int{3}) || dropped != 3 {
+		t.Errorf("expected only the newest segment to be kept after dropping 3, got %v after dropping %d", seqs, dropped)
+	}
+	_, data, ok, err := q.peek()
+	if err != nil || !ok || string(data) != "dddddddddddd" {
+		t.Errorf("peek() = %q, %v, %v", data, ok, err)
+	}
+}